@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 验证管理接口密钥：ADMIN_API_KEY 或密钥库中拥有 admin 权限的密钥
+// 两者都没有时不开放管理接口
+func adminAuth(c *gin.Context) {
+	if appConfig.AdminAPIKey == "" && !apiKeys.hasScope(scopeAdmin) {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "not_found",
+			Code:    http.StatusNotFound,
+			Message: "Admin API is disabled, set ADMIN_API_KEY to enable it",
+		})
+		c.Abort()
+		return
+	}
+
+	apiKey := extractAPIKey(c)
+	if appConfig.AdminAPIKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(appConfig.AdminAPIKey)) == 1 {
+		c.Next()
+		return
+	}
+
+	k, ok := apiKeys.verify(apiKey)
+	if !ok {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "unauthorized",
+			Code:    http.StatusUnauthorized,
+			Message: "Invalid admin API key",
+		})
+		c.Abort()
+		return
+	}
+	if err := k.check(scopeAdmin, time.Now()); err != nil {
+		writeErrorResponse(c, apiKeyErrorResponse(err))
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// 缓存未启用时返回错误响应
+func requireCache(c *gin.Context) bool {
+	if synthesisCache == nil {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "not_found",
+			Code:    http.StatusNotFound,
+			Message: "Audio cache is disabled",
+		})
+		return false
+	}
+	return true
+}
+
+// 查看音频缓存统计信息
+func handleCacheStats(c *gin.Context) {
+	if !requireCache(c) {
+		return
+	}
+	c.JSON(http.StatusOK, synthesisCache.stats())
+}
+
+// 按请求体清除缓存条目的请求体，语音按 tenant 指定的租户映射，为空时使用默认租户
+type cachePurgeRequest struct {
+	OpenAITTSRequest
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// 清除音频缓存
+// 请求体为空时清空全部缓存，否则按与 /v1/audio/speech 相同的请求体删除对应条目，条目不存在时返回404
+func handleCachePurge(c *gin.Context) {
+	if !requireCache(c) {
+		return
+	}
+
+	var req cachePurgeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if errors.Is(err, io.EOF) {
+			c.JSON(http.StatusOK, gin.H{"purged": synthesisCache.purgeAll()})
+			return
+		}
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "invalid_request",
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("Invalid request format: %v", err),
+		})
+		return
+	}
+
+	tenant := tenants.defaultTenant
+	if req.Tenant != "" && req.Tenant != defaultTenantName {
+		var ok bool
+		if tenant, ok = tenants.Tenants[req.Tenant]; !ok {
+			writeErrorResponse(c, &ErrorResponse{
+				Error:   "invalid_request",
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("Unknown tenant %q", req.Tenant),
+			})
+			return
+		}
+	}
+
+	params, _, err := prepareSynthesis(tenant, req.OpenAITTSRequest)
+	if err != nil {
+		writeSynthesisError(c, err)
+		return
+	}
+
+	key := audioCacheKey(params)
+	if !synthesisCache.purge(key) {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "not_found",
+			Code:    http.StatusNotFound,
+			Message: fmt.Sprintf("Cache entry not found for key %s", key),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": 1, "key": key})
+}
+
+// 按缓存键删除一个缓存条目，缓存键由 X-Cache-Key 响应头返回
+func handleCachePurgeKey(c *gin.Context) {
+	if !requireCache(c) {
+		return
+	}
+
+	key := c.Param("key")
+	if !isCacheKey(key) {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "invalid_request",
+			Code:    http.StatusBadRequest,
+			Message: "Cache key must be a hex-encoded SHA-256 digest",
+		})
+		return
+	}
+
+	if !synthesisCache.purge(key) {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "not_found",
+			Code:    http.StatusNotFound,
+			Message: "Cache entry not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": 1, "key": key})
+}
+
+// 创建密钥的请求体
+type createAPIKeyRequest struct {
+	// Name 密钥名称
+	Name string `json:"name"`
+	// Scopes 权限范围，默认只有 speech
+	Scopes []string `json:"scopes"`
+	// Tenant 密钥所属的租户，默认为默认租户
+	Tenant string `json:"tenant"`
+	// ExpiresAt 过期时间，为空表示不过期
+	ExpiresAt *time.Time `json:"expires_at"`
+	// RateLimit 该密钥的限流额度，默认使用 RATE_LIMIT_KEY_* 的设置
+	RateLimit *rateLimitConfig `json:"rate_limit"`
+	// Quota 该密钥每天和每月的配额，默认使用 QUOTA_KEY_* 的设置
+	Quota *quotaConfig `json:"quota"`
+}
+
+// 修改密钥的请求体，省略的字段保持不变
+type updateAPIKeyRequest struct {
+	Name      *string          `json:"name"`
+	Scopes    []string         `json:"scopes"`
+	Enabled   *bool            `json:"enabled"`
+	ExpiresAt *time.Time       `json:"expires_at"`
+	RateLimit *rateLimitConfig `json:"rate_limit"`
+	Quota     *quotaConfig     `json:"quota"`
+}
+
+// 轮换密钥的请求体
+type rotateAPIKeyRequest struct {
+	// GracePeriod 旧密钥继续有效的时间，例如 "1h"，默认立即失效
+	GracePeriod string `json:"grace_period"`
+}
+
+// 返回管理接口错误
+func writeAPIKeyError(c *gin.Context, err error) {
+	statusCode := http.StatusInternalServerError
+	errorType := "internal_error"
+	switch {
+	case errors.Is(err, ErrAPIKeyNotFound):
+		statusCode = http.StatusNotFound
+		errorType = "not_found"
+	case errors.Is(err, ErrInvalidRequest):
+		statusCode = http.StatusBadRequest
+		errorType = "invalid_request"
+	}
+	writeErrorResponse(c, &ErrorResponse{
+		Error:   errorType,
+		Code:    statusCode,
+		Message: err.Error(),
+	})
+}
+
+// 返回请求体格式错误
+func writeInvalidRequest(c *gin.Context, err error) {
+	writeErrorResponse(c, &ErrorResponse{
+		Error:   "invalid_request",
+		Code:    http.StatusBadRequest,
+		Message: fmt.Sprintf("Invalid request format: %v", err),
+	})
+}
+
+// 列出密钥库中的密钥，不包含哈希
+func handleListAPIKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": apiKeys.list()})
+}
+
+// 创建密钥，明文密钥只在响应的 key 字段中返回一次
+func handleCreateAPIKey(c *gin.Context) {
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeInvalidRequest(c, err)
+		return
+	}
+	if req.Scopes == nil {
+		req.Scopes = []string{scopeSpeech}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeAPIKeyError(c, fmt.Errorf("%w: expires_at must be in the future", ErrInvalidRequest))
+		return
+	}
+
+	k, plaintext, err := apiKeys.create(apiKeyRecord{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		Tenant:    req.Tenant,
+		ExpiresAt: req.ExpiresAt,
+		RateLimit: req.RateLimit,
+		Quota:     req.Quota,
+	})
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+
+	info := k.info()
+	info["key"] = plaintext
+	c.JSON(http.StatusCreated, info)
+}
+
+// 修改密钥的名称、权限范围、启用状态、过期时间、限流额度或配额，立即生效
+func handleUpdateAPIKey(c *gin.Context) {
+	var req updateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeInvalidRequest(c, err)
+		return
+	}
+
+	k, err := apiKeys.update(c.Param("id"), func(k *apiKeyRecord) error {
+		if req.Name != nil {
+			k.Name = *req.Name
+		}
+		if req.Scopes != nil {
+			k.Scopes = req.Scopes
+		}
+		if req.ExpiresAt != nil {
+			k.ExpiresAt = req.ExpiresAt
+		}
+		if req.RateLimit != nil {
+			k.RateLimit = req.RateLimit
+		}
+		if req.Quota != nil {
+			k.Quota = req.Quota
+		}
+		if req.Enabled != nil {
+			k.Enabled = *req.Enabled
+			if k.Enabled {
+				k.RevokedAt = nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, k.info())
+}
+
+// 轮换密钥，新的明文密钥只在响应的 key 字段中返回一次
+// 请求体可以指定 grace_period，旧密钥在这段时间内仍然有效
+func handleRotateAPIKey(c *gin.Context) {
+	var req rotateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeInvalidRequest(c, err)
+		return
+	}
+	var grace time.Duration
+	if req.GracePeriod != "" {
+		var err error
+		grace, err = time.ParseDuration(req.GracePeriod)
+		if err != nil || grace < 0 {
+			writeAPIKeyError(c, fmt.Errorf("%w: grace_period must be a non-negative duration such as \"1h\"", ErrInvalidRequest))
+			return
+		}
+	}
+
+	k, plaintext, err := apiKeys.rotate(c.Param("id"), grace)
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+
+	info := k.info()
+	info["key"] = plaintext
+	c.JSON(http.StatusOK, info)
+}
+
+// 吊销密钥，立即生效；记录保留在密钥库中
+func handleRevokeAPIKey(c *gin.Context) {
+	k, err := apiKeys.revoke(c.Param("id"))
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, k.info())
+}
+
+// 密钥的配额，id 为密钥库中的密钥ID，或已有计数的其他密钥的ID
+func apiKeyQuota(id string) (quotaConfig, error) {
+	k, err := apiKeys.get(id)
+	if err == nil {
+		return appConfig.QuotaKey.merge(k.Quota), nil
+	}
+	if quotas.has(id) {
+		return appConfig.QuotaKey, nil
+	}
+	return quotaConfig{}, err
+}
+
+// 查询密钥的配额、当前周期的用量和剩余配额
+func handleGetAPIKeyQuota(c *gin.Context) {
+	id := c.Param("id")
+	limits, err := apiKeyQuota(id)
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+
+	usage := quotas.current(id)
+	now := time.Now().UTC()
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":    id,
+		"limits":    limits,
+		"usage":     usage,
+		"remaining": limits.remaining(usage),
+		"resets_at": gin.H{
+			quotaPeriodDay:   quotaPeriodEnd(quotaPeriodDay, now),
+			quotaPeriodMonth: quotaPeriodEnd(quotaPeriodMonth, now),
+		},
+	})
+}
+
+// 清零密钥的配额用量，查询参数 period 为 day 或 month，省略时清零全部周期
+func handleResetAPIKeyQuota(c *gin.Context) {
+	id := c.Param("id")
+	period := c.Query("period")
+	if period != "" && period != quotaPeriodDay && period != quotaPeriodMonth {
+		writeAPIKeyError(c, fmt.Errorf("%w: period must be %s or %s", ErrInvalidRequest, quotaPeriodDay, quotaPeriodMonth))
+		return
+	}
+	limits, err := apiKeyQuota(id)
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	if err := quotas.reset(id, period); err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+
+	usage := quotas.current(id)
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":    id,
+		"limits":    limits,
+		"usage":     usage,
+		"remaining": limits.remaining(usage),
+	})
+}
+
+// 解析用量统计查询参数
+// from、to 为 UTC 日期（包含），默认最近30天；group_by 为逗号分隔的分组维度，默认 key,day,voice
+func parseUsageQuery(c *gin.Context) (usageQuery, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	q := usageQuery{
+		From:    today.AddDate(0, 0, -29),
+		To:      today.AddDate(0, 0, 1),
+		GroupBy: []string{usageByKey, usageByDay, usageByVoice},
+		KeyID:   c.Query("key"),
+		Tenant:  c.Query("tenant"),
+	}
+
+	if from := c.Query("from"); from != "" {
+		day, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			return q, fmt.Errorf("%w: from must be a date such as 2006-01-02", ErrInvalidRequest)
+		}
+		q.From = day
+	}
+	if to := c.Query("to"); to != "" {
+		day, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			return q, fmt.Errorf("%w: to must be a date such as 2006-01-02", ErrInvalidRequest)
+		}
+		q.To = day.AddDate(0, 0, 1)
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("%w: from must not be after to", ErrInvalidRequest)
+	}
+
+	if groupBy := c.Query("group_by"); groupBy != "" {
+		q.GroupBy = nil
+		for _, dim := range strings.Split(groupBy, ",") {
+			dim = strings.TrimSpace(dim)
+			if !slices.Contains(usageDimensions, dim) {
+				return q, fmt.Errorf("%w: unknown group_by dimension %q, must be one of %v", ErrInvalidRequest, dim, usageDimensions)
+			}
+			if !slices.Contains(q.GroupBy, dim) {
+				q.GroupBy = append(q.GroupBy, dim)
+			}
+		}
+	}
+	return q, nil
+}
+
+// 按密钥、租户、日期和语音汇总用量，format=csv 时以CSV文件下载
+func handleUsageReport(c *gin.Context) {
+	if usageRecorder == nil {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "not_found",
+			Code:    http.StatusNotFound,
+			Message: "Usage accounting is disabled, set USAGE_LOG_FILE to enable it",
+		})
+		return
+	}
+
+	q, err := parseUsageQuery(c)
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	report, err := usageRecorder.aggregate(q)
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+
+	switch c.Query("format") {
+	case "", "json":
+		c.JSON(http.StatusOK, report)
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s-%s.csv", report.From, report.To))
+		c.Status(http.StatusOK)
+		if err := report.writeCSV(csv.NewWriter(c.Writer)); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Error writing usage report", "error", err)
+		}
+	default:
+		writeAPIKeyError(c, fmt.Errorf("%w: format must be json or csv", ErrInvalidRequest))
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 共享并发调用名额的调用方，按API密钥区分
+type callFlow struct {
+	policy   callPolicy
+	maxSlots int     // 最多同时占用的名额数，由 max_share 计算
+	inUse    int     // 当前占用的名额数
+	waiting  int     // 正在排队的请求数
+	lastTag  float64 // 最近一个排队请求的虚拟完成时间
+}
+
+// 等待并发调用名额的请求
+type admissionWaiter struct {
+	flow     *callFlow
+	priority string
+	tag      float64       // 虚拟完成时间，越小越先获得名额
+	ready    chan struct{} // 分配到名额时关闭
+	granted  bool          // 是否已分配名额，由队列锁保护
+}
+
+// 并发调用准入队列，按调用方加权公平调度
+// 名额用尽时请求排队等待：interactive 请求总是先于 batch 请求，同一优先级内按权重公平分配，
+// 每个调用方占用的名额不超过其 max_share；队列已满或等待超时时才拒绝
+type admissionQueue struct {
+	slots    int           // 最大并发调用数
+	maxDepth int           // 最大排队请求数，0表示不排队
+	maxWait  time.Duration // 最长排队时间
+
+	mu       sync.Mutex
+	inUse    int
+	waiters  *list.List // 元素为 *admissionWaiter，按到达顺序
+	flows    map[string]*callFlow
+	virtTime float64 // 最近一个获得名额的请求的虚拟完成时间
+
+	// 统计信息，由队列锁保护
+	queued       int64         // 进入过队列的请求数
+	rejected     int64         // 队列已满被拒绝的请求数
+	timeouts     int64         // 等待超时的请求数
+	cancelled    int64         // 等待期间取消的请求数
+	totalWait    time.Duration // 排队后获得名额的请求的总等待时间
+	admittedWait int64         // 排队后获得名额的请求数
+	longestWait  time.Duration // 最长等待时间
+}
+
+// 全局并发调用准入队列，在 init 中创建
+var callQueue *admissionQueue
+
+// 创建准入队列
+func newAdmissionQueue(slots, maxDepth int, maxWait time.Duration) *admissionQueue {
+	return &admissionQueue{
+		slots:    slots,
+		maxDepth: maxDepth,
+		maxWait:  maxWait,
+		waiters:  list.New(),
+		flows:    make(map[string]*callFlow),
+	}
+}
+
+// 获取调用方，不存在时创建，调用方需持有锁
+func (q *admissionQueue) flowLocked(policy callPolicy) *callFlow {
+	if f, ok := q.flows[policy.Name]; ok {
+		return f
+	}
+	f := &callFlow{
+		policy:   policy,
+		maxSlots: max(1, int(math.Ceil(policy.MaxShare*float64(q.slots)))),
+		lastTag:  q.virtTime,
+	}
+	q.flows[policy.Name] = f
+	return f
+}
+
+// 调用方空闲时移除，空闲调用方重新排队时不保留过去的虚拟时间，调用方需持有锁
+func (q *admissionQueue) releaseFlowLocked(f *callFlow) {
+	if f.inUse == 0 && f.waiting == 0 {
+		delete(q.flows, f.policy.Name)
+	}
+}
+
+// 按优先级和虚拟完成时间将空闲名额分配给排队请求，调用方需持有锁
+func (q *admissionQueue) dispatchLocked() {
+	for q.inUse < q.slots {
+		var best *list.Element
+		for e := q.waiters.Front(); e != nil; e = e.Next() {
+			w := e.Value.(*admissionWaiter)
+			if w.flow.inUse >= w.flow.maxSlots {
+				continue
+			}
+			if best == nil || waiterBefore(w, best.Value.(*admissionWaiter)) {
+				best = e
+			}
+		}
+		if best == nil {
+			return
+		}
+
+		w := best.Value.(*admissionWaiter)
+		q.waiters.Remove(best)
+		w.flow.waiting--
+		w.flow.inUse++
+		q.inUse++
+		q.virtTime = max(q.virtTime, w.tag)
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// 请求 a 是否应先于 b 获得名额
+func waiterBefore(a, b *admissionWaiter) bool {
+	if a.priority != b.priority {
+		return a.priority == priorityInteractive
+	}
+	return a.tag < b.tag
+}
+
+// 获取一个名额，名额用尽时排队等待，返回释放名额的函数
+// 调度类别由 ctx 中的调用方策略和优先级决定；队列已满、等待超时或 ctx 取消时返回错误
+func (q *admissionQueue) acquire(ctx context.Context) (func(), error) {
+	class := callClassFromContext(ctx)
+
+	q.mu.Lock()
+	f := q.flowLocked(class.policy)
+	// 虚拟完成时间：调用方上一个请求之后，权重越高增长越慢
+	f.lastTag = max(f.lastTag, q.virtTime) + 1/class.policy.Weight
+	w := &admissionWaiter{
+		flow:     f,
+		priority: class.priority,
+		tag:      f.lastTag,
+		ready:    make(chan struct{}),
+	}
+	elem := q.waiters.PushBack(w)
+	f.waiting++
+	q.dispatchLocked()
+	if w.granted {
+		q.mu.Unlock()
+		metricCallQueueWait.WithLabelValues("admitted").Observe(0)
+		return q.releaser(f), nil
+	}
+	if q.waiters.Len() > q.maxDepth {
+		q.removeWaiterLocked(elem)
+		q.rejected++
+		q.mu.Unlock()
+		return nil, fmt.Errorf("%w: maximum concurrent calls (%d) reached and wait queue is full",
+			ErrTooManyConnections, q.slots)
+	}
+	q.queued++
+	q.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(q.maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		q.recordWait(time.Since(start))
+		return q.releaser(f), nil
+	case <-timer.C:
+		err = fmt.Errorf("%w: timed out after %v waiting for a synthesis slot",
+			ErrTooManyConnections, q.maxWait)
+	case <-ctx.Done():
+		err = fmt.Errorf("%w while waiting for a synthesis slot: %w", ErrRequestCancelled, context.Cause(ctx))
+	}
+
+	q.mu.Lock()
+	if w.granted {
+		// 超时或取消的同时已分配到名额，仍视为获得名额
+		q.mu.Unlock()
+		q.recordWait(time.Since(start))
+		return q.releaser(f), nil
+	}
+	q.removeWaiterLocked(elem)
+	result := "timeout"
+	if ctx.Err() != nil {
+		q.cancelled++
+		result = "cancelled"
+	} else {
+		q.timeouts++
+	}
+	q.mu.Unlock()
+	metricCallQueueWait.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return nil, err
+}
+
+// 移除未获得名额的排队请求，调用方需持有锁
+func (q *admissionQueue) removeWaiterLocked(elem *list.Element) {
+	w := q.waiters.Remove(elem).(*admissionWaiter)
+	w.flow.waiting--
+	q.releaseFlowLocked(w.flow)
+}
+
+// 名额空闲时获取一个名额，不等待，返回释放名额的函数
+// 用于长文本的额外并行片段，只使用排队请求无法使用的空闲名额
+func (q *admissionQueue) tryAcquire(ctx context.Context) (func(), bool) {
+	class := callClassFromContext(ctx)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.inUse >= q.slots {
+		return nil, false
+	}
+	f := q.flowLocked(class.policy)
+	if f.inUse >= f.maxSlots {
+		q.releaseFlowLocked(f)
+		return nil, false
+	}
+	f.inUse++
+	q.inUse++
+	return q.releaser(f), true
+}
+
+// 返回释放调用方名额的函数，释放后将名额分配给排队请求
+func (q *admissionQueue) releaser(f *callFlow) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			f.inUse--
+			q.inUse--
+			q.dispatchLocked()
+			q.releaseFlowLocked(f)
+		})
+	}
+}
+
+// 记录排队等待时间
+func (q *admissionQueue) recordWait(wait time.Duration) {
+	metricCallQueueWait.WithLabelValues("admitted").Observe(wait.Seconds())
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.totalWait += wait
+	q.admittedWait++
+	if wait > q.longestWait {
+		q.longestWait = wait
+	}
+}
+
+// 当前使用中的名额数
+func (q *admissionQueue) active() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.inUse
+}
+
+// 准入队列统计信息，包括每个活跃调用方占用和排队的情况
+func (q *admissionQueue) stats() map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var avgWait time.Duration
+	if q.admittedWait > 0 {
+		avgWait = q.totalWait / time.Duration(q.admittedWait)
+	}
+
+	flows := make([]map[string]interface{}, 0, len(q.flows))
+	for _, f := range q.flows {
+		flows = append(flows, map[string]interface{}{
+			"name":      f.policy.Name,
+			"priority":  f.policy.Priority,
+			"weight":    f.policy.Weight,
+			"max_slots": f.maxSlots,
+			"in_use":    f.inUse,
+			"waiting":   f.waiting,
+		})
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i]["name"].(string) < flows[j]["name"].(string) })
+
+	return map[string]interface{}{
+		"length":          q.waiters.Len(),
+		"max_depth":       q.maxDepth,
+		"max_wait_ms":     q.maxWait.Milliseconds(),
+		"queued":          q.queued,
+		"rejected":        q.rejected,
+		"timeouts":        q.timeouts,
+		"cancelled":       q.cancelled,
+		"avg_wait_ms":     avgWait.Milliseconds(),
+		"longest_wait_ms": q.longestWait.Milliseconds(),
+		"flows":           flows,
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 创建指定调度策略和优先级的请求上下文
+func testCallContext(name string, weight, maxShare float64, priority string) context.Context {
+	policy := callPolicy{Name: name, Weight: weight, MaxShare: maxShare, Priority: priority}
+	return withCallClass(context.Background(), callClass{policy: policy, priority: priority})
+}
+
+// 等待排队请求数达到 n
+func waitQueueLength(t *testing.T, q *admissionQueue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		q.mu.Lock()
+		length := q.waiters.Len()
+		q.mu.Unlock()
+		if length == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue length = %d, want %d", length, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdmissionQueueAcquire(t *testing.T) {
+	tests := []struct {
+		name     string
+		slots    int
+		maxDepth int
+		maxWait  time.Duration
+		held     int  // 预先占用的名额数
+		cancel   bool // 排队前取消请求
+		wantErr  error
+		stat     string // 失败时应增加的统计项
+	}{
+		{name: "free slot", slots: 2, maxDepth: 0, maxWait: time.Second, held: 1},
+		{name: "queue disabled", slots: 1, maxDepth: 0, maxWait: time.Second, held: 1, wantErr: ErrTooManyConnections, stat: "rejected"},
+		{name: "wait timeout", slots: 1, maxDepth: 1, maxWait: 20 * time.Millisecond, held: 1, wantErr: ErrTooManyConnections, stat: "timeouts"},
+		{name: "cancelled while waiting", slots: 1, maxDepth: 1, maxWait: time.Second, held: 1, cancel: true, wantErr: ErrRequestCancelled, stat: "cancelled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newAdmissionQueue(tt.slots, tt.maxDepth, tt.maxWait)
+			for i := 0; i < tt.held; i++ {
+				release, err := q.acquire(testCallContext("holder", 1, 1, priorityInteractive))
+				if err != nil {
+					t.Fatalf("acquire: %v", err)
+				}
+				defer release()
+			}
+
+			ctx, cancel := context.WithCancel(testCallContext("caller", 1, 1, priorityInteractive))
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			release, err := q.acquire(ctx)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("acquire: %v", err)
+				}
+				release()
+				if got := q.active(); got != tt.held {
+					t.Errorf("active = %d after release, want %d", got, tt.held)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got := q.stats()[tt.stat]; got != int64(1) {
+				t.Errorf("%s = %v, want 1", tt.stat, got)
+			}
+			if got := q.stats()["length"]; got != 0 {
+				t.Errorf("queue length = %v after failure, want 0", got)
+			}
+		})
+	}
+}
+
+func TestAdmissionQueueOrder(t *testing.T) {
+	type waiter struct {
+		name     string
+		flow     string
+		weight   float64
+		priority string
+	}
+	tests := []struct {
+		name    string
+		waiters []waiter // 按到达顺序
+		want    []string // 获得名额的顺序
+	}{
+		{
+			name: "interactive before batch",
+			waiters: []waiter{
+				{name: "b1", flow: "b", weight: 1, priority: priorityBatch},
+				{name: "b2", flow: "b", weight: 1, priority: priorityBatch},
+				{name: "i1", flow: "i", weight: 1, priority: priorityInteractive},
+			},
+			want: []string{"i1", "b1", "b2"},
+		},
+		{
+			name: "fair between flows with equal weight",
+			waiters: []waiter{
+				{name: "a1", flow: "a", weight: 1, priority: priorityInteractive},
+				{name: "a2", flow: "a", weight: 1, priority: priorityInteractive},
+				{name: "a3", flow: "a", weight: 1, priority: priorityInteractive},
+				{name: "b1", flow: "b", weight: 1, priority: priorityInteractive},
+				{name: "b2", flow: "b", weight: 1, priority: priorityInteractive},
+			},
+			want: []string{"a1", "b1", "a2", "b2", "a3"},
+		},
+		{
+			name: "weighted share",
+			waiters: []waiter{
+				{name: "a1", flow: "a", weight: 2, priority: priorityInteractive},
+				{name: "a2", flow: "a", weight: 2, priority: priorityInteractive},
+				{name: "a3", flow: "a", weight: 2, priority: priorityInteractive},
+				{name: "a4", flow: "a", weight: 2, priority: priorityInteractive},
+				{name: "b1", flow: "b", weight: 1, priority: priorityInteractive},
+				{name: "b2", flow: "b", weight: 1, priority: priorityInteractive},
+			},
+			want: []string{"a1", "a2", "b1", "a3", "a4", "b2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newAdmissionQueue(1, len(tt.waiters), 5*time.Second)
+			releaseHolder, err := q.acquire(testCallContext("holder", 1, 1, priorityInteractive))
+			if err != nil {
+				t.Fatalf("acquire: %v", err)
+			}
+
+			granted := make(chan string, len(tt.waiters))
+			errs := make(chan error, len(tt.waiters))
+			for i, w := range tt.waiters {
+				go func() {
+					release, err := q.acquire(testCallContext(w.flow, w.weight, 1, w.priority))
+					if err != nil {
+						errs <- err
+						return
+					}
+					// 先记录再释放，保证记录顺序与分配顺序一致
+					granted <- w.name
+					release()
+				}()
+				waitQueueLength(t, q, i+1)
+			}
+			releaseHolder()
+
+			var got []string
+			for range tt.waiters {
+				select {
+				case name := <-granted:
+					got = append(got, name)
+				case err := <-errs:
+					t.Fatalf("acquire: %v", err)
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timed out, granted %v", got)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdmissionQueueMaxShare(t *testing.T) {
+	q := newAdmissionQueue(2, 2, 5*time.Second)
+	ctxA := testCallContext("a", 1, 0.5, priorityInteractive)
+	ctxB := testCallContext("b", 1, 1, priorityInteractive)
+
+	releaseA, err := q.acquire(ctxA)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	// a 已占满自己的份额，空闲名额留给其他调用方
+	if _, ok := q.tryAcquire(ctxA); ok {
+		t.Fatal("tryAcquire succeeded beyond max_share")
+	}
+	waitingA := make(chan func(), 1)
+	go func() {
+		release, err := q.acquire(ctxA)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		waitingA <- release
+	}()
+	waitQueueLength(t, q, 1)
+
+	releaseB, err := q.acquire(ctxB)
+	if err != nil {
+		t.Fatalf("acquire for another flow: %v", err)
+	}
+	if got := q.active(); got != 2 {
+		t.Errorf("active = %d, want 2", got)
+	}
+
+	releaseB()
+	select {
+	case <-waitingA:
+		t.Fatal("flow exceeded max_share after another flow released")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	releaseA()
+	select {
+	case release := <-waitingA:
+		release()
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiter not granted after flow released its slot")
+	}
+	if got := q.active(); got != 0 {
+		t.Errorf("active = %d after all releases, want 0", got)
+	}
+	if got := len(q.stats()["flows"].([]map[string]interface{})); got != 0 {
+		t.Errorf("flows = %d after all releases, want 0", got)
+	}
+}
+
+func TestAdmissionQueueTryAcquire(t *testing.T) {
+	tests := []struct {
+		name     string
+		slots    int
+		held     int
+		maxShare float64
+		want     bool
+	}{
+		{name: "free slot", slots: 2, held: 0, maxShare: 1, want: true},
+		{name: "no free slot", slots: 1, held: 1, maxShare: 1, want: false},
+		{name: "flow share exhausted", slots: 4, held: 2, maxShare: 0.5, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newAdmissionQueue(tt.slots, 0, time.Second)
+			ctx := testCallContext("caller", 1, tt.maxShare, priorityInteractive)
+			for i := 0; i < tt.held; i++ {
+				release, ok := q.tryAcquire(ctx)
+				if !ok {
+					t.Fatal("tryAcquire failed with free slots")
+				}
+				defer release()
+			}
+
+			release, ok := q.tryAcquire(ctx)
+			if ok != tt.want {
+				t.Fatalf("tryAcquire = %v, want %v", ok, tt.want)
+			}
+			if ok {
+				release()
+				release() // 重复释放不影响计数
+			}
+			if got := q.active(); got != tt.held {
+				t.Errorf("active = %d, want %d", got, tt.held)
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 客户端密钥的权限范围
+const (
+	scopeSpeech = "speech" // 语音合成：/v1/audio/speech、/v1/audio/speech/stream 和 /tts/websocket
+	scopeVoices = "voices" // 查询可用语音：/v1/voices
+	scopeAdmin  = "admin"  // 管理接口：/admin
+)
+
+// 所有权限范围
+var apiKeyScopes = []string{scopeSpeech, scopeVoices, scopeAdmin}
+
+// OPENAI_TTS_API_KEY 和租户配置文件中的密钥拥有的权限范围
+var legacyKeyScopes = []string{scopeSpeech, scopeVoices}
+
+// 密钥库生成的客户端密钥前缀
+const apiKeyPrefix = "sk-tts-"
+
+// 记录在密钥库中的明文密钥前几位，用于识别密钥
+const apiKeyDisplayLength = len(apiKeyPrefix) + 6
+
+// 密钥库中的一个客户端密钥，只保存密钥的 SHA-256 哈希
+type apiKeyRecord struct {
+	// ID 密钥ID，用于管理接口
+	ID string `json:"id"`
+	// Name 密钥名称，例如使用该密钥的应用
+	Name string `json:"name"`
+	// Hash 明文密钥的 SHA-256 哈希，十六进制编码
+	Hash string `json:"hash"`
+	// Prefix 明文密钥的前几位，用于识别密钥
+	Prefix string `json:"prefix,omitempty"`
+	// Scopes 权限范围：speech、voices、admin
+	Scopes []string `json:"scopes"`
+	// Tenant 密钥所属的租户，为空表示默认租户
+	Tenant string `json:"tenant,omitempty"`
+	// Enabled 是否启用，吊销的密钥保留记录但不再启用
+	Enabled bool `json:"enabled"`
+	// ExpiresAt 过期时间，为空表示不过期
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RateLimit 该密钥的限流额度，非0的字段覆盖 RATE_LIMIT_KEY_* 的设置
+	RateLimit *rateLimitConfig `json:"rate_limit,omitempty"`
+	// Quota 该密钥每天和每月的配额，非0的字段覆盖 QUOTA_KEY_* 的设置
+	Quota *quotaConfig `json:"quota,omitempty"`
+	// CreatedAt 创建时间
+	CreatedAt time.Time `json:"created_at"`
+	// RotatedAt 最近一次轮换时间
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	// RevokedAt 吊销时间
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// PreviousHash 轮换前的密钥哈希，在 PreviousExpiresAt 之前仍然有效，便于客户端平滑切换
+	PreviousHash string `json:"previous_hash,omitempty"`
+	// PreviousExpiresAt 轮换前的密钥失效时间
+	PreviousExpiresAt *time.Time `json:"previous_expires_at,omitempty"`
+
+	hash         []byte
+	previousHash []byte
+}
+
+// 解码哈希并验证密钥记录
+func (k *apiKeyRecord) init() error {
+	if k.ID == "" || k.Name == "" {
+		return fmt.Errorf("id and name are required")
+	}
+	var err error
+	if k.hash, err = decodeAPIKeyHash(k.Hash); err != nil {
+		return fmt.Errorf("invalid hash: %w", err)
+	}
+	k.previousHash = nil
+	if k.PreviousHash != "" {
+		if k.previousHash, err = decodeAPIKeyHash(k.PreviousHash); err != nil {
+			return fmt.Errorf("invalid previous_hash: %w", err)
+		}
+	}
+	if err := validateAPIKeyScopes(k.Scopes); err != nil {
+		return err
+	}
+	if k.RateLimit != nil {
+		if err := k.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+	if k.Quota != nil {
+		if err := k.Quota.validate(); err != nil {
+			return err
+		}
+	}
+	if k.Tenant != "" && k.Tenant != defaultTenantName {
+		if _, ok := tenants.Tenants[k.Tenant]; !ok {
+			return fmt.Errorf("unknown tenant %q", k.Tenant)
+		}
+	}
+	return nil
+}
+
+// 检查密钥在 now 时是否可以用于 scope
+func (k *apiKeyRecord) check(scope string, now time.Time) error {
+	if !k.Enabled {
+		return ErrAPIKeyDisabled
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return ErrAPIKeyExpired
+	}
+	if !slices.Contains(k.Scopes, scope) {
+		return fmt.Errorf("%w: API key does not have the %s scope", ErrInsufficientScope, scope)
+	}
+	return nil
+}
+
+// 管理接口返回的密钥信息，不包含哈希
+func (k *apiKeyRecord) info() map[string]interface{} {
+	info := map[string]interface{}{
+		"id":         k.ID,
+		"name":       k.Name,
+		"prefix":     k.Prefix,
+		"scopes":     k.Scopes,
+		"enabled":    k.Enabled,
+		"created_at": k.CreatedAt,
+	}
+	if k.Tenant != "" {
+		info["tenant"] = k.Tenant
+	}
+	if k.ExpiresAt != nil {
+		info["expires_at"] = k.ExpiresAt
+	}
+	if k.RateLimit != nil {
+		info["rate_limit"] = k.RateLimit
+	}
+	if k.Quota != nil {
+		info["quota"] = k.Quota
+	}
+	if k.RotatedAt != nil {
+		info["rotated_at"] = k.RotatedAt
+	}
+	if k.RevokedAt != nil {
+		info["revoked_at"] = k.RevokedAt
+	}
+	if k.PreviousExpiresAt != nil && time.Now().Before(*k.PreviousExpiresAt) {
+		info["previous_expires_at"] = k.PreviousExpiresAt
+	}
+	return info
+}
+
+// 验证权限范围
+func validateAPIKeyScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return fmt.Errorf("unknown scope %q, must be one of %v", scope, apiKeyScopes)
+		}
+	}
+	return nil
+}
+
+// 解码十六进制编码的 SHA-256 哈希
+func decodeAPIKeyHash(s string) ([]byte, error) {
+	hash, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("must be a hex-encoded SHA-256 digest")
+	}
+	return hash, nil
+}
+
+// 计算明文密钥的 SHA-256 哈希
+// 密钥库生成的密钥包含192位随机数，不需要加盐或慢哈希
+func hashAPIKey(apiKey string) []byte {
+	sum := sha256.Sum256([]byte(apiKey))
+	return sum[:]
+}
+
+// 生成新的明文密钥
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// 生成新的密钥ID
+func generateAPIKeyID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "key_" + hex.EncodeToString(buf), nil
+}
+
+// 不在密钥库中的密钥的ID：明文密钥哈希的前16位十六进制数字
+func hashedAPIKeyID(apiKey string) string {
+	return hex.EncodeToString(hashAPIKey(apiKey)[:8])
+}
+
+// 通过验证的客户端密钥
+type apiKeyIdentity struct {
+	// ID 密钥库中的密钥ID，其他密钥为明文密钥哈希的前16位
+	ID string
+	// Name 密钥名称，租户配置文件中的密钥为租户名称，OPENAI_TTS_API_KEY 为 default
+	Name string
+	// Tenant 密钥所属的租户
+	Tenant *tenantConfig
+	// Quota 密钥每天和每月的配额
+	Quota quotaConfig
+}
+
+type apiKeyIdentityKey struct{}
+
+// 将客户端密钥附加到请求上下文
+func withAPIKeyIdentity(ctx context.Context, id *apiKeyIdentity) context.Context {
+	return context.WithValue(ctx, apiKeyIdentityKey{}, id)
+}
+
+// 从请求上下文获取客户端密钥，未设置时返回属于默认租户的匿名密钥
+func apiKeyIdentityFromContext(ctx context.Context) *apiKeyIdentity {
+	if id, ok := ctx.Value(apiKeyIdentityKey{}).(*apiKeyIdentity); ok {
+		return id
+	}
+	return &apiKeyIdentity{Tenant: tenants.defaultTenant}
+}
+
+// 密钥库文件
+type apiKeyFile struct {
+	Keys []apiKeyRecord `json:"keys"`
+}
+
+// APIKeyStore 客户端密钥库
+// 密钥只以哈希形式保存在JSON文件中，通过管理接口增加、轮换或吊销密钥后立即写回文件并生效，不需要重启服务
+type APIKeyStore struct {
+	path string // 为空时密钥只保存在内存中
+
+	mu   sync.RWMutex
+	keys []apiKeyRecord
+}
+
+// 客户端密钥库，默认为空的内存密钥库
+var apiKeys = &APIKeyStore{}
+
+// LoadAPIKeyStore 从JSON文件加载密钥库，文件不存在时创建空的密钥库，第一次修改时写入文件
+// 路径为空时密钥只保存在内存中，重启后丢失；密钥所属的租户按已加载的租户配置验证
+func LoadAPIKeyStore(path string) (*APIKeyStore, error) {
+	s := &APIKeyStore{path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API key store: %w", err)
+	}
+	var file apiKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse API key store: %w", err)
+	}
+
+	ids := make(map[string]bool, len(file.Keys))
+	for i := range file.Keys {
+		k := &file.Keys[i]
+		if err := k.init(); err != nil {
+			return nil, fmt.Errorf("API key %d (%s): %w", i+1, k.ID, err)
+		}
+		if ids[k.ID] {
+			return nil, fmt.Errorf("duplicate API key id %q", k.ID)
+		}
+		ids[k.ID] = true
+	}
+	s.keys = file.Keys
+	return s, nil
+}
+
+// 查找明文密钥对应的密钥记录，不检查是否启用、过期和权限范围
+// 逐个比较全部密钥的哈希且不提前返回，比较时间与密钥是否匹配及匹配位置无关
+func (s *APIKeyStore) verify(apiKey string) (apiKeyRecord, bool) {
+	hash := hashAPIKey(apiKey)
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found apiKeyRecord
+	ok := false
+	for i := range s.keys {
+		k := &s.keys[i]
+		match := subtle.ConstantTimeCompare(hash, k.hash)
+		if k.previousHash != nil && k.PreviousExpiresAt != nil && now.Before(*k.PreviousExpiresAt) {
+			match |= subtle.ConstantTimeCompare(hash, k.previousHash)
+		}
+		if match == 1 && !ok {
+			found, ok = *k, true
+		}
+	}
+	return found, ok
+}
+
+// 是否有拥有 scope 权限的密钥，无论是否启用
+func (s *APIKeyStore) hasScope(scope string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if slices.Contains(k.Scopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// 密钥数量
+func (s *APIKeyStore) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// 所有密钥的信息，不包含哈希
+func (s *APIKeyStore) list() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]map[string]interface{}, 0, len(s.keys))
+	for i := range s.keys {
+		list = append(list, s.keys[i].info())
+	}
+	return list
+}
+
+// 增加一个密钥，返回明文密钥；明文密钥只在这里返回一次
+func (s *APIKeyStore) create(k apiKeyRecord) (apiKeyRecord, string, error) {
+	plaintext, err := generateAPIKey()
+	if err != nil {
+		return apiKeyRecord{}, "", err
+	}
+	if k.ID, err = generateAPIKeyID(); err != nil {
+		return apiKeyRecord{}, "", err
+	}
+	k.Hash = hex.EncodeToString(hashAPIKey(plaintext))
+	k.Prefix = plaintext[:apiKeyDisplayLength]
+	k.Enabled = true
+	k.CreatedAt = time.Now().UTC()
+	if err := k.init(); err != nil {
+		return apiKeyRecord{}, "", fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := append(slices.Clone(s.keys), k)
+	if err := s.save(keys); err != nil {
+		return apiKeyRecord{}, "", err
+	}
+	s.keys = keys
+	return k, plaintext, nil
+}
+
+// 按ID查找密钥
+func (s *APIKeyStore) get(id string) (apiKeyRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := slices.IndexFunc(s.keys, func(k apiKeyRecord) bool { return k.ID == id })
+	if i < 0 {
+		return apiKeyRecord{}, fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	return s.keys[i], nil
+}
+
+// 修改一个密钥，写入文件成功后才生效
+func (s *APIKeyStore) update(id string, fn func(k *apiKeyRecord) error) (apiKeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.keys, func(k apiKeyRecord) bool { return k.ID == id })
+	if i < 0 {
+		return apiKeyRecord{}, fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	keys := slices.Clone(s.keys)
+	if err := fn(&keys[i]); err != nil {
+		return apiKeyRecord{}, err
+	}
+	if err := keys[i].init(); err != nil {
+		return apiKeyRecord{}, fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+	}
+	if err := s.save(keys); err != nil {
+		return apiKeyRecord{}, err
+	}
+	s.keys = keys
+	return keys[i], nil
+}
+
+// 为密钥生成新的明文密钥，旧密钥在 grace 时间内仍然有效，grace 为0时立即失效
+func (s *APIKeyStore) rotate(id string, grace time.Duration) (apiKeyRecord, string, error) {
+	plaintext, err := generateAPIKey()
+	if err != nil {
+		return apiKeyRecord{}, "", err
+	}
+	k, err := s.update(id, func(k *apiKeyRecord) error {
+		now := time.Now().UTC()
+		k.PreviousHash, k.PreviousExpiresAt = "", nil
+		if grace > 0 {
+			until := now.Add(grace)
+			k.PreviousHash, k.PreviousExpiresAt = k.Hash, &until
+		}
+		k.Hash = hex.EncodeToString(hashAPIKey(plaintext))
+		k.Prefix = plaintext[:apiKeyDisplayLength]
+		k.RotatedAt = &now
+		return nil
+	})
+	if err != nil {
+		return apiKeyRecord{}, "", err
+	}
+	return k, plaintext, nil
+}
+
+// 吊销密钥：停用密钥，轮换前的旧密钥也立即失效
+func (s *APIKeyStore) revoke(id string) (apiKeyRecord, error) {
+	return s.update(id, func(k *apiKeyRecord) error {
+		now := time.Now().UTC()
+		k.Enabled = false
+		k.RevokedAt = &now
+		k.PreviousHash, k.PreviousExpiresAt = "", nil
+		return nil
+	})
+}
+
+// 写入密钥库文件，内存密钥库不写入
+func (s *APIKeyStore) save(keys []apiKeyRecord) error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(apiKeyFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("failed to write API key store: %w", err)
+	}
+	return nil
+}
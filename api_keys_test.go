@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 替换全局密钥库、租户配置和 OPENAI_TTS_API_KEY，测试结束后恢复
+func useTestAuth(t *testing.T, store *APIKeyStore, tc *Tenants, legacyKey string) {
+	t.Helper()
+	previousKeys, previousTenants, previousLegacy := apiKeys, tenants, appConfig.OpenAITTSAPIKey
+	apiKeys, tenants, appConfig.OpenAITTSAPIKey = store, tc, legacyKey
+	t.Cleanup(func() {
+		apiKeys, tenants, appConfig.OpenAITTSAPIKey = previousKeys, previousTenants, previousLegacy
+	})
+}
+
+func TestAPIKeyStoreVerify(t *testing.T) {
+	store := &APIKeyStore{}
+	k, plaintext, err := store.create(apiKeyRecord{Name: "app", Scopes: []string{scopeSpeech}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plaintext, apiKeyPrefix) || !strings.HasPrefix(plaintext, k.Prefix) {
+		t.Errorf("plaintext %q does not start with prefix %q", plaintext, k.Prefix)
+	}
+	if k.Hash != hex.EncodeToString(hashAPIKey(plaintext)) || strings.Contains(k.Hash, plaintext) {
+		t.Errorf("hash = %q, want the SHA-256 of the plaintext key", k.Hash)
+	}
+
+	tests := []struct {
+		name   string
+		apiKey string
+		want   bool
+	}{
+		{name: "plaintext key", apiKey: plaintext, want: true},
+		{name: "hash is not a key", apiKey: k.Hash},
+		{name: "prefix only", apiKey: k.Prefix},
+		{name: "different key", apiKey: plaintext[:len(plaintext)-1] + "x"},
+	}
+	for _, tt := range tests {
+		got, ok := store.verify(tt.apiKey)
+		if ok != tt.want {
+			t.Errorf("%s: verify() ok = %v, want %v", tt.name, ok, tt.want)
+		}
+		if ok && got.ID != k.ID {
+			t.Errorf("%s: verify() = %s, want %s", tt.name, got.ID, k.ID)
+		}
+	}
+}
+
+func TestAPIKeyCheck(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	tests := []struct {
+		name    string
+		key     apiKeyRecord
+		scope   string
+		wantErr error
+	}{
+		{name: "valid key", key: apiKeyRecord{Enabled: true, Scopes: []string{scopeSpeech}}, scope: scopeSpeech},
+		{name: "not yet expired", key: apiKeyRecord{Enabled: true, Scopes: []string{scopeSpeech}, ExpiresAt: &future}, scope: scopeSpeech},
+		{name: "revoked key", key: apiKeyRecord{Enabled: false, Scopes: []string{scopeSpeech}}, scope: scopeSpeech, wantErr: ErrAPIKeyDisabled},
+		{name: "expired key", key: apiKeyRecord{Enabled: true, Scopes: []string{scopeSpeech}, ExpiresAt: &past}, scope: scopeSpeech, wantErr: ErrAPIKeyExpired},
+		{name: "scope mismatch", key: apiKeyRecord{Enabled: true, Scopes: []string{scopeSpeech, scopeVoices}}, scope: scopeAdmin, wantErr: ErrInsufficientScope},
+	}
+
+	for _, tt := range tests {
+		if err := tt.key.check(tt.scope, now); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: check() err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAPIKeyStoreRotateAndRevoke(t *testing.T) {
+	tests := []struct {
+		name        string
+		grace       time.Duration
+		wantOldKey  bool
+		revokeAfter bool
+	}{
+		{name: "rotation invalidates the old secret", grace: 0},
+		{name: "old secret valid during grace period", grace: time.Hour, wantOldKey: true},
+		{name: "revoke invalidates the old secret", grace: time.Hour, revokeAfter: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &APIKeyStore{}
+			k, oldKey, err := store.create(apiKeyRecord{Name: "app", Scopes: []string{scopeSpeech}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, newKey, err := store.rotate(k.ID, tt.grace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if newKey == oldKey {
+				t.Fatal("rotate() returned the old secret")
+			}
+			if tt.revokeAfter {
+				if _, err := store.revoke(k.ID); err != nil {
+					t.Fatal(err)
+				}
+				if got, ok := store.verify(newKey); !ok || !errors.Is(got.check(scopeSpeech, time.Now()), ErrAPIKeyDisabled) {
+					t.Errorf("revoked key verify() ok = %v, check() = %v", ok, got.check(scopeSpeech, time.Now()))
+				}
+			} else if _, ok := store.verify(newKey); !ok {
+				t.Error("new secret not accepted")
+			}
+			if _, ok := store.verify(oldKey); ok != tt.wantOldKey {
+				t.Errorf("old secret accepted = %v, want %v", ok, tt.wantOldKey)
+			}
+		})
+	}
+
+	store := &APIKeyStore{}
+	if _, _, err := store.rotate("key_missing", 0); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("rotate() unknown id err = %v, want ErrAPIKeyNotFound", err)
+	}
+}
+
+func TestLoadAPIKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := LoadAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, plaintext, err := store.create(apiKeyRecord{Name: "app", Scopes: []string{scopeSpeech, scopeVoices}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 文件中只保存哈希
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), plaintext) {
+		t.Error("key store file contains the plaintext key")
+	}
+
+	reloaded, err := LoadAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reloaded.verify(plaintext); !ok || got.ID != k.ID {
+		t.Errorf("reloaded verify() = %s, %v, want %s", got.ID, ok, k.ID)
+	}
+
+	for name, content := range map[string]string{
+		"invalid hash":  `{"keys": [{"id": "key_1", "name": "app", "hash": "abc", "scopes": ["speech"]}]}`,
+		"unknown scope": `{"keys": [{"id": "key_1", "name": "app", "hash": "` + k.Hash + `", "scopes": ["write"]}]}`,
+		"duplicate id": `{"keys": [{"id": "key_1", "name": "a", "hash": "` + k.Hash + `", "scopes": ["speech"]},
+			{"id": "key_1", "name": "b", "hash": "` + k.Hash + `", "scopes": ["speech"]}]}`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAPIKeyStore(path); err == nil {
+			t.Errorf("%s: LoadAPIKeyStore() succeeded", name)
+		}
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	tc, err := loadTestTenants(t, `{"tenants": {"search": {"api_keys": ["search-key"]}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &APIKeyStore{}
+	useTestAuth(t, store, tc, "")
+	_, speechKey, err := store.create(apiKeyRecord{Name: "app", Scopes: []string{scopeSpeech}, Tenant: "search"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedKey, err := store.create(apiKeyRecord{Name: "old", Scopes: []string{scopeSpeech}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.revoke(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(-time.Minute)
+	_, expiredKey, err := store.create(apiKeyRecord{Name: "expired", Scopes: []string{scopeSpeech}, ExpiresAt: &expiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		legacyKey  string
+		apiKey     string
+		scope      string
+		wantTenant string
+		wantStatus int
+	}{
+		{name: "store key", apiKey: speechKey, scope: scopeSpeech, wantTenant: "search"},
+		{name: "store key without scope", apiKey: speechKey, scope: scopeAdmin, wantStatus: http.StatusForbidden},
+		{name: "revoked store key", apiKey: revokedKey, scope: scopeSpeech, wantStatus: http.StatusUnauthorized},
+		{name: "expired store key", apiKey: expiredKey, scope: scopeSpeech, wantStatus: http.StatusUnauthorized},
+		{name: "tenant key", apiKey: "search-key", scope: scopeVoices, wantTenant: "search"},
+		{name: "tenant key cannot administer", apiKey: "search-key", scope: scopeAdmin, wantStatus: http.StatusForbidden},
+		{name: "legacy key", legacyKey: "legacy-key", apiKey: "legacy-key", scope: scopeSpeech, wantTenant: defaultTenantName},
+		{name: "wrong legacy key", legacyKey: "legacy-key", apiKey: "other-key", scope: scopeSpeech, wantStatus: http.StatusUnauthorized},
+		{name: "unknown key without legacy key", apiKey: "other-key", scope: scopeSpeech, wantStatus: http.StatusUnauthorized},
+		{name: "empty key without legacy key", apiKey: "", scope: scopeSpeech, wantStatus: http.StatusUnauthorized},
+		{name: "illegal characters", apiKey: "key(1)", scope: scopeSpeech, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestAuth(t, store, tc, tt.legacyKey)
+			identity, errResp := authenticateAPIKey(tt.apiKey, tt.scope)
+			if tt.wantStatus != 0 {
+				if errResp == nil || errResp.Code != tt.wantStatus {
+					t.Fatalf("authenticateAPIKey() = %+v, want status %d", errResp, tt.wantStatus)
+				}
+				return
+			}
+			if errResp != nil {
+				t.Fatalf("authenticateAPIKey() = %+v, want success", errResp)
+			}
+			if identity.Tenant.Name != tt.wantTenant {
+				t.Errorf("tenant = %s, want %s", identity.Tenant.Name, tt.wantTenant)
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// X-Cache 响应头取值
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheBypass = "BYPASS" // 缓存未启用
+)
+
+// 命中缓存时每次输出的音频块大小
+const cacheChunkSize = 32 * 1024
+
+// 音频缓存配置
+type audioCacheConfig struct {
+	MemoryMaxBytes int64         // 内存缓存最大字节数，0表示不使用内存缓存
+	Dir            string        // 磁盘缓存目录，为空表示不使用磁盘缓存
+	DiskMaxBytes   int64         // 磁盘缓存最大字节数
+	TTL            time.Duration // 缓存条目有效期
+}
+
+// 缓存条目
+type cacheEntry struct {
+	key     string
+	size    int64
+	created time.Time
+	data    []byte // 仅内存缓存持有数据
+}
+
+// LRU缓存层，只记录条目元数据和容量，数据由调用方决定放在内存还是磁盘
+type cacheTier struct {
+	maxBytes  int64
+	bytes     int64
+	order     *list.List // 前端为最近使用
+	entries   map[string]*list.Element
+	evictions int64
+}
+
+// 创建缓存层
+func newCacheTier(maxBytes int64) *cacheTier {
+	return &cacheTier{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// 查找条目并标记为最近使用
+func (t *cacheTier) get(key string) *cacheEntry {
+	elem, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	t.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+// 加入条目，返回因容量不足被淘汰的条目
+func (t *cacheTier) add(e *cacheEntry) []*cacheEntry {
+	var evicted []*cacheEntry
+	if old := t.remove(e.key); old != nil {
+		evicted = append(evicted, old)
+	}
+
+	t.entries[e.key] = t.order.PushFront(e)
+	t.bytes += e.size
+
+	for t.bytes > t.maxBytes {
+		back := t.order.Back()
+		if back == nil {
+			break
+		}
+		old := t.remove(back.Value.(*cacheEntry).key)
+		evicted = append(evicted, old)
+		t.evictions++
+	}
+	return evicted
+}
+
+// 移除条目
+func (t *cacheTier) remove(key string) *cacheEntry {
+	elem, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	t.order.Remove(elem)
+	delete(t.entries, key)
+	e := elem.Value.(*cacheEntry)
+	t.bytes -= e.size
+	return e
+}
+
+// 缓存层统计信息
+func (t *cacheTier) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"entries":   len(t.entries),
+		"bytes":     t.bytes,
+		"max_bytes": t.maxBytes,
+		"evictions": t.evictions,
+	}
+}
+
+// 合成音频缓存，按内容寻址
+// 内存层为LRU，磁盘层可选，内存未命中时从磁盘读取并提升到内存
+type audioCache struct {
+	cfg audioCacheConfig
+
+	mu     sync.Mutex
+	memory *cacheTier // 为nil表示不使用内存缓存
+	disk   *cacheTier // 为nil表示不使用磁盘缓存
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// 全局音频缓存，在 main 中根据配置创建，为nil表示不使用缓存
+var synthesisCache *audioCache
+
+// 创建音频缓存，启用磁盘缓存时加载目录中已有的条目
+func newAudioCache(cfg audioCacheConfig) (*audioCache, error) {
+	c := &audioCache{cfg: cfg}
+	if cfg.MemoryMaxBytes > 0 {
+		c.memory = newCacheTier(cfg.MemoryMaxBytes)
+	}
+
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		c.disk = newCacheTier(cfg.DiskMaxBytes)
+		if err := c.loadDisk(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// 扫描磁盘缓存目录，按修改时间从旧到新加入LRU
+func (c *audioCache) loadDisk() error {
+	files, err := os.ReadDir(c.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	var entries []*cacheEntry
+	for _, f := range files {
+		if f.IsDir() || !isCacheKey(f.Name()) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, &cacheEntry{key: f.Name(), size: info.Size(), created: info.ModTime()})
+	}
+
+	// 最新的条目最后加入，位于LRU前端
+	sort.Slice(entries, func(i, j int) bool { return entries[i].created.Before(entries[j].created) })
+	for _, e := range entries {
+		if c.expired(e) {
+			os.Remove(c.diskPath(e.key))
+			continue
+		}
+		for _, old := range c.disk.add(e) {
+			os.Remove(c.diskPath(old.key))
+		}
+	}
+	return nil
+}
+
+// 缓存键是否为合法的十六进制SHA-256，防止通过管理接口访问任意路径
+func isCacheKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// 磁盘缓存文件路径
+func (c *audioCache) diskPath(key string) string {
+	return filepath.Join(c.cfg.Dir, key)
+}
+
+// 条目是否已过期
+func (c *audioCache) expired(e *cacheEntry) bool {
+	return c.cfg.TTL > 0 && time.Since(e.created) > c.cfg.TTL
+}
+
+// 查找缓存的音频
+func (c *audioCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.memory != nil {
+		if e := c.memory.get(key); e != nil {
+			if !c.expired(e) {
+				c.hits.Add(1)
+				return e.data, true
+			}
+			c.memory.remove(key)
+		}
+	}
+
+	if c.disk != nil {
+		if e := c.disk.get(key); e != nil {
+			if !c.expired(e) {
+				data, err := os.ReadFile(c.diskPath(key))
+				if err == nil {
+					c.hits.Add(1)
+					c.addMemoryLocked(&cacheEntry{key: key, size: e.size, created: e.created, data: data})
+					return data, true
+				}
+				slog.Warn("Failed to read cache file", "error", err)
+			}
+			c.disk.remove(key)
+			os.Remove(c.diskPath(key))
+		}
+	}
+
+	c.misses.Add(1)
+	return nil, false
+}
+
+// 缓存一段完整合成的音频
+// 超过某一层容量四分之一的音频不放入该层，避免单个条目挤掉大量常用条目
+func (c *audioCache) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &cacheEntry{key: key, size: int64(len(data)), created: time.Now(), data: data}
+	c.addMemoryLocked(e)
+
+	if c.disk != nil && e.size <= c.disk.maxBytes/4 {
+		if err := writeFileAtomic(c.diskPath(key), data); err != nil {
+			slog.Warn("Failed to write cache file", "error", err)
+			return
+		}
+		for _, old := range c.disk.add(&cacheEntry{key: key, size: e.size, created: e.created}) {
+			if old.key != key {
+				os.Remove(c.diskPath(old.key))
+			}
+		}
+	}
+}
+
+// 放入内存缓存，调用方需持有锁
+func (c *audioCache) addMemoryLocked(e *cacheEntry) {
+	if c.memory != nil && e.size <= c.memory.maxBytes/4 {
+		c.memory.add(e)
+	}
+}
+
+// 删除一个缓存条目，返回条目是否存在
+func (c *audioCache) purge(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found := false
+	if c.memory != nil && c.memory.remove(key) != nil {
+		found = true
+	}
+	if c.disk != nil && c.disk.remove(key) != nil {
+		os.Remove(c.diskPath(key))
+		found = true
+	}
+	return found
+}
+
+// 清空缓存，返回删除的条目数
+func (c *audioCache) purgeAll() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make(map[string]struct{})
+	if c.memory != nil {
+		for key := range c.memory.entries {
+			keys[key] = struct{}{}
+		}
+		c.memory = newCacheTier(c.memory.maxBytes)
+	}
+	if c.disk != nil {
+		for key := range c.disk.entries {
+			keys[key] = struct{}{}
+			os.Remove(c.diskPath(key))
+		}
+		c.disk = newCacheTier(c.disk.maxBytes)
+	}
+	return len(keys)
+}
+
+// 缓存统计信息
+func (c *audioCache) stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"hits":        c.hits.Load(),
+		"misses":      c.misses.Load(),
+		"ttl_seconds": int(c.cfg.TTL.Seconds()),
+	}
+	if c.memory != nil {
+		stats["memory"] = c.memory.stats()
+	}
+	if c.disk != nil {
+		disk := c.disk.stats()
+		disk["dir"] = c.cfg.Dir
+		stats["disk"] = disk
+	}
+	return stats
+}
+
+// 先写入临时文件再重命名，避免读取到写了一半的缓存文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// 计算合成结果的缓存键
+// 由规范化文本、语音、语速、上游编码、协议和租户使用的集群或资源ID共同决定，不同输出格式由同一上游编码转码时共用缓存
+func audioCacheKey(p synthesisParams) string {
+	parts := []string{
+		normalizeCacheText(p.Text),
+		p.VoiceType,
+		strconv.FormatFloat(p.Speed, 'f', 2, 64),
+		p.Encoding,
+		appConfig.ByteDanceProtocol,
+		p.tenant().upstreamResources,
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// 规范化缓存文本：去掉首尾空白和空行，合并行内连续空白
+// 保留换行，换行会影响句子切分
+func normalizeCacheText(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 返回合成参数对应的缓存状态、缓存键和合成函数
+// 命中时合成函数直接输出缓存的音频，未命中时合成并在完整成功后写入缓存
+func cachedSynthesis(ctx context.Context, p synthesisParams) (status, key string, synthesize func(onAudio audioHandler) error) {
+	if synthesisCache == nil {
+		return cacheBypass, "", func(onAudio audioHandler) error {
+			return synthesizeText(ctx, p, onAudio)
+		}
+	}
+
+	key = audioCacheKey(p)
+	if data, ok := synthesisCache.get(key); ok {
+		return cacheHit, key, func(onAudio audioHandler) error {
+			for len(data) > 0 {
+				n := min(cacheChunkSize, len(data))
+				if err := onAudio(data[:n]); err != nil {
+					return fmt.Errorf("%w: %v", ErrAudioWriteFailed, err)
+				}
+				data = data[n:]
+			}
+			return nil
+		}
+	}
+
+	return cacheMiss, key, func(onAudio audioHandler) error {
+		var audio []byte
+		err := synthesizeText(ctx, p, func(chunk []byte) error {
+			audio = append(audio, chunk...)
+			return onAudio(chunk)
+		})
+		if err == nil && len(audio) > 0 {
+			synthesisCache.put(key, audio)
+		}
+		return err
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 测试用的缓存键
+func testCacheKey(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// 修改条目的创建时间，模拟条目已存在一段时间
+func ageCacheEntry(tier *cacheTier, key string, age time.Duration) {
+	if elem, ok := tier.entries[key]; ok {
+		e := elem.Value.(*cacheEntry)
+		e.created = e.created.Add(-age)
+	}
+}
+
+func TestNormalizeCacheText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "请稍候", want: "请稍候"},
+		{text: "  请稍候  ", want: "请稍候"},
+		{text: "hello   \t world", want: "hello world"},
+		{text: "第一行\n\n  \n第二行  ", want: "第一行\n第二行"},
+		{text: " \n \t", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeCacheText(tt.text); got != tt.want {
+			t.Errorf("normalizeCacheText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestAudioCacheKey(t *testing.T) {
+	base := synthesisParams{Text: "请稍候", VoiceType: "BV001_streaming", Speed: 1.0, Encoding: "mp3",
+		Tenant: &tenantConfig{Name: defaultTenantName, upstreamResources: "cluster_a"}}
+	tests := []struct {
+		name   string
+		modify func(p *synthesisParams)
+		same   bool
+	}{
+		{name: "whitespace is normalized", modify: func(p *synthesisParams) { p.Text = "  请稍候 " }, same: true},
+		{name: "text", modify: func(p *synthesisParams) { p.Text = "请稍等" }},
+		{name: "voice", modify: func(p *synthesisParams) { p.VoiceType = "BV002_streaming" }},
+		{name: "speed", modify: func(p *synthesisParams) { p.Speed = 1.25 }},
+		{name: "encoding", modify: func(p *synthesisParams) { p.Encoding = "pcm" }},
+		{name: "tenant with other clusters", modify: func(p *synthesisParams) { p.Tenant = &tenantConfig{upstreamResources: "cluster_a,cluster_b"} }},
+		{name: "tenant with the same clusters", modify: func(p *synthesisParams) { p.Tenant = &tenantConfig{Name: "search", upstreamResources: "cluster_a"} }, same: true},
+	}
+
+	want := audioCacheKey(base)
+	if !isCacheKey(want) {
+		t.Fatalf("audioCacheKey() = %q is not a valid cache key", want)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := base
+			tt.modify(&p)
+			if got := audioCacheKey(p); (got == want) != tt.same {
+				t.Errorf("key equal = %v, want %v", got == want, tt.same)
+			}
+		})
+	}
+}
+
+func TestAudioCacheMemoryLRU(t *testing.T) {
+	c, err := newAudioCache(audioCacheConfig{MemoryMaxBytes: 400, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := bytes.Repeat([]byte{1}, 100)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		c.put(testCacheKey(name), entry)
+	}
+	// 访问 a 后 b 成为最久未使用的条目
+	if _, ok := c.get(testCacheKey("a")); !ok {
+		t.Fatal("a not cached")
+	}
+	c.put(testCacheKey("e"), entry)
+	// 超过容量四分之一的条目不缓存
+	c.put(testCacheKey("large"), bytes.Repeat([]byte{1}, 101))
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+		{"d", true},
+		{"e", true},
+		{"large", false},
+	}
+	for _, tt := range tests {
+		if _, ok := c.get(testCacheKey(tt.name)); ok != tt.want {
+			t.Errorf("get(%s) hit = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+	if c.memory.evictions != 1 {
+		t.Errorf("evictions = %d, want 1", c.memory.evictions)
+	}
+	if c.memory.bytes != 400 {
+		t.Errorf("bytes = %d, want 400", c.memory.bytes)
+	}
+}
+
+func TestAudioCacheTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		age  time.Duration
+		want bool
+	}{
+		{name: "fresh entry", age: 59 * time.Minute, want: true},
+		{name: "expired entry", age: 61 * time.Minute, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newAudioCache(audioCacheConfig{MemoryMaxBytes: 1024, Dir: t.TempDir(), DiskMaxBytes: 1024, TTL: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := testCacheKey("entry")
+			c.put(key, []byte("audio"))
+			ageCacheEntry(c.memory, key, tt.age)
+			ageCacheEntry(c.disk, key, tt.age)
+
+			if _, ok := c.get(key); ok != tt.want {
+				t.Errorf("get() hit = %v, want %v", ok, tt.want)
+			}
+			if _, err := os.Stat(c.diskPath(key)); (err == nil) != tt.want {
+				t.Errorf("disk file exists = %v, want %v", err == nil, tt.want)
+			}
+		})
+	}
+}
+
+func TestAudioCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newAudioCache(audioCacheConfig{Dir: dir, DiskMaxBytes: 400, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := bytes.Repeat([]byte{1}, 100)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		c.put(testCacheKey(name), entry)
+	}
+	c.put(testCacheKey("large"), bytes.Repeat([]byte{1}, 101))
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a", false}, // 超过磁盘容量时淘汰最早的条目
+		{"b", true},
+		{"e", true},
+		{"large", false}, // 超过容量四分之一的条目不写入磁盘
+	}
+	for _, tt := range tests {
+		if _, err := os.Stat(filepath.Join(dir, testCacheKey(tt.name))); (err == nil) != tt.want {
+			t.Errorf("file for %s exists = %v, want %v", tt.name, err == nil, tt.want)
+		}
+	}
+
+	// 重启后从磁盘加载，过期的文件被删除
+	expired := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, testCacheKey("b")), expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "not-a-cache-key"), []byte("x"), 0o644)
+
+	reloaded, err := newAudioCache(audioCacheConfig{Dir: dir, DiskMaxBytes: 400, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := reloaded.get(testCacheKey("e")); !ok || !bytes.Equal(data, entry) {
+		t.Errorf("reloaded get(e) = %d bytes, %v", len(data), ok)
+	}
+	if _, ok := reloaded.get(testCacheKey("b")); ok {
+		t.Error("expired entry loaded from disk")
+	}
+	if _, err := os.Stat(filepath.Join(dir, testCacheKey("b"))); err == nil {
+		t.Error("expired cache file not removed")
+	}
+	if got := len(reloaded.disk.entries); got != 3 {
+		t.Errorf("loaded entries = %d, want 3", got)
+	}
+}
+
+func TestAudioCachePurge(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newAudioCache(audioCacheConfig{MemoryMaxBytes: 1024, Dir: dir, DiskMaxBytes: 1024, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.put(testCacheKey("a"), []byte("audio a"))
+	c.put(testCacheKey("b"), []byte("audio b"))
+
+	if !c.purge(testCacheKey("a")) {
+		t.Error("purge(a) = false, want true")
+	}
+	if c.purge(testCacheKey("a")) {
+		t.Error("second purge(a) = true, want false")
+	}
+	if _, ok := c.get(testCacheKey("a")); ok {
+		t.Error("purged entry still cached")
+	}
+	if _, err := os.Stat(filepath.Join(dir, testCacheKey("a"))); err == nil {
+		t.Error("purged cache file not removed")
+	}
+
+	if n := c.purgeAll(); n != 1 {
+		t.Errorf("purgeAll() = %d, want 1", n)
+	}
+	if _, ok := c.get(testCacheKey("b")); ok {
+		t.Error("entry cached after purgeAll")
+	}
+}
+
+func TestHandleCachePurge(t *testing.T) {
+	tc, err := loadTestTenants(t, `{"tenants": {
+		"default": {"default_voice": "BV001_streaming"},
+		"search": {"default_voice": "BV002_streaming"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestAuth(t, &APIKeyStore{}, tc, "")
+	cache, err := newAudioCache(audioCacheConfig{MemoryMaxBytes: 1024, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := synthesisCache
+	synthesisCache = cache
+	t.Cleanup(func() { synthesisCache = previous })
+
+	// 缓存搜索租户使用默认语音合成的音频
+	req := OpenAITTSRequest{Model: "tts-1", Input: "请稍候", Voice: "alloy"}
+	params, _, err := prepareSynthesis(tc.byName("search"), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := audioCacheKey(params)
+
+	router := gin.New()
+	router.DELETE("/admin/cache", handleCachePurge)
+	router.DELETE("/admin/cache/:key", handleCachePurgeKey)
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		cached     bool // 请求前是否缓存了该条目
+		wantStatus int
+	}{
+		{name: "default tenant maps the voice differently", path: "/admin/cache", body: `{"model": "tts-1", "input": "请稍候", "voice": "alloy"}`, cached: true, wantStatus: http.StatusNotFound},
+		{name: "purge by tenant", path: "/admin/cache", body: `{"model": "tts-1", "input": " 请稍候 ", "voice": "alloy", "tenant": "search"}`, cached: true, wantStatus: http.StatusOK},
+		{name: "missing entry", path: "/admin/cache", body: `{"model": "tts-1", "input": "请稍候", "voice": "alloy", "tenant": "search"}`, wantStatus: http.StatusNotFound},
+		{name: "unknown tenant", path: "/admin/cache", body: `{"model": "tts-1", "input": "请稍候", "voice": "alloy", "tenant": "missing"}`, cached: true, wantStatus: http.StatusBadRequest},
+		{name: "purge by key", path: "/admin/cache/" + key, cached: true, wantStatus: http.StatusOK},
+		{name: "missing key", path: "/admin/cache/" + key, wantStatus: http.StatusNotFound},
+		{name: "invalid key", path: "/admin/cache/not-a-key", wantStatus: http.StatusBadRequest},
+		{name: "purge all", path: "/admin/cache", cached: true, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache.purgeAll()
+			if tt.cached {
+				cache.put(key, []byte("audio"))
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, tt.path, strings.NewReader(tt.body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			_, stillCached := cache.get(key)
+			if wantCached := tt.cached && tt.wantStatus != http.StatusOK; stillCached != wantCached {
+				t.Errorf("entry cached = %v, want %v", stillCached, wantCached)
+			}
+		})
+	}
+}
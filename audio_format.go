@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 上游音频采样率，与 OpenAI pcm 输出（24kHz 16bit 单声道）保持一致
+const audioSampleRate = 24000
+
+// 音频格式定义
+type audioFormat struct {
+	// OpenAI response_format 名称
+	Name string
+	// 返回给客户端的 Content-Type
+	ContentType string
+	// 火山引擎 encoding 参数
+	Encoding string
+	// 本地转码时 ffmpeg 的输出参数，为空表示火山引擎原生支持
+	TranscodeArgs []string
+}
+
+// 是否需要本地转码
+func (f audioFormat) needsTranscode() bool {
+	return len(f.TranscodeArgs) > 0
+}
+
+// 支持的 response_format
+// 火山引擎原生支持 mp3、ogg_opus、wav、pcm，其余格式请求 pcm 后经 ffmpeg 转码
+var audioFormats = map[string]audioFormat{
+	"mp3":      {Name: "mp3", ContentType: "audio/mpeg", Encoding: "mp3"},
+	"opus":     {Name: "opus", ContentType: "audio/ogg", Encoding: "ogg_opus"},
+	"ogg_opus": {Name: "ogg_opus", ContentType: "audio/ogg", Encoding: "ogg_opus"},
+	"wav":      {Name: "wav", ContentType: "audio/wav", Encoding: "wav"},
+	"pcm":      {Name: "pcm", ContentType: "audio/pcm", Encoding: "pcm"},
+	"aac":      {Name: "aac", ContentType: "audio/aac", Encoding: "pcm", TranscodeArgs: []string{"-c:a", "aac", "-f", "adts"}},
+	"flac":     {Name: "flac", ContentType: "audio/flac", Encoding: "pcm", TranscodeArgs: []string{"-c:a", "flac", "-f", "flac"}},
+}
+
+// ffmpeg 可执行文件路径，为空表示本地转码不可用
+var ffmpegPath string
+
+// 查找 response_format 对应的音频格式
+func lookupAudioFormat(name string) (audioFormat, error) {
+	if name == "" {
+		name = "mp3"
+	}
+
+	format, ok := audioFormats[name]
+	if !ok {
+		return audioFormat{}, fmt.Errorf("%w: %s", ErrUnsupportedFormat, name)
+	}
+
+	if format.needsTranscode() && ffmpegPath == "" {
+		return audioFormat{}, fmt.Errorf("%w: %s requires local transcoding, which is not available", ErrUnsupportedFormat, name)
+	}
+
+	return format, nil
+}
+
+// 生成流式WAV文件头（16bit单声道PCM）
+// 流式输出时总长度未知，数据长度字段按惯例填写最大值
+func wavStreamHeader(sampleRate int) []byte {
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], 0xFFFFFFFF)
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], 1) // PCM
+	binary.LittleEndian.PutUint16(header[22:24], 1) // 单声道
+	binary.LittleEndian.PutUint32(header[24:28], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(sampleRate*2))
+	binary.LittleEndian.PutUint16(header[32:34], 2)
+	binary.LittleEndian.PutUint16(header[34:36], 16)
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], 0xFFFFFFFF)
+	return header
+}
+
+// 音频输出管道：需要转码的格式经过 ffmpeg，其余格式直接输出
+type audioPipeline struct {
+	out audioHandler
+
+	// 以下字段仅在转码时使用
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan error
+	once  sync.Once
+}
+
+// 创建音频输出管道
+func newAudioPipeline(format audioFormat, out audioHandler) (*audioPipeline, error) {
+	p := &audioPipeline{out: out}
+	if !format.needsTranscode() {
+		return p, nil
+	}
+
+	rate := strconv.Itoa(audioSampleRate)
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-f", "s16le", "-ar", rate, "-ac", "1", "-i", "pipe:0"}
+	args = append(args, format.TranscodeArgs...)
+	args = append(args, "pipe:1")
+
+	p.cmd = exec.Command(ffmpegPath, args...)
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTranscodeFailed, err)
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTranscodeFailed, err)
+	}
+	if err := p.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTranscodeFailed, err)
+	}
+	p.stdin = stdin
+
+	// 将转码输出转发给客户端
+	p.done = make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				if werr := out(buf[:n]); werr != nil {
+					// 客户端写入失败，终止转码进程
+					p.cmd.Process.Kill()
+					io.Copy(io.Discard, stdout)
+					p.done <- werr
+					return
+				}
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				p.done <- err
+				return
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+// Write 写入一帧火山引擎音频
+func (p *audioPipeline) Write(audio []byte) error {
+	if p.cmd == nil {
+		return p.out(audio)
+	}
+
+	if _, err := p.stdin.Write(audio); err != nil {
+		return fmt.Errorf("%w: %v", ErrTranscodeFailed, err)
+	}
+	return nil
+}
+
+// Close 结束输入并等待转码输出全部写出
+func (p *audioPipeline) Close() error {
+	if p.cmd == nil {
+		return nil
+	}
+
+	var err error
+	p.once.Do(func() {
+		p.stdin.Close()
+		copyErr := <-p.done
+		waitErr := p.cmd.Wait()
+		switch {
+		case copyErr != nil:
+			err = copyErr
+		case waitErr != nil:
+			err = fmt.Errorf("%w: %v", ErrTranscodeFailed, waitErr)
+		}
+	})
+	return err
+}
+
+// Abort 中止转码并释放进程资源
+func (p *audioPipeline) Abort() {
+	if p.cmd == nil {
+		return
+	}
+
+	p.once.Do(func() {
+		p.stdin.Close()
+		p.cmd.Process.Kill()
+		<-p.done
+		p.cmd.Wait()
+	})
+}
+
+// WAV 文件头长度
+const wavHeaderSize = 44
+
+// 火山引擎音频时长计量
+// pcm 和 wav 按字节数计算；mp3 逐帧解析帧头累计采样数；ogg_opus 按每页的 granule position 计算，
+// 多段合成拼接的多个 Ogg 流按流累加。只保留帧头，不缓存音频数据
+type audioMeter struct {
+	encoding string
+	bytes    int64
+
+	pending []byte // 尚未解析完的帧头或页头
+	skip    int    // 当前帧或页剩余未收到的字节数
+
+	micros        int64 // mp3 已解析帧的总时长（微秒）
+	granuleTotal  int64 // ogg 已结束的流的采样数之和
+	granuleStream int64 // ogg 当前流最后一页的 granule position
+}
+
+// 创建音频时长计量，encoding 为火山引擎 encoding 参数
+func newAudioMeter(encoding string) *audioMeter {
+	return &audioMeter{encoding: encoding}
+}
+
+// 计量一帧音频
+func (m *audioMeter) write(audio []byte) {
+	m.bytes += int64(len(audio))
+	if m.encoding != "mp3" && m.encoding != "ogg_opus" {
+		return
+	}
+
+	for len(audio) > 0 {
+		if m.skip > 0 {
+			n := min(m.skip, len(audio))
+			m.skip -= n
+			audio = audio[n:]
+			continue
+		}
+		m.pending = append(m.pending, audio...)
+		audio = nil
+		if m.encoding == "mp3" {
+			m.parseMP3()
+		} else {
+			m.parseOgg()
+		}
+	}
+}
+
+// 音频时长
+func (m *audioMeter) duration() time.Duration {
+	switch m.encoding {
+	case "mp3":
+		return time.Duration(m.micros) * time.Microsecond
+	case "ogg_opus":
+		// Opus 的 granule position 固定以 48kHz 计数
+		return time.Duration((m.granuleTotal + m.granuleStream) * int64(time.Second) / 48000)
+	case "wav":
+		return pcmDuration(max(0, m.bytes-wavHeaderSize))
+	default:
+		return pcmDuration(m.bytes)
+	}
+}
+
+// 16bit 单声道 pcm 的时长
+func pcmDuration(bytes int64) time.Duration {
+	return time.Duration(bytes * int64(time.Second) / (audioSampleRate * 2))
+}
+
+// MPEG Layer III 的比特率（kbps），按 MPEG-1 和 MPEG-2/2.5 区分
+var mp3Bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// MPEG 采样率，按版本字段（0: MPEG-2.5，2: MPEG-2，3: MPEG-1）索引
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},
+	{},
+	{22050, 24000, 16000},
+	{44100, 48000, 32000},
+}
+
+// 解析 pending 中的 mp3 帧头，累计帧时长，帧数据通过 skip 跳过
+func (m *audioMeter) parseMP3() {
+	buf := m.pending
+	for len(buf) >= 4 {
+		version := buf[1] >> 3 & 0x03
+		bitrateIndex := buf[2] >> 4
+		sampleRateIndex := buf[2] >> 2 & 0x03
+		// 帧同步、Layer III、合法的版本、比特率和采样率
+		if buf[0] != 0xFF || buf[1]&0xE0 != 0xE0 || buf[1]>>1&0x03 != 1 || version == 1 ||
+			bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+			buf = buf[1:]
+			continue
+		}
+
+		sampleRate := mp3SampleRates[version][sampleRateIndex]
+		samples, coefficient, table := 1152, 144, 0
+		if version != 3 {
+			samples, coefficient, table = 576, 72, 1
+		}
+		frameSize := coefficient*mp3Bitrates[table][bitrateIndex]*1000/sampleRate + int(buf[2]>>1&0x01)
+		m.micros += int64(samples) * 1000000 / int64(sampleRate)
+
+		if frameSize >= len(buf) {
+			m.skip = frameSize - len(buf)
+			buf = nil
+			break
+		}
+		buf = buf[frameSize:]
+	}
+	m.pending = append(m.pending[:0], buf...)
+}
+
+// 解析 pending 中的 Ogg 页头，记录 granule position，页数据通过 skip 跳过
+func (m *audioMeter) parseOgg() {
+	buf := m.pending
+	for len(buf) >= 27 {
+		if string(buf[:4]) != "OggS" {
+			buf = buf[1:]
+			continue
+		}
+		segments := int(buf[26])
+		if len(buf) < 27+segments {
+			break
+		}
+
+		// 新的逻辑流开始，累加上一个流的采样数
+		if buf[5]&0x02 != 0 {
+			m.granuleTotal += m.granuleStream
+			m.granuleStream = 0
+		}
+		if granule := int64(binary.LittleEndian.Uint64(buf[6:14])); granule > 0 {
+			m.granuleStream = granule
+		}
+
+		pageSize := 27 + segments
+		for _, lacing := range buf[27 : 27+segments] {
+			pageSize += int(lacing)
+		}
+		if pageSize >= len(buf) {
+			m.skip = pageSize - len(buf)
+			buf = nil
+			break
+		}
+		buf = buf[pageSize:]
+	}
+	m.pending = append(m.pending[:0], buf...)
+}
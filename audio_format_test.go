@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 使用 script 作为 ffmpeg，测试结束后恢复
+func useTestTranscoder(t *testing.T, script string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	previous := ffmpegPath
+	ffmpegPath = path
+	t.Cleanup(func() { ffmpegPath = previous })
+}
+
+func TestLookupAudioFormat(t *testing.T) {
+	tests := []struct {
+		name         string
+		format       string
+		ffmpeg       string
+		wantEncoding string
+		wantType     string
+		wantErr      error
+	}{
+		{name: "default is mp3", format: "", wantEncoding: "mp3", wantType: "audio/mpeg"},
+		{name: "opus maps to ogg_opus", format: "opus", wantEncoding: "ogg_opus", wantType: "audio/ogg"},
+		{name: "pcm", format: "pcm", wantEncoding: "pcm", wantType: "audio/pcm"},
+		{name: "aac without ffmpeg", format: "aac", wantErr: ErrUnsupportedFormat},
+		{name: "aac with ffmpeg", format: "aac", ffmpeg: "/usr/bin/ffmpeg", wantEncoding: "pcm", wantType: "audio/aac"},
+		{name: "flac with ffmpeg", format: "flac", ffmpeg: "/usr/bin/ffmpeg", wantEncoding: "pcm", wantType: "audio/flac"},
+		{name: "unknown format", format: "wma", ffmpeg: "/usr/bin/ffmpeg", wantErr: ErrUnsupportedFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := ffmpegPath
+			ffmpegPath = tt.ffmpeg
+			defer func() { ffmpegPath = previous }()
+
+			format, err := lookupAudioFormat(tt.format)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("lookupAudioFormat(%q) err = %v, want %v", tt.format, err, tt.wantErr)
+			}
+			if format.Encoding != tt.wantEncoding || format.ContentType != tt.wantType {
+				t.Errorf("lookupAudioFormat(%q) = %s %s, want %s %s",
+					tt.format, format.Encoding, format.ContentType, tt.wantEncoding, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestAudioPipeline(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		script  string // 替代 ffmpeg 的脚本，为空表示不转码
+		wantOut bool   // 是否应输出写入的全部音频
+		wantErr error
+	}{
+		{name: "passthrough", format: "mp3", wantOut: true},
+		{name: "transcode", format: "aac", script: "exec cat", wantOut: true},
+		{name: "transcoder fails", format: "aac", script: "cat >/dev/null; exit 1", wantErr: ErrTranscodeFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.script != "" {
+				useTestTranscoder(t, tt.script)
+			}
+			format, err := lookupAudioFormat(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			pipeline, err := newAudioPipeline(format, func(audio []byte) error {
+				out.Write(audio)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, frame := range [][]byte{[]byte("first "), []byte("second")} {
+				if err := pipeline.Write(frame); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			if err := pipeline.Close(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Close() err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantOut && out.String() != "first second" {
+				t.Errorf("output = %q, want %q", out.String(), "first second")
+			}
+		})
+	}
+}
+
+func TestAudioPipelineWriteError(t *testing.T) {
+	useTestTranscoder(t, "exec cat")
+	format, err := lookupAudioFormat("flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 客户端写入失败时终止转码，Close 返回写入错误
+	errClient := errors.New("client gone")
+	pipeline, err := newAudioPipeline(format, func([]byte) error { return errClient })
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Write([]byte("audio"))
+	if err := pipeline.Close(); !errors.Is(err, errClient) {
+		t.Errorf("Close() err = %v, want %v", err, errClient)
+	}
+
+	// Abort 可以在未写入任何音频时释放转码进程
+	pipeline, err = newAudioPipeline(format, func([]byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Abort()
+	pipeline.Abort()
+}
+
+// 构造一个 mp3 帧，帧数据填充为0
+func mp3Frame(header [4]byte, size int) []byte {
+	frame := make([]byte, size)
+	copy(frame, header[:])
+	return frame
+}
+
+// MPEG-1 Layer III 128kbps 44.1kHz 帧，417字节，1152个采样
+var mp3Frame44k = mp3Frame([4]byte{0xFF, 0xFB, 0x90, 0x00}, 417)
+
+// MPEG-2 Layer III 64kbps 24kHz 帧，192字节，576个采样
+var mp3Frame24k = mp3Frame([4]byte{0xFF, 0xF3, 0x84, 0x00}, 192)
+
+// 构造一个 Ogg 页，负载不超过255字节
+func oggPage(headerType byte, granule int64, payload []byte) []byte {
+	page := []byte("OggS")
+	page = append(page, 0, headerType)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = append(page, make([]byte, 12)...) // 流序号、页序号和校验和
+	page = append(page, 1, byte(len(payload)))
+	return append(page, payload...)
+}
+
+// 连接多段音频数据
+func concatAudio(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestAudioMeter(t *testing.T) {
+	const oggBOS = 0x02
+	oggStream := func(granules ...int64) []byte {
+		data := oggPage(oggBOS, 0, []byte("OpusHead"))
+		for _, g := range granules {
+			data = append(data, oggPage(0, g, bytes.Repeat([]byte{0xAA}, 100))...)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		data     []byte
+		want     time.Duration
+	}{
+		{
+			name:     "pcm",
+			encoding: "pcm",
+			data:     make([]byte, audioSampleRate*2),
+			want:     time.Second,
+		},
+		{
+			name:     "wav excludes header",
+			encoding: "wav",
+			data:     make([]byte, wavHeaderSize+audioSampleRate),
+			want:     500 * time.Millisecond,
+		},
+		{
+			name:     "mp3 mpeg-1 frames",
+			encoding: "mp3",
+			data:     concatAudio(mp3Frame44k, mp3Frame44k),
+			want:     2 * 26122 * time.Microsecond,
+		},
+		{
+			name:     "mp3 mpeg-2 frames",
+			encoding: "mp3",
+			data:     concatAudio(mp3Frame24k, mp3Frame24k, mp3Frame24k),
+			want:     3 * 24 * time.Millisecond,
+		},
+		{
+			name:     "mp3 skips leading garbage",
+			encoding: "mp3",
+			data:     concatAudio([]byte{0x00, 0xFF, 0x12}, mp3Frame24k),
+			want:     24 * time.Millisecond,
+		},
+		{
+			name:     "ogg single stream",
+			encoding: "ogg_opus",
+			data:     oggStream(24000, 48000),
+			want:     time.Second,
+		},
+		{
+			name:     "ogg concatenated streams",
+			encoding: "ogg_opus",
+			data:     concatAudio(oggStream(48000), oggStream(12000, 24000)),
+			want:     1500 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		// 整段写入和按任意大小分块写入的结果相同，帧头和页头可能被切开
+		for _, chunk := range []int{len(tt.data), 100, 7, 1} {
+			m := newAudioMeter(tt.encoding)
+			for data := tt.data; len(data) > 0; {
+				n := min(chunk, len(data))
+				m.write(data[:n])
+				data = data[n:]
+			}
+			if got := m.duration(); got != tt.want {
+				t.Errorf("%s with %d byte chunks: duration = %v, want %v", tt.name, chunk, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 调用优先级，交互请求总是先于批量请求获得并发调用名额
+const (
+	priorityInteractive = "interactive"
+	priorityBatch       = "batch"
+)
+
+// 指定请求优先级的请求头，WebSocket 也可以使用 priority 查询参数
+const priorityHeader = "X-Priority"
+
+// 单个调用方的调度策略
+type callPolicy struct {
+	// Name 调用方名称，用于统计信息，默认由API密钥的哈希生成
+	Name string `json:"name,omitempty"`
+	// Weight 排队时的权重，名额按权重比例分配，默认1
+	Weight float64 `json:"weight,omitempty"`
+	// MaxShare 最多占用 MAX_CONCURRENT_CALLS 的比例，默认1
+	MaxShare float64 `json:"max_share,omitempty"`
+	// Priority 默认优先级，batch 密钥不能通过请求头提升为 interactive
+	Priority string `json:"priority,omitempty"`
+}
+
+// CallPolicies 按API密钥配置的调度策略
+type CallPolicies struct {
+	// Default 未单独配置的密钥使用的策略，每个密钥仍按独立调用方公平调度
+	Default callPolicy `json:"default"`
+	// Keys API密钥到调度策略的映射
+	Keys map[string]callPolicy `json:"keys"`
+}
+
+// 调度策略，默认所有密钥权重相同、不限制占用比例
+var callPolicies = &CallPolicies{}
+
+// LoadCallPolicies 从JSON配置文件加载调度策略，路径为空时返回默认策略
+func LoadCallPolicies(path string) (*CallPolicies, error) {
+	policies := &CallPolicies{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read call policy file: %w", err)
+		}
+		if err := json.Unmarshal(data, policies); err != nil {
+			return nil, fmt.Errorf("failed to parse call policy file: %w", err)
+		}
+	}
+
+	if err := policies.Default.normalize(); err != nil {
+		return nil, fmt.Errorf("invalid default call policy: %w", err)
+	}
+	for key, policy := range policies.Keys {
+		if err := policy.normalize(); err != nil {
+			return nil, fmt.Errorf("invalid call policy for %s: %w", policyName(policy, key), err)
+		}
+		policies.Keys[key] = policy
+		registerSecrets("call policy "+policyName(policy, key), key)
+	}
+
+	return policies, nil
+}
+
+// 补全默认值并验证策略
+func (p *callPolicy) normalize() error {
+	if p.Weight == 0 {
+		p.Weight = 1
+	}
+	if p.MaxShare == 0 {
+		p.MaxShare = 1
+	}
+	if p.Priority == "" {
+		p.Priority = priorityInteractive
+	}
+
+	if p.Weight < 0 {
+		return fmt.Errorf("weight must be positive")
+	}
+	if p.MaxShare < 0 || p.MaxShare > 1 {
+		return fmt.Errorf("max_share must be between 0 and 1")
+	}
+	if p.Priority != priorityInteractive && p.Priority != priorityBatch {
+		return fmt.Errorf("priority must be %q or %q", priorityInteractive, priorityBatch)
+	}
+	return nil
+}
+
+// 查找API密钥的调度策略
+func (cp *CallPolicies) Lookup(apiKey string) callPolicy {
+	policy, ok := cp.Keys[apiKey]
+	if !ok {
+		policy = cp.Default
+	}
+	policy.Name = policyName(policy, apiKey)
+	return policy
+}
+
+// 调用方名称，未配置名称时使用密钥哈希的前缀，避免在统计信息中暴露密钥
+func policyName(policy callPolicy, apiKey string) string {
+	if policy.Name != "" {
+		return policy.Name
+	}
+	if apiKey == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// 一次请求的调度类别
+type callClass struct {
+	policy   callPolicy
+	priority string
+}
+
+type callClassKey struct{}
+
+// 将调度类别附加到请求上下文
+func withCallClass(ctx context.Context, class callClass) context.Context {
+	return context.WithValue(ctx, callClassKey{}, class)
+}
+
+// 从请求上下文获取调度类别，未设置时使用默认策略
+func callClassFromContext(ctx context.Context) callClass {
+	if class, ok := ctx.Value(callClassKey{}).(callClass); ok {
+		return class
+	}
+	policy := callPolicies.Lookup("")
+	return callClass{policy: policy, priority: policy.Priority}
+}
+
+// 根据API密钥、租户和优先级请求头创建带调度类别、客户端密钥和租户的请求上下文
+// 调度策略文件中单独配置的密钥优先，其次为租户的调度策略；请求头只能降低优先级，batch 密钥的请求始终为 batch
+func callContext(c *gin.Context, apiKey string, id *apiKeyIdentity) (context.Context, error) {
+	t := id.Tenant
+	policy := callPolicies.Lookup(apiKey)
+	if _, ok := callPolicies.Keys[apiKey]; !ok && t.CallPolicy != nil {
+		policy = *t.CallPolicy
+	}
+	class := callClass{policy: policy, priority: policy.Priority}
+
+	requested := c.GetHeader(priorityHeader)
+	if requested == "" {
+		requested = c.Query("priority")
+	}
+	switch strings.ToLower(requested) {
+	case "":
+	case priorityBatch:
+		class.priority = priorityBatch
+	case priorityInteractive:
+		// 不能高于密钥的默认优先级
+	default:
+		return nil, fmt.Errorf("%w: %s must be %q or %q", ErrInvalidRequest, priorityHeader, priorityInteractive, priorityBatch)
+	}
+
+	setLogKeyID(c, id.ID)
+	ctx := withCallClass(c.Request.Context(), class)
+	return withAPIKeyIdentity(withTenant(ctx, t), id), nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 日志格式
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// 日志中替换敏感信息的文本
+const redactedValue = "[REDACTED]"
+
+// 解析日志级别
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("LOG_LEVEL must be one of debug, info, warn and error")
+}
+
+// 验证日志格式
+func validateLogFormat(format string) error {
+	if format != logFormatText && format != logFormatJSON {
+		return fmt.Errorf("LOG_FORMAT must be %q or %q", logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// 初始化默认日志记录器，配置已通过验证
+// 日志输出到标准输出，低于 LOG_LEVEL 的日志被丢弃
+func initLogging() {
+	level, _ := parseLogLevel(appConfig.LogLevel)
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, opts)
+	if appConfig.LogFormat == logFormatJSON {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	registerSecrets("BYTEDANCE_TTS_BEARER_TOKEN", appConfig.ByteDanceToken)
+	registerSecrets("OPENAI_TTS_API_KEY", appConfig.OpenAITTSAPIKey)
+	registerSecrets("ADMIN_API_KEY", appConfig.AdminAPIKey)
+}
+
+// 需要从日志中去除的密钥和令牌，只在启动时加载配置期间注册
+var logSecrets []string
+
+// 去除的密钥的最小长度，过短的值（例如测试用的占位值）会误伤普通文本
+const minSecretLength = 8
+
+// 注册需要从日志中去除的密钥，source 为密钥的来源，用于提示
+// 过短的值不去除，记录一条警告以便更换为更长的密钥，警告中不包含密钥本身
+func registerSecrets(source string, secrets ...string) {
+	for _, s := range secrets {
+		switch {
+		case s == "":
+		case len(s) < minSecretLength:
+			slog.Warn("Secret is too short to be redacted from logs", "source", source, "min_length", minSecretLength)
+		default:
+			logSecrets = append(logSecrets, s)
+		}
+	}
+}
+
+// 表示敏感信息的日志字段名称，名称相同或以 _名称 结尾的字段值整体替换
+var sensitiveLogKeys = []string{"token", "secret", "password", "authorization", "api_key", "access_key"}
+
+// 去除日志字段中的敏感信息
+// 名称为敏感字段的值整体替换，其他字符串和错误中出现的已注册密钥被替换，消息文本同样处理
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, k := range sensitiveLogKeys {
+		if key == k || strings.HasSuffix(key, "_"+k) {
+			return slog.String(a.Key, redactedValue)
+		}
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if s := a.Value.String(); s != "" {
+			a.Value = slog.StringValue(redactSecrets(s))
+		}
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok && err != nil {
+			a.Value = slog.StringValue(redactSecrets(err.Error()))
+		}
+	}
+	return a
+}
+
+// 替换文本中出现的已注册密钥
+func redactSecrets(s string) string {
+	for _, secret := range logSecrets {
+		s = strings.ReplaceAll(s, secret, redactedValue)
+	}
+	return s
+}
+
+// 为每条日志添加请求上下文中的请求ID、客户端密钥ID、火山引擎 reqid 和 trace ID
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := requestIDFromContext(ctx); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+		if id, ok := ctx.Value(apiKeyIdentityKey{}).(*apiKeyIdentity); ok && id.ID != "" {
+			r.AddAttrs(slog.String("key_id", id.ID))
+		}
+		if reqID := volcanoReqIDFromContext(ctx); reqID != "" {
+			r.AddAttrs(slog.String("volcano_reqid", reqID))
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type volcanoReqIDKey struct{}
+
+// 将一次上游调用的火山引擎 reqid 附加到上下文
+func withVolcanoReqID(ctx context.Context, reqID string) context.Context {
+	return context.WithValue(ctx, volcanoReqIDKey{}, reqID)
+}
+
+// 从上下文获取火山引擎 reqid
+func volcanoReqIDFromContext(ctx context.Context) string {
+	reqID, _ := ctx.Value(volcanoReqIDKey{}).(string)
+	return reqID
+}
+
+// 请求上下文中记录客户端密钥ID的键
+const logKeyIDKey = "log_key_id"
+
+// 记录请求的客户端密钥ID，用于访问日志
+func setLogKeyID(c *gin.Context, keyID string) {
+	c.Set(logKeyIDKey, keyID)
+}
+
+// 为每个请求分配请求ID并在请求结束后输出访问日志的中间件
+// 5xx 响应记为 error，4xx 响应记为 warn，健康检查和指标端点记为 debug
+func requestLogger(c *gin.Context) {
+	start := time.Now()
+	assignRequestID(c)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	case c.Request.URL.Path == "/health" || c.Request.URL.Path == "/metrics":
+		level = slog.LevelDebug
+	}
+	attrs := []slog.Attr{
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.Int("status", status),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("client_ip", c.ClientIP()),
+	}
+	if keyID := c.GetString(logKeyIDKey); keyID != "" {
+		attrs = append(attrs, slog.String("key_id", keyID))
+	}
+	if errorType := c.GetString(errorTypeKey); errorType != "" {
+		attrs = append(attrs, slog.String("error", errorType))
+	}
+	slog.LogAttrs(c.Request.Context(), level, "Request completed", attrs...)
+}
+
+// 输出错误日志并退出，用于启动阶段的致命错误
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append([]any{"error", err}, args...)...)
+	os.Exit(1)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// 使用 secrets 作为已注册的密钥，测试结束后恢复
+func useTestSecrets(t *testing.T, secrets ...string) {
+	t.Helper()
+	previous := logSecrets
+	logSecrets = nil
+	registerSecrets("test", secrets...)
+	t.Cleanup(func() { logSecrets = previous })
+}
+
+func TestRedactAttr(t *testing.T) {
+	const token = "volcano-token-1234"
+	useTestSecrets(t, token)
+
+	tests := []struct {
+		name string
+		attr slog.Attr
+		want string
+	}{
+		{name: "secret in string value", attr: slog.String("url", "wss://host/?token="+token), want: "wss://host/?token=" + redactedValue},
+		{name: "secret in error", attr: slog.Any("error", fmt.Errorf("dial failed: %w", errors.New("bad token "+token))), want: "dial failed: bad token " + redactedValue},
+		{name: "sensitive key name", attr: slog.String("token", "anything"), want: redactedValue},
+		{name: "sensitive key suffix", attr: slog.String("admin_api_key", "anything"), want: redactedValue},
+		{name: "sensitive key is case insensitive", attr: slog.String("Authorization", "Bearer;x"), want: redactedValue},
+		{name: "sensitive key with non-string value", attr: slog.Int("password", 1234), want: redactedValue},
+		{name: "key containing a sensitive word", attr: slog.String("tokens", "12"), want: "12"},
+		{name: "plain value", attr: slog.String("voice", "BV001_streaming"), want: "BV001_streaming"},
+		{name: "nil error", attr: slog.Any("error", error(nil)), want: "<nil>"},
+	}
+
+	for _, tt := range tests {
+		got := redactAttr(nil, tt.attr)
+		if got.Key != tt.attr.Key || got.Value.String() != tt.want {
+			t.Errorf("%s: redactAttr() = %s=%q, want %s=%q", tt.name, got.Key, got.Value.String(), tt.attr.Key, tt.want)
+		}
+	}
+}
+
+func TestRedactMessage(t *testing.T) {
+	const token = "volcano-token-1234"
+	useTestSecrets(t, token)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactAttr}))
+	logger.Info("connecting with " + token)
+	if strings.Contains(buf.String(), token) || !strings.Contains(buf.String(), redactedValue) {
+		t.Errorf("log = %q, want the secret redacted from the message", buf.String())
+	}
+}
+
+func TestRegisterSecrets(t *testing.T) {
+	// 过短的密钥记录警告，警告中不包含密钥本身
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(previous)
+
+	useTestSecrets(t, "", "s3cr3t", "12345678", "a-long-secret-value")
+	if n := strings.Count(logs.String(), "Secret is too short"); n != 1 {
+		t.Errorf("short secret warnings = %d, want 1: %s", n, logs.String())
+	}
+	if !strings.Contains(logs.String(), "source=test") || strings.Contains(logs.String(), "s3cr3t") {
+		t.Errorf("warning = %q, want source without the secret", logs.String())
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "key 12345678", want: "key " + redactedValue},
+		{text: "a-long-secret-value and 12345678", want: redactedValue + " and " + redactedValue},
+		{text: "an s3cr3t word", want: "an s3cr3t word"}, // 短于 minSecretLength 的值不替换
+		{text: "nothing to hide", want: "nothing to hide"},
+	}
+
+	for _, tt := range tests {
+		if got := redactSecrets(tt.text); got != tt.want {
+			t.Errorf("redactSecrets(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{level: "debug", want: slog.LevelDebug},
+		{level: "INFO", want: slog.LevelInfo},
+		{level: "warning", want: slog.LevelWarn},
+		{level: "error", want: slog.LevelError},
+		{level: "trace", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.level)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseLogLevel(%q) = %v, %v, want %v, wantErr %v", tt.level, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus 指标，由 /metrics 端点导出
+var (
+	// 按路由、状态码和错误类型统计的请求数，错误类型与 ErrorResponse 的 error 字段一致
+	metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tts_http_requests_total",
+		Help: "HTTP and WebSocket requests by route, status code and error type.",
+	}, []string{"route", "status", "error"})
+
+	// 从请求开始到第一帧音频的时间
+	metricFirstAudio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tts_synthesis_first_audio_seconds",
+		Help:    "Time from the start of a synthesis to its first audio frame.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"endpoint", "cached"})
+
+	// 从请求开始到合成完成的时间
+	metricSynthesisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tts_synthesis_duration_seconds",
+		Help:    "Time from the start of a synthesis to its completion.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"endpoint", "cached"})
+
+	// 成功合成的输入字符数
+	metricCharacters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tts_synthesized_characters_total",
+		Help: "Input characters of successful syntheses.",
+	}, []string{"endpoint", "cached"})
+
+	// 成功合成的音频字节数，不包括本地转码
+	metricAudioBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tts_synthesized_audio_bytes_total",
+		Help: "Audio bytes of successful syntheses before local transcoding.",
+	}, []string{"endpoint", "cached"})
+
+	// 建立上游连接的时间，v3 协议包括 StartConnection 握手
+	metricUpstreamDial = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tts_upstream_dial_seconds",
+		Help:    "Time to establish an upstream WebSocket connection.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	}, []string{"protocol", "result"})
+
+	// 火山引擎返回的错误码
+	metricVolcanoErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tts_volcano_errors_total",
+		Help: "Errors returned by Volcano Engine by error code.",
+	}, []string{"code"})
+
+	// 等待并发调用名额的时间
+	metricCallQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tts_call_queue_wait_seconds",
+		Help:    "Time spent waiting for a concurrent call slot.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"result"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tts_active_connections",
+		Help: "Client requests and WebSocket connections currently being served.",
+	}, func() float64 {
+		return float64(activeConnections.Load())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tts_current_calls",
+		Help: "Upstream synthesis calls currently holding a concurrent call slot.",
+	}, func() float64 {
+		return float64(callQueue.active())
+	})
+}
+
+// 请求上下文中记录错误类型的键
+const errorTypeKey = "error_type"
+
+// 记录请求的错误类型，用于请求计数
+// 已开始输出音频后发生的错误不改变状态码，也通过错误类型统计
+func setErrorType(c *gin.Context, errorType string) {
+	c.Set(errorTypeKey, errorType)
+}
+
+// 写出带请求ID的错误响应并记录错误类型
+func writeErrorResponse(c *gin.Context, resp *ErrorResponse) {
+	setErrorType(c, resp.Error)
+	resp.RequestID = requestIDFromContext(c.Request.Context())
+	c.JSON(resp.Code, resp)
+}
+
+// 统计请求数的中间件，未匹配任何路由的请求记为 unmatched，避免标签数量无限增长
+func metricsMiddleware(c *gin.Context) {
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metricRequests.WithLabelValues(route, strconv.Itoa(c.Writer.Status()), c.GetString(errorTypeKey)).Inc()
+}
+
+// 导出 Prometheus 指标
+var handleMetrics = gin.WrapH(promhttp.Handler())
+
+// 记录一次成功合成的延迟、字符数和音频字节数
+func observeSynthesis(endpoint string, cached bool, characters int, audioBytes int64, firstAudio, duration time.Duration) {
+	labels := prometheus.Labels{"endpoint": endpoint, "cached": strconv.FormatBool(cached)}
+	if audioBytes > 0 {
+		metricFirstAudio.With(labels).Observe(firstAudio.Seconds())
+	}
+	metricSynthesisDuration.With(labels).Observe(duration.Seconds())
+	metricCharacters.With(labels).Add(float64(characters))
+	metricAudioBytes.With(labels).Add(float64(audioBytes))
+}
+
+// 记录一次建立上游连接的时间
+func observeUpstreamDial(protocol string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metricUpstreamDial.WithLabelValues(protocol, result).Observe(time.Since(start).Seconds())
+}
+
+// 记录火山引擎返回的错误码
+func observeVolcanoError(err error) {
+	var volcErr *VolcanoError
+	if errors.As(err, &volcErr) {
+		metricVolcanoErrors.WithLabelValues(strconv.Itoa(volcErr.Code)).Inc()
+	}
+}
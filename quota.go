@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// 配额，0表示不限制
+type quotaConfig struct {
+	// RequestsPerDay 每天（UTC）的请求数
+	RequestsPerDay int `json:"requests_per_day,omitempty"`
+	// RequestsPerMonth 每月（UTC）的请求数
+	RequestsPerMonth int `json:"requests_per_month,omitempty"`
+	// CharsPerDay 每天（UTC）的输入字符数
+	CharsPerDay int `json:"chars_per_day,omitempty"`
+	// CharsPerMonth 每月（UTC）的输入字符数
+	CharsPerMonth int `json:"chars_per_month,omitempty"`
+}
+
+// 用 override 中非0的配额覆盖默认配额
+func (qc quotaConfig) merge(override *quotaConfig) quotaConfig {
+	if override == nil {
+		return qc
+	}
+	if override.RequestsPerDay != 0 {
+		qc.RequestsPerDay = override.RequestsPerDay
+	}
+	if override.RequestsPerMonth != 0 {
+		qc.RequestsPerMonth = override.RequestsPerMonth
+	}
+	if override.CharsPerDay != 0 {
+		qc.CharsPerDay = override.CharsPerDay
+	}
+	if override.CharsPerMonth != 0 {
+		qc.CharsPerMonth = override.CharsPerMonth
+	}
+	return qc
+}
+
+// 验证配额不为负数
+func (qc quotaConfig) validate() error {
+	if qc.RequestsPerDay < 0 || qc.RequestsPerMonth < 0 || qc.CharsPerDay < 0 || qc.CharsPerMonth < 0 {
+		return fmt.Errorf("quotas must not be negative")
+	}
+	return nil
+}
+
+// 是否没有任何配额
+func (qc quotaConfig) unlimited() bool {
+	return qc == quotaConfig{}
+}
+
+// 配额周期
+const (
+	quotaPeriodDay   = "day"
+	quotaPeriodMonth = "month"
+)
+
+// 一个密钥在当前周期内的用量
+type quotaUsage struct {
+	// Day 当前日期（UTC），日期变化时每天的用量清零
+	Day         string `json:"day"`
+	DayRequests int    `json:"day_requests"`
+	DayChars    int    `json:"day_chars"`
+	// Month 当前月份（UTC），月份变化时每月的用量清零
+	Month         string `json:"month"`
+	MonthRequests int    `json:"month_requests"`
+	MonthChars    int    `json:"month_chars"`
+}
+
+// 进入 now 所在的周期，跨周期时清零用量
+func (u *quotaUsage) roll(now time.Time) {
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day, u.DayRequests, u.DayChars = day, 0, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthRequests, u.MonthChars = month, 0, 0
+	}
+}
+
+// 下一个周期开始的时间
+func quotaPeriodEnd(period string, now time.Time) time.Time {
+	if period == quotaPeriodDay {
+		return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// 超过配额的错误
+type quotaError struct {
+	limit   string    // 配额名称，例如 chars_per_day
+	resetAt time.Time // 配额恢复的时间
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%v: %s quota exhausted, resets at %s", ErrQuotaExceeded, e.limit, e.resetAt.Format(time.RFC3339))
+}
+
+func (e *quotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// 配额计数器
+// 按密钥ID记录每天和每月的请求数和字符数，定期写入状态文件，服务重启后继续计数
+type quotaStore struct {
+	path string // 为空时计数只保存在内存中
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+	dirty bool
+
+	// 串行化状态文件的写入，定时保存、重置计数和退出前的保存同时进行时，
+	// 后取得的快照后写入，较旧的快照不会覆盖较新的快照
+	flushMu sync.Mutex
+}
+
+// 配额计数器，默认为内存计数器
+var quotas = &quotaStore{usage: make(map[string]*quotaUsage)}
+
+// 加载配额状态文件，文件不存在时从0开始计数，路径为空时只在内存中计数
+func LoadQuotaStore(path string) (*quotaStore, error) {
+	qs := &quotaStore{path: path, usage: make(map[string]*quotaUsage)}
+	if path == "" {
+		return qs, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return qs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota state: %w", err)
+	}
+	if err := json.Unmarshal(data, &qs.usage); err != nil {
+		return nil, fmt.Errorf("failed to parse quota state: %w", err)
+	}
+	for id, u := range qs.usage {
+		if u == nil {
+			delete(qs.usage, id)
+		}
+	}
+	return qs, nil
+}
+
+// 获取密钥的用量并进入当前周期，调用方需持有锁
+func (qs *quotaStore) get(keyID string, now time.Time) *quotaUsage {
+	u, ok := qs.usage[keyID]
+	if !ok {
+		u = &quotaUsage{}
+		qs.usage[keyID] = u
+	}
+	u.roll(now)
+	return u
+}
+
+// 扣除配额，任一配额不足时不扣除并返回 quotaError
+func (qs *quotaStore) take(keyID string, limits quotaConfig, requests, chars int) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	now := time.Now().UTC()
+	u := qs.get(keyID, now)
+	for _, check := range []struct {
+		name   string
+		period string
+		used   int
+		n      int
+		limit  int
+	}{
+		{"requests_per_day", quotaPeriodDay, u.DayRequests, requests, limits.RequestsPerDay},
+		{"requests_per_month", quotaPeriodMonth, u.MonthRequests, requests, limits.RequestsPerMonth},
+		{"chars_per_day", quotaPeriodDay, u.DayChars, chars, limits.CharsPerDay},
+		{"chars_per_month", quotaPeriodMonth, u.MonthChars, chars, limits.CharsPerMonth},
+	} {
+		if check.limit > 0 && check.n > 0 && check.used+check.n > check.limit {
+			return &quotaError{limit: check.name, resetAt: quotaPeriodEnd(check.period, now)}
+		}
+	}
+
+	u.DayRequests += requests
+	u.MonthRequests += requests
+	u.DayChars += chars
+	u.MonthChars += chars
+	qs.dirty = true
+	return nil
+}
+
+// 退还扣除的配额，跨周期后不再退还
+func (qs *quotaStore) refund(keyID string, day, month string, requests, chars int) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	u := qs.get(keyID, time.Now().UTC())
+	if u.Day == day {
+		u.DayRequests = max(0, u.DayRequests-requests)
+		u.DayChars = max(0, u.DayChars-chars)
+	}
+	if u.Month == month {
+		u.MonthRequests = max(0, u.MonthRequests-requests)
+		u.MonthChars = max(0, u.MonthChars-chars)
+	}
+	qs.dirty = true
+}
+
+// 是否有密钥的计数
+func (qs *quotaStore) has(keyID string) bool {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	_, ok := qs.usage[keyID]
+	return ok
+}
+
+// 密钥在当前周期内的用量
+func (qs *quotaStore) current(keyID string) quotaUsage {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return *qs.get(keyID, time.Now().UTC())
+}
+
+// 清零密钥在 period 周期内的用量，period 为空时清零全部周期
+func (qs *quotaStore) reset(keyID, period string) error {
+	qs.mu.Lock()
+	u := qs.get(keyID, time.Now().UTC())
+	if period == "" || period == quotaPeriodDay {
+		u.DayRequests, u.DayChars = 0, 0
+	}
+	if period == "" || period == quotaPeriodMonth {
+		u.MonthRequests, u.MonthChars = 0, 0
+	}
+	qs.dirty = true
+	qs.mu.Unlock()
+
+	return qs.flush()
+}
+
+// 有未保存的计数时写入状态文件
+func (qs *quotaStore) flush() error {
+	if qs.path == "" {
+		return nil
+	}
+
+	qs.flushMu.Lock()
+	defer qs.flushMu.Unlock()
+
+	qs.mu.Lock()
+	if !qs.dirty {
+		qs.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(qs.usage)
+	qs.dirty = false
+	qs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(qs.path, data); err != nil {
+		qs.mu.Lock()
+		qs.dirty = true
+		qs.mu.Unlock()
+		return fmt.Errorf("failed to write quota state: %w", err)
+	}
+	return nil
+}
+
+// 配额计数统计信息
+func (qs *quotaStore) stats() map[string]interface{} {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return map[string]interface{}{
+		"file": qs.path,
+		"keys": len(qs.usage),
+	}
+}
+
+// 定期保存计数，服务异常退出时最多丢失一个周期内的计数
+func (qs *quotaStore) run(interval time.Duration) {
+	if qs.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := qs.flush(); err != nil {
+			slog.Warn("Failed to save quota state", "error", err)
+		}
+	}
+}
+
+// 配额的剩余量，不限制的配额不返回
+func (qc quotaConfig) remaining(u quotaUsage) map[string]int {
+	remaining := make(map[string]int)
+	for _, r := range []struct {
+		name  string
+		used  int
+		limit int
+	}{
+		{"requests_per_day", u.DayRequests, qc.RequestsPerDay},
+		{"requests_per_month", u.MonthRequests, qc.RequestsPerMonth},
+		{"chars_per_day", u.DayChars, qc.CharsPerDay},
+		{"chars_per_month", u.MonthChars, qc.CharsPerMonth},
+	} {
+		if r.limit > 0 {
+			remaining[r.name] = max(0, r.limit-r.used)
+		}
+	}
+	return remaining
+}
+
+// 一次请求扣除的配额
+type quotaReservation struct {
+	keyID    string
+	day      string
+	month    string
+	requests int
+	chars    int
+}
+
+// 按请求上下文中的客户端密钥扣除配额，密钥没有配额时不扣除并返回nil
+func reserveQuota(ctx context.Context, requests, chars int) (*quotaReservation, error) {
+	id := apiKeyIdentityFromContext(ctx)
+	if id.ID == "" || id.Quota.unlimited() {
+		return nil, nil
+	}
+	if err := quotas.take(id.ID, id.Quota, requests, chars); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &quotaReservation{
+		keyID:    id.ID,
+		day:      now.Format(time.DateOnly),
+		month:    now.Format("2006-01"),
+		requests: requests,
+		chars:    chars,
+	}, nil
+}
+
+// 包装合成函数，合成失败且没有输出任何音频时退还扣除的配额
+func (r *quotaReservation) settle(synthesize func(onAudio audioHandler) error) func(onAudio audioHandler) error {
+	if r == nil {
+		return synthesize
+	}
+	return func(onAudio audioHandler) error {
+		received := false
+		err := synthesize(func(audio []byte) error {
+			received = true
+			return onAudio(audio)
+		})
+		if err != nil && !received {
+			r.refund()
+		}
+		return err
+	}
+}
+
+// 退还扣除的配额，不限制配额时 r 为nil
+func (r *quotaReservation) refund() {
+	if r != nil {
+		quotas.refund(r.keyID, r.day, r.month, r.requests, r.chars)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 使用独立的内存配额计数器，测试结束后恢复
+func useTestQuotaStore(t *testing.T) *quotaStore {
+	t.Helper()
+	previous := quotas
+	quotas = &quotaStore{usage: make(map[string]*quotaUsage)}
+	t.Cleanup(func() { quotas = previous })
+	return quotas
+}
+
+func TestQuotaUsageRoll(t *testing.T) {
+	used := quotaUsage{Day: "2026-01-30", DayRequests: 3, DayChars: 30, Month: "2026-01", MonthRequests: 5, MonthChars: 50}
+	tests := []struct {
+		name   string
+		before quotaUsage
+		now    time.Time
+		want   quotaUsage
+	}{
+		{
+			name:   "same day",
+			before: used,
+			now:    time.Date(2026, 1, 30, 23, 59, 0, 0, time.UTC),
+			want:   used,
+		},
+		{
+			name:   "next day in same month",
+			before: used,
+			now:    time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC),
+			want:   quotaUsage{Day: "2026-01-31", Month: "2026-01", MonthRequests: 5, MonthChars: 50},
+		},
+		{
+			name:   "next month",
+			before: used,
+			now:    time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+			want:   quotaUsage{Day: "2026-02-01", Month: "2026-02"},
+		},
+		{
+			name: "new key",
+			now:  time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC),
+			want: quotaUsage{Day: "2026-03-04", Month: "2026-03"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tt.before
+			u.roll(tt.now)
+			if u != tt.want {
+				t.Errorf("usage = %+v, want %+v", u, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaPeriodEnd(t *testing.T) {
+	tests := []struct {
+		period string
+		now    time.Time
+		want   time.Time
+	}{
+		{quotaPeriodDay, time.Date(2026, 1, 31, 15, 4, 5, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{quotaPeriodMonth, time.Date(2026, 1, 31, 15, 4, 5, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{quotaPeriodMonth, time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		if got := quotaPeriodEnd(tt.period, tt.now); !got.Equal(tt.want) {
+			t.Errorf("quotaPeriodEnd(%s, %v) = %v, want %v", tt.period, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestQuotaStoreTake(t *testing.T) {
+	type take struct {
+		requests, chars int
+		wantLimit       string // 超过配额时的配额名称
+	}
+	tests := []struct {
+		name   string
+		limits quotaConfig
+		takes  []take
+	}{
+		{
+			name:   "requests per day",
+			limits: quotaConfig{RequestsPerDay: 2},
+			takes:  []take{{requests: 1}, {requests: 1}, {requests: 1, wantLimit: "requests_per_day"}},
+		},
+		{
+			name:   "chars per month",
+			limits: quotaConfig{CharsPerMonth: 10},
+			takes:  []take{{chars: 6}, {chars: 5, wantLimit: "chars_per_month"}, {chars: 4}},
+		},
+		{
+			name:   "rejected take does not consume",
+			limits: quotaConfig{RequestsPerDay: 2, CharsPerDay: 10},
+			takes:  []take{{requests: 1, chars: 8}, {requests: 1, chars: 3, wantLimit: "chars_per_day"}, {requests: 1, chars: 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs := &quotaStore{usage: make(map[string]*quotaUsage)}
+			for i, tk := range tt.takes {
+				err := qs.take("key", tt.limits, tk.requests, tk.chars)
+				var exceeded *quotaError
+				if tk.wantLimit == "" {
+					if err != nil {
+						t.Fatalf("take %d: %v", i, err)
+					}
+					continue
+				}
+				if !errors.As(err, &exceeded) || !errors.Is(err, ErrQuotaExceeded) {
+					t.Fatalf("take %d: err = %v, want quotaError", i, err)
+				}
+				if exceeded.limit != tk.wantLimit {
+					t.Errorf("take %d: limit = %q, want %q", i, exceeded.limit, tk.wantLimit)
+				}
+				if !exceeded.resetAt.After(time.Now()) {
+					t.Errorf("take %d: resetAt %v is not in the future", i, exceeded.resetAt)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaStoreRefund(t *testing.T) {
+	now := time.Now().UTC()
+	today, thisMonth := now.Format(time.DateOnly), now.Format("2006-01")
+	tests := []struct {
+		name           string
+		day, month     string // 扣除配额时的周期
+		requests       int
+		chars          int
+		wantDayChars   int
+		wantMonthChars int
+	}{
+		{name: "current period", day: today, month: thisMonth, requests: 1, chars: 10, wantDayChars: 0, wantMonthChars: 0},
+		{name: "previous day", day: "2000-01-01", month: thisMonth, requests: 1, chars: 10, wantDayChars: 10, wantMonthChars: 0},
+		{name: "previous month", day: "2000-01-01", month: "2000-01", requests: 1, chars: 10, wantDayChars: 10, wantMonthChars: 10},
+		{name: "refund is capped at usage", day: today, month: thisMonth, requests: 5, chars: 100, wantDayChars: 0, wantMonthChars: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs := &quotaStore{usage: make(map[string]*quotaUsage)}
+			if err := qs.take("key", quotaConfig{CharsPerDay: 100}, 1, 10); err != nil {
+				t.Fatal(err)
+			}
+			qs.refund("key", tt.day, tt.month, tt.requests, tt.chars)
+
+			u := qs.current("key")
+			if u.DayChars != tt.wantDayChars || u.MonthChars != tt.wantMonthChars {
+				t.Errorf("chars day/month = %d/%d, want %d/%d", u.DayChars, u.MonthChars, tt.wantDayChars, tt.wantMonthChars)
+			}
+			if u.DayRequests < 0 || u.MonthRequests < 0 {
+				t.Errorf("negative request usage: %+v", u)
+			}
+		})
+	}
+}
+
+func TestQuotaReservationSettle(t *testing.T) {
+	tests := []struct {
+		name      string
+		audio     bool // 失败前是否输出了音频
+		err       error
+		wantChars int
+	}{
+		{name: "success keeps charge", err: nil, wantChars: 10},
+		{name: "failure before audio is refunded", err: ErrUpstreamUnavailable, wantChars: 0},
+		{name: "failure after audio keeps charge", audio: true, err: ErrUpstreamUnavailable, wantChars: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs := useTestQuotaStore(t)
+			ctx := withAPIKeyIdentity(context.Background(), &apiKeyIdentity{ID: "key", Quota: quotaConfig{CharsPerDay: 100}})
+
+			reservation, err := reserveQuota(ctx, 1, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			synthesize := reservation.settle(func(onAudio audioHandler) error {
+				if tt.audio {
+					if err := onAudio([]byte("audio")); err != nil {
+						return err
+					}
+				}
+				return tt.err
+			})
+			if err := synthesize(func([]byte) error { return nil }); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if got := qs.current("key").DayChars; got != tt.wantChars {
+				t.Errorf("day chars = %d, want %d", got, tt.wantChars)
+			}
+		})
+	}
+}
+
+func TestReserveQuotaUnlimited(t *testing.T) {
+	qs := useTestQuotaStore(t)
+	ctx := withAPIKeyIdentity(context.Background(), &apiKeyIdentity{ID: "key"})
+
+	reservation, err := reserveQuota(ctx, 1, 10)
+	if err != nil || reservation != nil {
+		t.Fatalf("reserveQuota = %v, %v, want nil, nil", reservation, err)
+	}
+	reservation.refund()
+	if qs.has("key") {
+		t.Error("usage recorded for key without quota")
+	}
+}
+
+func TestQuotaStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	qs, err := LoadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qs.take("key", quotaConfig{CharsPerDay: 100}, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := qs.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.current("key"), qs.current("key"); got != want {
+		t.Errorf("loaded usage = %+v, want %+v", got, want)
+	}
+}
+
+func TestQuotaStoreConcurrentFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	qs, err := LoadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 计数、定时保存和重置同时进行，最后写入文件的必须是最新的计数
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i%4)
+			for j := 0; j < 20; j++ {
+				if err := qs.take(key, quotaConfig{}, 1, 10); err != nil {
+					t.Error(err)
+					return
+				}
+				if j%5 == 0 {
+					if err := qs.reset(key, quotaPeriodDay); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if err := qs.flush(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	loaded, err := LoadQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if got, want := loaded.current(key), qs.current(key); got != want {
+			t.Errorf("%s: saved usage = %+v, want %+v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 限流额度，0表示不限制
+type rateLimitConfig struct {
+	// RequestsPerMinute 每分钟请求数
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	// CharsPerMinute 每分钟输入字符数
+	CharsPerMinute int `json:"chars_per_minute,omitempty"`
+	// CharsPerDay 每天输入字符数
+	CharsPerDay int `json:"chars_per_day,omitempty"`
+}
+
+// 用 override 中非0的额度覆盖默认额度
+func (rc rateLimitConfig) merge(override *rateLimitConfig) rateLimitConfig {
+	if override == nil {
+		return rc
+	}
+	if override.RequestsPerMinute != 0 {
+		rc.RequestsPerMinute = override.RequestsPerMinute
+	}
+	if override.CharsPerMinute != 0 {
+		rc.CharsPerMinute = override.CharsPerMinute
+	}
+	if override.CharsPerDay != 0 {
+		rc.CharsPerDay = override.CharsPerDay
+	}
+	return rc
+}
+
+// 验证额度不为负数
+func (rc rateLimitConfig) validate() error {
+	if rc.RequestsPerMinute < 0 || rc.CharsPerMinute < 0 || rc.CharsPerDay < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	return nil
+}
+
+// 是否没有任何限制
+func (rc rateLimitConfig) unlimited() bool {
+	return rc.RequestsPerMinute == 0 && rc.CharsPerMinute == 0 && rc.CharsPerDay == 0
+}
+
+// 令牌桶，容量为额度，令牌按额度匀速补充
+type tokenBucket struct {
+	name     string  // 额度名称，例如 requests_per_minute
+	capacity float64 // 桶容量
+	rate     float64 // 每秒补充的令牌数
+	tokens   float64
+	updated  time.Time
+}
+
+// 创建装满令牌的令牌桶，每 period 补充 limit 个令牌
+func newTokenBucket(name string, limit int, period time.Duration, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		name:     name,
+		capacity: float64(limit),
+		rate:     float64(limit) / period.Seconds(),
+		tokens:   float64(limit),
+		updated:  now,
+	}
+}
+
+// 补充从上次更新到 now 的令牌
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = min(b.capacity, b.tokens+elapsed*b.rate)
+		b.updated = now
+	}
+}
+
+// 令牌数达到 n 还需要等待的时间，调用前需先 refill
+func (b *tokenBucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// 一个限流对象（API密钥或客户端IP）的令牌桶，额度为0的桶为nil
+type rateLimitSubject struct {
+	kind   string // key 或 ip
+	config rateLimitConfig
+
+	requests    *tokenBucket
+	charsMinute *tokenBucket
+	charsDay    *tokenBucket
+}
+
+// 按额度创建令牌桶
+func newRateLimitSubject(kind string, config rateLimitConfig, now time.Time) *rateLimitSubject {
+	s := &rateLimitSubject{kind: kind, config: config}
+	if config.RequestsPerMinute > 0 {
+		s.requests = newTokenBucket("requests_per_minute", config.RequestsPerMinute, time.Minute, now)
+	}
+	if config.CharsPerMinute > 0 {
+		s.charsMinute = newTokenBucket("chars_per_minute", config.CharsPerMinute, time.Minute, now)
+	}
+	if config.CharsPerDay > 0 {
+		s.charsDay = newTokenBucket("chars_per_day", config.CharsPerDay, 24*time.Hour, now)
+	}
+	return s
+}
+
+// 所有令牌桶
+func (s *rateLimitSubject) buckets() []*tokenBucket {
+	var buckets []*tokenBucket
+	for _, b := range []*tokenBucket{s.requests, s.charsMinute, s.charsDay} {
+		if b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// 所有令牌桶都已装满，删除后重新创建不影响限流
+func (s *rateLimitSubject) full(now time.Time) bool {
+	for _, b := range s.buckets() {
+		b.refill(now)
+		if b.tokens < b.capacity {
+			return false
+		}
+	}
+	return true
+}
+
+// 超过限流额度的错误
+type rateLimitError struct {
+	kind       string        // key 或 ip
+	limit      string        // 额度名称
+	retryAfter time.Duration // 额度恢复所需的时间
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("%v: %s limit per %s exceeded, retry after %ds", ErrRateLimited, e.limit, e.kind, retryAfterSeconds(e.retryAfter))
+}
+
+func (e *rateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// 向上取整的秒数，至少为1
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// 限流器，按API密钥和客户端IP分别维护令牌桶
+type rateLimiter struct {
+	keyLimits rateLimitConfig
+	ipLimits  rateLimitConfig
+
+	mu        sync.Mutex
+	subjects  map[string]*rateLimitSubject
+	lastSweep time.Time
+	rejected  int64 // 被限流拒绝的请求数
+}
+
+// 清理令牌桶已装满的限流对象的间隔
+const rateLimitSweepInterval = time.Minute
+
+// 全局限流器，在 main 中根据配置创建，为nil表示不限流
+var requestLimiter *rateLimiter
+
+// 创建限流器，API密钥和IP都没有额度时返回nil
+func newRateLimiter(keyLimits, ipLimits rateLimitConfig) *rateLimiter {
+	if keyLimits.unlimited() && ipLimits.unlimited() {
+		return nil
+	}
+	return &rateLimiter{
+		keyLimits: keyLimits,
+		ipLimits:  ipLimits,
+		subjects:  make(map[string]*rateLimitSubject),
+	}
+}
+
+// 获取限流对象，不存在或额度变化时重新创建令牌桶，调用方需持有锁
+func (rl *rateLimiter) subject(ref rateLimitRef, now time.Time) *rateLimitSubject {
+	s, ok := rl.subjects[ref.id]
+	if !ok || s.config != ref.config {
+		s = newRateLimitSubject(ref.kind, ref.config, now)
+		rl.subjects[ref.id] = s
+	}
+	return s
+}
+
+// 删除令牌桶已装满的限流对象，调用方需持有锁
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for id, s := range rl.subjects {
+		if s.full(now) {
+			delete(rl.subjects, id)
+		}
+	}
+}
+
+// 请求适用的一个限流对象
+type rateLimitRef struct {
+	id     string // key:<密钥ID或密钥哈希> 或 ip:<客户端IP>
+	kind   string
+	config rateLimitConfig
+}
+
+// 一个请求适用的限流对象，为nil表示不限流
+// 每次扣除额度时按ID重新查找令牌桶，长时间的WebSocket连接与新请求共用同一组令牌桶
+type rateLimitHandle struct {
+	limiter *rateLimiter
+	refs    []rateLimitRef
+}
+
+// 为请求创建限流句柄，apiKey 为空时只按IP限流
+// 密钥库中的密钥按密钥ID计数并可单独配置额度，其他密钥按哈希计数
+func (rl *rateLimiter) handle(apiKey, clientIP string) *rateLimitHandle {
+	h := &rateLimitHandle{limiter: rl}
+	if apiKey != "" {
+		ref := rateLimitRef{kind: "key", config: rl.keyLimits}
+		if k, ok := apiKeys.verify(apiKey); ok {
+			ref.id = "key:" + k.ID
+			ref.config = ref.config.merge(k.RateLimit)
+		} else {
+			ref.id = "key:" + hashedAPIKeyID(apiKey)
+		}
+		if !ref.config.unlimited() {
+			h.refs = append(h.refs, ref)
+		}
+	}
+	if !rl.ipLimits.unlimited() {
+		h.refs = append(h.refs, rateLimitRef{id: "ip:" + clientIP, kind: "ip", config: rl.ipLimits})
+	}
+	if len(h.refs) == 0 {
+		return nil
+	}
+	return h
+}
+
+// 查找句柄对应的限流对象，调用方需持有锁
+func (h *rateLimitHandle) subjects(now time.Time) []*rateLimitSubject {
+	h.limiter.sweep(now)
+	subjects := make([]*rateLimitSubject, 0, len(h.refs))
+	for _, ref := range h.refs {
+		subjects = append(subjects, h.limiter.subject(ref, now))
+	}
+	return subjects
+}
+
+// 扣除 requests 个请求和 chars 个字符的额度，任一令牌桶不足时不扣除并返回 rateLimitError
+// 字符数超过某个额度的容量时永远无法满足，返回 ErrTextTooLong
+func (h *rateLimitHandle) take(requests, chars int) error {
+	if h == nil || (requests == 0 && chars == 0) {
+		return nil
+	}
+
+	rl := h.limiter
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	subjects := h.subjects(now)
+	var limited *rateLimitError
+	for _, s := range subjects {
+		for _, need := range []struct {
+			bucket *tokenBucket
+			n      int
+		}{{s.requests, requests}, {s.charsMinute, chars}, {s.charsDay, chars}} {
+			b := need.bucket
+			if b == nil || need.n == 0 {
+				continue
+			}
+			if float64(need.n) > b.capacity {
+				rl.rejected++
+				return fmt.Errorf("%w: text length %d exceeds the %s limit of %d per %s", ErrTextTooLong, need.n, b.name, int(b.capacity), s.kind)
+			}
+			b.refill(now)
+			if wait := b.wait(float64(need.n)); wait > 0 && (limited == nil || wait > limited.retryAfter) {
+				limited = &rateLimitError{kind: s.kind, limit: b.name, retryAfter: wait}
+			}
+		}
+	}
+	if limited != nil {
+		rl.rejected++
+		return limited
+	}
+
+	for _, s := range subjects {
+		if s.requests != nil {
+			s.requests.tokens -= float64(requests)
+		}
+		if s.charsMinute != nil {
+			s.charsMinute.tokens -= float64(chars)
+		}
+		if s.charsDay != nil {
+			s.charsDay.tokens -= float64(chars)
+		}
+	}
+	return nil
+}
+
+// 设置 X-RateLimit-* 响应头，报告剩余比例最低的额度
+// X-RateLimit-Reset 为该额度完全恢复所需的秒数
+func (h *rateLimitHandle) setHeaders(c *gin.Context) {
+	if h == nil {
+		return
+	}
+
+	rl := h.limiter
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	var tightest *tokenBucket
+	for _, s := range h.subjects(now) {
+		for _, b := range s.buckets() {
+			b.refill(now)
+			if tightest == nil || b.tokens/b.capacity < tightest.tokens/tightest.capacity {
+				tightest = b
+			}
+		}
+	}
+	c.Header("X-RateLimit-Limit", strconv.Itoa(int(tightest.capacity)))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(max(0, int(tightest.tokens))))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(tightest.wait(tightest.capacity).Seconds()))))
+	c.Header("X-RateLimit-Policy", tightest.name)
+}
+
+// 限流统计信息
+func (rl *rateLimiter) stats() map[string]interface{} {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return map[string]interface{}{
+		"key_limits": rl.keyLimits,
+		"ip_limits":  rl.ipLimits,
+		"tracked":    len(rl.subjects),
+		"rejected":   rl.rejected,
+	}
+}
+
+type rateLimitKey struct{}
+
+// 将限流句柄附加到请求上下文
+func withRateLimit(ctx context.Context, h *rateLimitHandle) context.Context {
+	return context.WithValue(ctx, rateLimitKey{}, h)
+}
+
+// 扣除请求上下文对应的限流额度，未启用限流时直接返回
+func takeRateLimit(ctx context.Context, requests, chars int) error {
+	h, _ := ctx.Value(rateLimitKey{}).(*rateLimitHandle)
+	return h.take(requests, chars)
+}
+
+// 限流中间件：按API密钥和客户端IP扣除一个请求的额度，超过额度时返回429
+// 输入字符数在解析出文本后由各端点通过 takeRateLimit 扣除
+func rateLimit(c *gin.Context) {
+	if requestLimiter == nil {
+		c.Next()
+		return
+	}
+
+	apiKey := extractAPIKey(c)
+	if apiKey == "" {
+		apiKey = c.Query("api_key")
+	}
+	h := requestLimiter.handle(apiKey, c.ClientIP())
+	if h == nil {
+		c.Next()
+		return
+	}
+
+	err := h.take(1, 0)
+	h.setHeaders(c)
+	if err != nil {
+		writeSynthesisError(c, err)
+		c.Abort()
+		return
+	}
+
+	c.Request = c.Request.WithContext(withRateLimit(c.Request.Context(), h))
+	c.Next()
+}
+
+// 设置请求上下文对应的 X-RateLimit-* 响应头，必须在写出响应之前调用
+func setRateLimitHeaders(c *gin.Context) {
+	h, _ := c.Request.Context().Value(rateLimitKey{}).(*rateLimitHandle)
+	h.setHeaders(c)
+}
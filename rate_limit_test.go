@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name       string
+		tokens     float64 // 补充前的令牌数
+		elapsed    time.Duration
+		need       float64
+		wantTokens float64
+		wantWait   time.Duration
+	}{
+		{name: "full bucket", tokens: 60, need: 1, wantTokens: 60},
+		{name: "refills at rate", tokens: 0, elapsed: 2 * time.Second, need: 1, wantTokens: 2},
+		{name: "refill is capped at capacity", tokens: 59, elapsed: time.Minute, need: 1, wantTokens: 60},
+		{name: "waits for missing tokens", tokens: 0, need: 5, wantTokens: 0, wantWait: 5 * time.Second},
+		{name: "partial tokens", tokens: 0, elapsed: 1500 * time.Millisecond, need: 2, wantTokens: 1.5, wantWait: 500 * time.Millisecond},
+		{name: "clock going backwards", tokens: 10, elapsed: -time.Second, need: 1, wantTokens: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket("requests_per_minute", 60, time.Minute, start)
+			b.tokens = tt.tokens
+			b.refill(start.Add(tt.elapsed))
+			if b.tokens != tt.wantTokens {
+				t.Errorf("tokens = %v, want %v", b.tokens, tt.wantTokens)
+			}
+			if got := b.wait(tt.need); got != tt.wantWait {
+				t.Errorf("wait(%v) = %v, want %v", tt.need, got, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestRateLimitHandleTake(t *testing.T) {
+	type take struct {
+		requests, chars int
+		wantErr         error
+		wantLimit       string // 超过额度时的额度名称
+	}
+	tests := []struct {
+		name   string
+		limits rateLimitConfig
+		takes  []take
+	}{
+		{
+			name:   "requests per minute",
+			limits: rateLimitConfig{RequestsPerMinute: 2},
+			takes: []take{
+				{requests: 1},
+				{requests: 1},
+				{requests: 1, wantErr: ErrRateLimited, wantLimit: "requests_per_minute"},
+			},
+		},
+		{
+			name:   "chars per minute",
+			limits: rateLimitConfig{CharsPerMinute: 10},
+			takes: []take{
+				{chars: 6},
+				{chars: 6, wantErr: ErrRateLimited, wantLimit: "chars_per_minute"},
+				{chars: 4},
+			},
+		},
+		{
+			name:   "text longer than capacity",
+			limits: rateLimitConfig{CharsPerMinute: 10},
+			takes: []take{
+				{chars: 11, wantErr: ErrTextTooLong},
+				{chars: 10},
+			},
+		},
+		{
+			name:   "rejected take does not consume other buckets",
+			limits: rateLimitConfig{RequestsPerMinute: 2, CharsPerMinute: 10},
+			takes: []take{
+				{requests: 1, chars: 8},
+				{requests: 1, chars: 5, wantErr: ErrRateLimited, wantLimit: "chars_per_minute"},
+				{requests: 1, chars: 2},
+				{requests: 1, wantErr: ErrRateLimited, wantLimit: "requests_per_minute"},
+			},
+		},
+		{
+			name:   "longest wait is reported",
+			limits: rateLimitConfig{RequestsPerMinute: 1, CharsPerDay: 10},
+			takes: []take{
+				{requests: 1, chars: 10},
+				{requests: 1, chars: 1, wantErr: ErrRateLimited, wantLimit: "chars_per_day"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := newRateLimiter(rateLimitConfig{}, tt.limits)
+			h := rl.handle("", "192.0.2.1")
+			for i, tk := range tt.takes {
+				err := h.take(tk.requests, tk.chars)
+				if !errors.Is(err, tk.wantErr) {
+					t.Fatalf("take %d: err = %v, want %v", i, err, tk.wantErr)
+				}
+				var limited *rateLimitError
+				if errors.As(err, &limited) {
+					if limited.limit != tk.wantLimit {
+						t.Errorf("take %d: limit = %q, want %q", i, limited.limit, tk.wantLimit)
+					}
+					if limited.kind != "ip" || limited.retryAfter <= 0 {
+						t.Errorf("take %d: kind = %q, retryAfter = %v", i, limited.kind, limited.retryAfter)
+					}
+				} else if tk.wantLimit != "" {
+					t.Errorf("take %d: err = %v, want rateLimitError", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	if rl := newRateLimiter(rateLimitConfig{}, rateLimitConfig{}); rl != nil {
+		t.Fatal("limiter created without limits")
+	}
+	rl := newRateLimiter(rateLimitConfig{RequestsPerMinute: 1}, rateLimitConfig{})
+	h := rl.handle("", "192.0.2.1")
+	if h != nil {
+		t.Fatal("handle created for request without applicable limits")
+	}
+	if err := h.take(1, 100); err != nil {
+		t.Fatalf("nil handle take: %v", err)
+	}
+}
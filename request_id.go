@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+// 请求ID的请求头和响应头
+const requestIDHeader = "X-Request-ID"
+
+// 客户端传入的请求ID的最大长度
+const maxRequestIDLength = 64
+
+type requestIDKey struct{}
+
+// 将请求ID附加到请求上下文
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// 从请求上下文获取请求ID
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// 为请求分配请求ID并写入响应头
+// 使用客户端在 X-Request-ID 中传入的ID，没有传入或格式无效时生成新的ID
+func assignRequestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !isValidRequestID(id) {
+		id = uuid.NewV4().String()
+	}
+	c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+	c.Header(requestIDHeader, id)
+}
+
+// 请求ID只能包含字母、数字和 -_.:，长度不超过 maxRequestIDLength
+// 请求ID是火山引擎 reqid 的前缀，并出现在日志和响应头中
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// 为一次上游调用生成火山引擎 reqid
+// 每次上游调用（重试、故障转移和长文本的各个片段）都使用 请求ID-8位随机字符 形式的新ID，
+// 客户端重复使用同一请求ID时 reqid 也不会重复；上下文中没有请求ID时生成新的ID
+func newVolcanoReqID(ctx context.Context) string {
+	suffix := uuid.NewV4().String()
+	id := requestIDFromContext(ctx)
+	if id == "" {
+		return suffix
+	}
+	return id + "-" + suffix[:8]
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIsValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id: "3f2a9c4e-6b1d-4f0e-9a55-2c7d8e1b0f42", want: true},
+		{id: "job_42.retry:1", want: true},
+		{id: strings.Repeat("a", maxRequestIDLength), want: true},
+		{id: strings.Repeat("a", maxRequestIDLength+1)},
+		{id: ""},
+		{id: "has space"},
+		{id: "line\nbreak"},
+		{id: "slash/id"},
+		{id: "quote\"id"},
+		{id: "请求"},
+	}
+
+	for _, tt := range tests {
+		if got := isValidRequestID(tt.id); got != tt.want {
+			t.Errorf("isValidRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestAssignRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "client request ID", header: "client-42", keep: true},
+		{name: "missing request ID", header: ""},
+		{name: "invalid request ID", header: "bad id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/audio/speech", nil)
+			if tt.header != "" {
+				c.Request.Header.Set(requestIDHeader, tt.header)
+			}
+			assignRequestID(c)
+
+			id := requestIDFromContext(c.Request.Context())
+			if w.Header().Get(requestIDHeader) != id || !isValidRequestID(id) {
+				t.Fatalf("response header = %q, context ID = %q", w.Header().Get(requestIDHeader), id)
+			}
+			if (id == tt.header) != tt.keep {
+				t.Errorf("request ID = %q, keep client ID %v", id, tt.keep)
+			}
+		})
+	}
+}
+
+func TestNewVolcanoReqID(t *testing.T) {
+	// 每次上游调用都得到新的 reqid，包括客户端重复使用同一请求ID的不同请求和并发的上游调用
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, ctx := range []context.Context{
+		withRequestID(context.Background(), "req-1"),
+		withRequestID(context.Background(), "req-1"),
+	} {
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				id := newVolcanoReqID(ctx)
+				if !strings.HasPrefix(id, "req-1-") || len(id) != len("req-1-")+8 {
+					t.Errorf("newVolcanoReqID() = %q, want req-1- followed by 8 characters", id)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if seen[id] {
+					t.Errorf("duplicate reqid %q", id)
+				}
+				seen[id] = true
+			}()
+		}
+	}
+	wg.Wait()
+
+	// 没有请求ID时每次生成新的ID
+	if a, b := newVolcanoReqID(context.Background()), newVolcanoReqID(context.Background()); a == b || a == "" {
+		t.Errorf("newVolcanoReqID() without request ID = %q, %q", a, b)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VolcanoError 火山引擎返回的错误，包含错误码
+type VolcanoError struct {
+	Code    int
+	Message string
+	Event   int32 // V3 协议的事件编号，v1 协议为0
+}
+
+func (e *VolcanoError) Error() string {
+	if e.Event != 0 {
+		return fmt.Sprintf("server error (event: %d, code: %d): %s", e.Event, e.Code, e.Message)
+	}
+	return fmt.Sprintf("server error (code: %d): %s", e.Code, e.Message)
+}
+
+// 可以重试的 v1 协议错误码：并发超限、服务繁忙、服务中断、处理超时和后端异常
+var retryableVolcanoCodes = map[int]bool{
+	3003: true,
+	3005: true,
+	3006: true,
+	3030: true,
+	3031: true,
+	3032: true,
+	3040: true,
+}
+
+// Retryable 错误是否为服务端的临时错误
+// V3 协议以 55 开头的错误码表示服务端错误
+func (e *VolcanoError) Retryable() bool {
+	return retryableVolcanoCodes[e.Code] || e.Code/1000000 == 55
+}
+
+// 错误是否可以重试：建立连接失败或火山引擎返回临时错误
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrWebSocketDialFailed) {
+		return true
+	}
+	var volcErr *VolcanoError
+	return errors.As(err, &volcErr) && volcErr.Retryable()
+}
+
+// 全局重试预算中的令牌上限，也是启动时的初始令牌数
+const retryBudgetMaxTokens = 20
+
+// 全局重试预算
+// 每个请求存入 ratio 个令牌，每次重试消耗一个令牌，重试次数因此不超过请求数的一定比例，
+// 上游故障时不会因重试成倍放大请求量
+type retryBudget struct {
+	ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+// 创建重试预算
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, tokens: retryBudgetMaxTokens}
+}
+
+// 记录一个请求
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetMaxTokens)
+}
+
+// 申请一次重试，预算不足时返回false
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 剩余令牌数
+func (b *retryBudget) available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
+
+// 重试策略
+type retryPolicy struct {
+	maxAttempts int           // 每个请求的最大尝试次数，包括第一次
+	baseDelay   time.Duration // 第一次重试的退避时间上限
+	maxDelay    time.Duration // 退避时间上限
+	budget      *retryBudget
+
+	retries   atomic.Int64 // 重试次数
+	recovered atomic.Int64 // 重试后成功的请求数
+	exhausted atomic.Int64 // 因尝试次数或全局预算用尽而放弃的合成数
+}
+
+// 全局重试策略，在 init 中根据配置创建
+var upstreamRetry *retryPolicy
+
+// 第 attempt 次重试前的退避时间：指数增长并加入完全随机抖动，避免大量请求同时重试
+func (rp *retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := rp.baseDelay << (attempt - 1)
+	if ceiling > rp.maxDelay || ceiling <= 0 {
+		ceiling = rp.maxDelay
+	}
+	return rand.N(ceiling + 1)
+}
+
+// 一次合成的上游调用计数
+// 第一次调用之后的每次调用（重试、换用账号、故障转移和重建连接）都要申请，
+// 总数不超过 maxAttempts，并且每次都消耗一个全局重试预算令牌
+type upstreamAttempts struct {
+	policy *retryPolicy
+
+	mu        sync.Mutex
+	used      int
+	exhausted bool
+}
+
+type upstreamAttemptsKey struct{}
+
+// 开始一次合成的上游调用计数，第一次调用不需要申请
+func (rp *retryPolicy) withAttempts(ctx context.Context) context.Context {
+	rp.budget.deposit()
+	return context.WithValue(ctx, upstreamAttemptsKey{}, &upstreamAttempts{policy: rp, used: 1})
+}
+
+// 申请一次额外的上游调用，超过最大尝试次数或全局重试预算不足时返回false
+// 上下文中没有调用计数时不允许额外的调用
+func takeUpstreamAttempt(ctx context.Context) bool {
+	a, ok := ctx.Value(upstreamAttemptsKey{}).(*upstreamAttempts)
+	if !ok {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.exhausted {
+		return false
+	}
+	if a.used >= a.policy.maxAttempts || !a.policy.budget.withdraw() {
+		// 每次合成只记录一次放弃
+		a.exhausted = true
+		a.policy.exhausted.Add(1)
+		return false
+	}
+	a.used++
+	return true
+}
+
+// 执行一次上游合成，临时失败时按退避策略重试
+// 只有尚未向 onAudio 输出任何音频时才会重试，避免客户端收到重复的音频
+// 重试与换用账号、故障转移共用同一个调用计数，每次合成的上游调用总数不超过 maxAttempts
+func (rp *retryPolicy) do(ctx context.Context, synthesize func(ctx context.Context, onAudio audioHandler) error, onAudio audioHandler) error {
+	ctx = rp.withAttempts(ctx)
+
+	for attempt := 1; ; attempt++ {
+		received := false
+		err := synthesize(ctx, func(audio []byte) error {
+			received = true
+			return onAudio(audio)
+		})
+		if err == nil {
+			if attempt > 1 {
+				rp.recovered.Add(1)
+			}
+			return nil
+		}
+		if received || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if !takeUpstreamAttempt(ctx) {
+			return err
+		}
+
+		delay := rp.backoff(attempt)
+		slog.WarnContext(ctx, "Upstream synthesis failed, retrying",
+			"attempt", attempt, "max_attempts", rp.maxAttempts, "delay", delay, "error", err)
+		rp.retries.Add(1)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ErrRequestCancelled, context.Cause(ctx))
+		}
+	}
+}
+
+// 重试统计信息
+func (rp *retryPolicy) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"max_attempts":  rp.maxAttempts,
+		"retries":       rp.retries.Load(),
+		"recovered":     rp.recovered.Load(),
+		"exhausted":     rp.exhausted.Load(),
+		"budget_tokens": rp.budget.available(),
+	}
+}
+
+// 执行一次上游合成，临时失败时重试
+func synthesizeWithRetry(ctx context.Context, p synthesisParams, onAudio audioHandler) error {
+	return upstreamRetry.do(ctx, func(ctx context.Context, onAudio audioHandler) error {
+		return upstream.synthesize(ctx, p, onAudio)
+	}, onAudio)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	rp := &retryPolicy{baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{attempt: 1, ceiling: 100 * time.Millisecond},
+		{attempt: 2, ceiling: 200 * time.Millisecond},
+		{attempt: 3, ceiling: 400 * time.Millisecond},
+		{attempt: 5, ceiling: time.Second},
+		{attempt: 70, ceiling: time.Second}, // 移位溢出时使用上限
+	}
+
+	for _, tt := range tests {
+		// 完全随机抖动，每次结果都在 [0, ceiling] 之间
+		for i := 0; i < 100; i++ {
+			if d := rp.backoff(tt.attempt); d < 0 || d > tt.ceiling {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", tt.attempt, d, tt.ceiling)
+			}
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "dial failure", err: fmt.Errorf("%w: connection refused", ErrWebSocketDialFailed), want: true},
+		{name: "v1 concurrency limit", err: &VolcanoError{Code: 3003}, want: true},
+		{name: "v1 server busy", err: fmt.Errorf("wrapped: %w", &VolcanoError{Code: 3030}), want: true},
+		{name: "v3 server error", err: &VolcanoError{Code: 55000000, Event: v3EventSessionFailed}, want: true},
+		{name: "v1 invalid text", err: &VolcanoError{Code: 3011}},
+		{name: "v3 client error", err: &VolcanoError{Code: 45000001, Event: v3EventSessionFailed}},
+		{name: "other error", err: errors.New("boom")},
+	}
+
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: isRetryable(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5)
+	for i := 0; i < retryBudgetMaxTokens; i++ {
+		if !b.withdraw() {
+			t.Fatalf("withdraw %d failed with tokens left", i)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("withdraw succeeded with an empty budget")
+	}
+
+	// 每个请求存入 ratio 个令牌，不超过上限
+	b.deposit()
+	if b.withdraw() {
+		t.Error("withdraw succeeded with half a token")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Error("withdraw failed after two deposits")
+	}
+	for i := 0; i < 100; i++ {
+		b.deposit()
+	}
+	if got := b.available(); got != retryBudgetMaxTokens {
+		t.Errorf("available = %v, want %v", got, retryBudgetMaxTokens)
+	}
+}
+
+// 按顺序返回预设结果的上游合成，audio 为 true 的尝试在失败前先输出音频
+type scriptedAttempt struct {
+	audio bool
+	err   error
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	errBusy := &VolcanoError{Code: 3030, Message: "server busy"}
+	errInvalid := &VolcanoError{Code: 3011, Message: "invalid text"}
+
+	tests := []struct {
+		name          string
+		maxAttempts   int
+		budgetTokens  float64
+		attempts      []scriptedAttempt
+		wantErr       error
+		wantCalls     int
+		wantRecovered int64
+		wantExhausted int64
+	}{
+		{
+			name:        "success on first attempt",
+			maxAttempts: 3, budgetTokens: 10,
+			attempts:  []scriptedAttempt{{}},
+			wantCalls: 1,
+		},
+		{
+			name:        "transient failure is retried",
+			maxAttempts: 3, budgetTokens: 10,
+			attempts:      []scriptedAttempt{{err: errBusy}, {err: errBusy}, {}},
+			wantCalls:     3,
+			wantRecovered: 1,
+		},
+		{
+			name:        "permanent failure is not retried",
+			maxAttempts: 3, budgetTokens: 10,
+			attempts:  []scriptedAttempt{{err: errInvalid}, {}},
+			wantErr:   errInvalid,
+			wantCalls: 1,
+		},
+		{
+			name:        "never retried after audio was sent",
+			maxAttempts: 3, budgetTokens: 10,
+			attempts:  []scriptedAttempt{{audio: true, err: errBusy}, {}},
+			wantErr:   errBusy,
+			wantCalls: 1,
+		},
+		{
+			name:        "attempts exhausted",
+			maxAttempts: 2, budgetTokens: 10,
+			attempts:      []scriptedAttempt{{err: errBusy}, {err: errBusy}, {}},
+			wantErr:       errBusy,
+			wantCalls:     2,
+			wantExhausted: 1,
+		},
+		{
+			name:        "budget exhausted",
+			maxAttempts: 3, budgetTokens: 0,
+			attempts:      []scriptedAttempt{{err: errBusy}, {}},
+			wantErr:       errBusy,
+			wantCalls:     1,
+			wantExhausted: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := &retryPolicy{
+				maxAttempts: tt.maxAttempts,
+				baseDelay:   time.Millisecond,
+				maxDelay:    time.Millisecond,
+				budget:      &retryBudget{tokens: tt.budgetTokens},
+			}
+			calls := 0
+			var audio []string
+			err := rp.do(context.Background(), func(_ context.Context, onAudio audioHandler) error {
+				a := tt.attempts[calls]
+				calls++
+				if a.audio || a.err == nil {
+					if err := onAudio([]byte(fmt.Sprintf("audio %d", calls))); err != nil {
+						return err
+					}
+				}
+				return a.err
+			}, func(chunk []byte) error {
+				audio = append(audio, string(chunk))
+				return nil
+			})
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if len(audio) > 1 {
+				t.Errorf("client received audio from %d attempts: %q", len(audio), audio)
+			}
+			if got := rp.recovered.Load(); got != tt.wantRecovered {
+				t.Errorf("recovered = %d, want %d", got, tt.wantRecovered)
+			}
+			if got := rp.exhausted.Load(); got != tt.wantExhausted {
+				t.Errorf("exhausted = %d, want %d", got, tt.wantExhausted)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyCancelledDuringBackoff(t *testing.T) {
+	rp := &retryPolicy{maxAttempts: 3, baseDelay: time.Hour, maxDelay: time.Hour, budget: newRetryBudget(1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := rp.do(ctx, func(_ context.Context, onAudio audioHandler) error {
+		calls++
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return &VolcanoError{Code: 3030}
+	}, func([]byte) error { return nil })
+
+	if !errors.Is(err, ErrRequestCancelled) {
+		t.Errorf("err = %v, want ErrRequestCancelled", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestTakeUpstreamAttempt(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxAttempts   int
+		budgetTokens  float64
+		wantTaken     int
+		wantExhausted int64
+	}{
+		{name: "capped by max attempts", maxAttempts: 3, budgetTokens: 10, wantTaken: 2, wantExhausted: 1},
+		{name: "capped by the retry budget", maxAttempts: 5, budgetTokens: 1, wantTaken: 1, wantExhausted: 1},
+		{name: "single attempt", maxAttempts: 1, budgetTokens: 10, wantTaken: 0, wantExhausted: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := &retryPolicy{maxAttempts: tt.maxAttempts, budget: &retryBudget{tokens: tt.budgetTokens}}
+			ctx := rp.withAttempts(context.Background())
+			taken := 0
+			for i := 0; i < 10; i++ {
+				if takeUpstreamAttempt(ctx) {
+					taken++
+				}
+			}
+			if taken != tt.wantTaken {
+				t.Errorf("taken = %d, want %d", taken, tt.wantTaken)
+			}
+			// 每次合成只记录一次放弃
+			if got := rp.exhausted.Load(); got != tt.wantExhausted {
+				t.Errorf("exhausted = %d, want %d", got, tt.wantExhausted)
+			}
+		})
+	}
+
+	if takeUpstreamAttempt(context.Background()) {
+		t.Error("takeUpstreamAttempt() without an attempts tracker = true, want false")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// 输出已结束，后台合成的片段不再需要
+var errSegmentAborted = errors.New("segment synthesis aborted")
+
+// 一个文本片段的合成结果
+// 尚未轮到输出的片段先缓存音频，轮到时再依次写出
+type segmentAudio struct {
+	mu     sync.Mutex
+	chunks [][]byte
+	done   bool
+	err    error
+	ready  chan struct{} // 有新音频或合成结束时通知
+	stop   <-chan struct{}
+}
+
+// 创建片段合成结果
+func newSegmentAudio(stop <-chan struct{}) *segmentAudio {
+	return &segmentAudio{
+		ready: make(chan struct{}, 1),
+		stop:  stop,
+	}
+}
+
+// 缓存一帧音频，输出已结束时返回错误以中止上游合成
+func (s *segmentAudio) append(audio []byte) error {
+	select {
+	case <-s.stop:
+		return errSegmentAborted
+	default:
+	}
+
+	s.mu.Lock()
+	s.chunks = append(s.chunks, append([]byte(nil), audio...))
+	s.mu.Unlock()
+	s.notify()
+	return nil
+}
+
+// 标记片段合成结束
+func (s *segmentAudio) finish(err error) {
+	s.mu.Lock()
+	s.done = true
+	s.err = err
+	s.mu.Unlock()
+	s.notify()
+}
+
+// 通知输出方，已有未处理的通知时不再重复
+func (s *segmentAudio) notify() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// 取出已缓存的音频和合成状态
+func (s *segmentAudio) take() ([][]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chunks := s.chunks
+	s.chunks = nil
+	return chunks, s.done, s.err
+}
+
+// 合成任意长度的文本
+// 超过 MAX_SEGMENT_LENGTH 的文本按句切分，在并发调用限制内并行合成各片段，音频按原文顺序输出
+func synthesizeText(ctx context.Context, p synthesisParams, onAudio audioHandler) error {
+	segments := splitText(p.Text, appConfig.MaxSegmentLength)
+	if len(segments) <= 1 {
+		return streamSynthesize(ctx, p, onAudio)
+	}
+
+	// 第一个并发名额与普通请求一样，名额用尽时排队等待
+	release, err := callQueue.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	// 各片段的wav音频无法直接拼接，以pcm合成并只输出一次WAV文件头
+	wavHeader := false
+	if p.Encoding == "wav" {
+		p.Encoding = "pcm"
+		wavHeader = true
+	}
+
+	stop := make(chan struct{})
+	results := make([]*segmentAudio, len(segments))
+	jobs := make(chan int, len(segments))
+	for i := range segments {
+		results[i] = newSegmentAudio(stop)
+		jobs <- i
+	}
+	close(jobs)
+
+	// 每个工作协程占用一个并发名额，按顺序领取片段，保证正在输出的片段总在合成中或已完成
+	var wg sync.WaitGroup
+	worker := func(release func()) {
+		defer wg.Done()
+		defer release()
+		for i := range jobs {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			sp := p
+			sp.Text = segments[i]
+			err := synthesizeWithRetry(ctx, sp, results[i].append)
+			results[i].finish(err)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	workers := min(appConfig.SegmentParallelism, len(segments))
+	wg.Add(1)
+	go worker(release)
+	// 其余名额只在排队请求无法使用时占用，不与其他请求争抢
+	for i := 1; i < workers; i++ {
+		release, ok := callQueue.tryAcquire(ctx)
+		if !ok {
+			break
+		}
+		wg.Add(1)
+		go worker(release)
+	}
+
+	err = emitSegments(ctx, results, wavHeader, onAudio)
+	close(stop)
+	wg.Wait()
+	if errors.Is(err, ErrRequestCancelled) {
+		cancelledCalls.Add(1)
+	}
+	return err
+}
+
+// 按顺序输出各片段的音频，遇到第一个失败的片段时返回其错误
+func emitSegments(ctx context.Context, results []*segmentAudio, wavHeader bool, onAudio audioHandler) error {
+	for _, seg := range results {
+		for {
+			chunks, done, err := seg.take()
+			for _, audio := range chunks {
+				// 收到第一帧音频时才输出WAV文件头，之前的错误仍可作为普通错误返回
+				if wavHeader {
+					wavHeader = false
+					if err := onAudio(wavStreamHeader(audioSampleRate)); err != nil {
+						return fmt.Errorf("%w: %v", ErrAudioWriteFailed, err)
+					}
+				}
+				if err := onAudio(audio); err != nil {
+					return fmt.Errorf("%w: %v", ErrAudioWriteFailed, err)
+				}
+			}
+			if done {
+				if err != nil {
+					return err
+				}
+				break
+			}
+			select {
+			case <-seg.ready:
+			case <-ctx.Done():
+				return fmt.Errorf("%w: %w", ErrRequestCancelled, context.Cause(ctx))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SSE事件类型，与OpenAI流式语音接口保持一致
+const (
+	sseEventAudioDelta = "speech.audio.delta"
+	sseEventAudioDone  = "speech.audio.done"
+	sseEventError      = "error"
+)
+
+// 音频片段事件
+type speechAudioDeltaEvent struct {
+	Type  string `json:"type"`
+	Audio string `json:"audio"`
+}
+
+// 合成用量
+type speechUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// 合成完成事件
+type speechAudioDoneEvent struct {
+	Type  string      `json:"type"`
+	Usage speechUsage `json:"usage"`
+}
+
+// 错误事件
+type speechErrorEvent struct {
+	Type  string        `json:"type"`
+	Error ErrorResponse `json:"error"`
+}
+
+// 写出一个SSE事件并刷新
+func writeSSEEvent(c *gin.Context, event any) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// 以Server-Sent Events方式输出合成音频的响应
+// 每帧音频以base64编码放入 speech.audio.delta 事件，结束时发送带用量的 speech.audio.done 事件
+type speechEventStream struct {
+	c       *gin.Context
+	ctx     context.Context
+	params  synthesisParams
+	started bool
+}
+
+// 写出响应头，发送第一个事件时才写出，以便在此之前仍可返回JSON错误
+func (s *speechEventStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.c.Header("Content-Type", "text/event-stream")
+	s.c.Header("Cache-Control", "no-cache")
+	s.c.Header("Connection", "keep-alive")
+	s.c.Header("X-Accel-Buffering", "no")
+	s.c.Status(http.StatusOK)
+}
+
+func (s *speechEventStream) writeAudio(audio []byte) error {
+	s.start()
+	return writeSSEEvent(s.c, speechAudioDeltaEvent{
+		Type:  sseEventAudioDelta,
+		Audio: base64.StdEncoding.EncodeToString(audio),
+	})
+}
+
+func (s *speechEventStream) finish(err error) {
+	c := s.c
+	if err != nil {
+		// 已开始发送事件，通过错误事件通知客户端
+		if s.started {
+			statusCode, errorType := synthesisErrorStatus(err)
+			setErrorType(c, errorType)
+			writeSSEEvent(c, speechErrorEvent{
+				Type: sseEventError,
+				Error: ErrorResponse{
+					Error:     errorType,
+					Code:      statusCode,
+					Message:   err.Error(),
+					RequestID: requestIDFromContext(c.Request.Context()),
+				},
+			})
+			slog.ErrorContext(s.ctx, "Error streaming audio events", "error", err)
+			return
+		}
+
+		writeSynthesisError(c, err)
+		return
+	}
+
+	// 按字符数统计用量，与火山引擎计费方式一致
+	inputTokens := utf8.RuneCountInString(s.params.Text)
+	s.start()
+	writeSSEEvent(c, speechAudioDoneEvent{
+		Type: sseEventAudioDone,
+		Usage: speechUsage{
+			InputTokens: inputTokens,
+			TotalTokens: inputTokens,
+		},
+	})
+}
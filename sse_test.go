@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPrepareSynthesisStreamFormat(t *testing.T) {
+	tenant := &tenantConfig{Name: defaultTenantName, DefaultVoice: "BV001_streaming"}
+	if err := tenant.init(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		streamFormat string
+		wantErr      error
+	}{
+		{streamFormat: ""},
+		{streamFormat: streamFormatAudio},
+		{streamFormat: streamFormatSSE},
+		{streamFormat: "websocket", wantErr: ErrInvalidRequest},
+		{streamFormat: "SSE", wantErr: ErrInvalidRequest},
+	}
+
+	for _, tt := range tests {
+		req := OpenAITTSRequest{Model: "tts-1", Input: "你好", Voice: "alloy", StreamFormat: tt.streamFormat}
+		if _, _, err := prepareSynthesis(tenant, req); !errors.Is(err, tt.wantErr) {
+			t.Errorf("prepareSynthesis(stream_format %q) err = %v, want %v", tt.streamFormat, err, tt.wantErr)
+		}
+	}
+}
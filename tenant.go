@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// 默认租户名称，未单独配置的客户端密钥属于默认租户
+const defaultTenantName = "default"
+
+// 租户配置，一个租户对应一个内部产品
+type tenantConfig struct {
+	// Name 租户名称，即配置文件中的键
+	Name string `json:"-"`
+	// APIKeys 属于该租户的客户端密钥
+	APIKeys []string `json:"api_keys"`
+	// Accounts 可以使用的火山引擎账号名称，为空表示可以使用全部账号
+	Accounts []string `json:"accounts,omitempty"`
+	// DefaultVoice 请求语音没有映射时使用的火山引擎语音，默认 BYTEDANCE_TTS_VOICE_TYPE
+	DefaultVoice string `json:"default_voice,omitempty"`
+	// AllowedVoices 允许使用的火山引擎语音，在语音目录白名单的基础上进一步限制，为空表示不限制
+	AllowedVoices []string `json:"allowed_voices,omitempty"`
+	// MaxTextLength 单个请求的最大文本字符数，默认且不超过 MAX_TEXT_LENGTH
+	MaxTextLength int `json:"max_text_length,omitempty"`
+	// CallPolicy 租户所有密钥共用的调度策略，调度策略文件中单独配置的密钥除外
+	CallPolicy *callPolicy `json:"call_policy,omitempty"`
+
+	accounts      map[string]struct{}
+	allowedVoices map[string]struct{}
+	// 租户的调用可能使用的集群（v1 协议）或资源ID（V3 协议），排序后以逗号连接，是缓存键的一部分
+	upstreamResources string
+}
+
+// Tenants 租户配置文件
+type Tenants struct {
+	// Tenants 租户名称到租户配置的映射，名为 default 的租户用于未单独配置的密钥
+	Tenants map[string]*tenantConfig `json:"tenants"`
+
+	defaultTenant *tenantConfig
+}
+
+// 租户配置，默认只有使用全局配置的默认租户
+var tenants = &Tenants{defaultTenant: &tenantConfig{Name: defaultTenantName}}
+
+// LoadTenants 从JSON配置文件加载租户，路径为空时只有默认租户
+// 账号名称按 accounts 验证，语音按语音目录验证；租户使用的集群或资源ID按 accounts 和上游地址 targets 计算
+func LoadTenants(path string, accounts []volcanoAccount, targets []upstreamTarget) (*Tenants, error) {
+	tc := &Tenants{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tenant file: %w", err)
+		}
+		if err := json.Unmarshal(data, tc); err != nil {
+			return nil, fmt.Errorf("failed to parse tenant file: %w", err)
+		}
+	}
+
+	tc.defaultTenant = tc.Tenants[defaultTenantName]
+	if tc.defaultTenant == nil {
+		tc.defaultTenant = &tenantConfig{}
+	}
+	all := map[string]*tenantConfig{defaultTenantName: tc.defaultTenant}
+	for name, t := range tc.Tenants {
+		if t == nil {
+			return nil, fmt.Errorf("tenant %s: configuration is empty", name)
+		}
+		all[name] = t
+	}
+
+	accountNames := make(map[string]struct{}, len(accounts))
+	for _, a := range accounts {
+		accountNames[a.Name] = struct{}{}
+	}
+
+	byKey := make(map[string]*tenantConfig)
+	for name, t := range all {
+		t.Name = name
+		if err := t.init(accountNames); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
+		t.resolveUpstreamResources(accounts, targets)
+		for _, key := range t.APIKeys {
+			if !isValidAPIKey(key) || key == "" {
+				return nil, fmt.Errorf("tenant %s: invalid API key", name)
+			}
+			if other, ok := byKey[key]; ok {
+				return nil, fmt.Errorf("tenant %s: API key is already used by tenant %s", name, other.Name)
+			}
+			byKey[key] = t
+		}
+		registerSecrets("tenant "+name, t.APIKeys...)
+	}
+
+	return tc, nil
+}
+
+// 补全默认值并验证租户配置
+func (t *tenantConfig) init(accountNames map[string]struct{}) error {
+	if t.DefaultVoice == "" {
+		t.DefaultVoice = appConfig.ByteDanceVoiceType
+	}
+	if t.MaxTextLength == 0 {
+		t.MaxTextLength = appConfig.MaxTextLength
+	}
+	if t.MaxTextLength < 0 || t.MaxTextLength > appConfig.MaxTextLength {
+		return fmt.Errorf("max_text_length must be between 1 and MAX_TEXT_LENGTH")
+	}
+
+	t.accounts = make(map[string]struct{}, len(t.Accounts))
+	for _, name := range t.Accounts {
+		if _, ok := accountNames[name]; !ok {
+			return fmt.Errorf("unknown account %q", name)
+		}
+		t.accounts[name] = struct{}{}
+	}
+
+	t.allowedVoices = make(map[string]struct{}, len(t.AllowedVoices))
+	for _, voiceType := range t.AllowedVoices {
+		t.allowedVoices[voiceType] = struct{}{}
+	}
+	if !t.voiceAllowed(t.DefaultVoice) || !voiceCatalog.isAllowed(t.DefaultVoice) {
+		return fmt.Errorf("default voice %q is not allowed", t.DefaultVoice)
+	}
+
+	if t.CallPolicy != nil {
+		if t.CallPolicy.Name == "" {
+			t.CallPolicy.Name = t.Name
+		}
+		if err := t.CallPolicy.normalize(); err != nil {
+			return fmt.Errorf("invalid call policy: %w", err)
+		}
+	}
+	return nil
+}
+
+// 计算租户的调用可能使用的集群或资源ID：租户可以使用的每个账号在每个上游地址上使用的值
+// 查找缓存时还没有选择账号和上游地址，缓存键包含这一组值，使用相同集群或资源ID的租户才共用缓存
+func (t *tenantConfig) resolveUpstreamResources(accounts []volcanoAccount, targets []upstreamTarget) {
+	resources := make(map[string]struct{})
+	for _, a := range accounts {
+		if !t.accountAllowed(a.Name) {
+			continue
+		}
+		for _, target := range targets {
+			a := a.forTarget(target)
+			if appConfig.ByteDanceProtocol == protocolV3 {
+				resources[a.ResourceID] = struct{}{}
+			} else {
+				resources[a.Cluster] = struct{}{}
+			}
+		}
+	}
+	t.upstreamResources = strings.Join(slices.Sorted(maps.Keys(resources)), ",")
+}
+
+// 查找客户端密钥所属的租户，密钥不属于任何租户时返回nil
+// 逐个比较全部密钥且不提前返回，比较时间与密钥是否匹配及匹配位置无关
+func (tc *Tenants) match(apiKey string) *tenantConfig {
+	var found *tenantConfig
+	for _, t := range tc.Tenants {
+		for _, key := range t.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(apiKey), []byte(key)) == 1 && found == nil {
+				found = t
+			}
+		}
+	}
+	return found
+}
+
+// 按名称查找租户，名称为空或租户不存在时返回默认租户
+func (tc *Tenants) byName(name string) *tenantConfig {
+	if t, ok := tc.Tenants[name]; ok {
+		return t
+	}
+	return tc.defaultTenant
+}
+
+// 是否配置了租户密钥
+func (tc *Tenants) hasKeys() bool {
+	for _, t := range tc.Tenants {
+		if len(t.APIKeys) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 租户是否可以使用该账号
+func (t *tenantConfig) accountAllowed(name string) bool {
+	if len(t.accounts) == 0 {
+		return true
+	}
+	_, ok := t.accounts[name]
+	return ok
+}
+
+// 租户是否可以使用该语音
+func (t *tenantConfig) voiceAllowed(voiceType string) bool {
+	if len(t.allowedVoices) == 0 {
+		return true
+	}
+	_, ok := t.allowedVoices[voiceType]
+	return ok
+}
+
+// 将请求中的 voice 解析为火山引擎 voice_type，没有任何映射时回退到租户的默认语音，并验证租户是否可以使用
+func (t *tenantConfig) resolveVoice(voice string) (string, error) {
+	voiceType, err := voiceCatalog.Resolve(voice, t.DefaultVoice)
+	if err != nil {
+		return "", err
+	}
+	if !t.voiceAllowed(voiceType) {
+		return "", fmt.Errorf("%w: %s", ErrVoiceNotAllowed, voiceType)
+	}
+	return voiceType, nil
+}
+
+type tenantKey struct{}
+
+// 将租户附加到请求上下文
+func withTenant(ctx context.Context, t *tenantConfig) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// 从请求上下文获取租户，未设置时返回默认租户
+func tenantFromContext(ctx context.Context) *tenantConfig {
+	if t, ok := ctx.Value(tenantKey{}).(*tenantConfig); ok {
+		return t
+	}
+	return tenants.defaultTenant
+}
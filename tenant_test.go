@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 测试用的火山引擎账号
+var testTenantAccounts = []volcanoAccount{
+	{Name: "primary", Cluster: "cluster_a", ResourceID: "resource_a"},
+	{Name: "backup", Cluster: "cluster_b", ResourceID: "resource_b"},
+}
+
+// 测试用的上游地址，每个参数是一个地址的 # 后缀，为空表示使用账号的集群或资源ID
+func testTenantTargets(fragments ...string) []upstreamTarget {
+	var targets []upstreamTarget
+	for i, fragment := range fragments {
+		u, _ := url.Parse(fmt.Sprintf("wss://endpoint-%d.example.com/api/v1/tts/ws_binary", i))
+		targets = append(targets, upstreamTarget{URL: u, Cluster: fragment, Resource: fragment})
+	}
+	return targets
+}
+
+// 写入测试用的租户配置文件并加载
+func loadTestTenants(t *testing.T, content string) (*Tenants, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadTenants(path, testTenantAccounts, testTenantTargets(""))
+}
+
+func TestLoadTenants(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name: "valid tenants",
+			content: `{"tenants": {
+				"default": {"default_voice": "BV001_streaming"},
+				"search": {"api_keys": ["search-key"], "accounts": ["backup"], "allowed_voices": ["BV002_streaming"],
+					"default_voice": "BV002_streaming", "max_text_length": 100}}}`,
+		},
+		{name: "unknown account", content: `{"tenants": {"search": {"api_keys": ["search-key"], "accounts": ["missing"]}}}`, wantErr: true},
+		{name: "default voice not allowed", content: `{"tenants": {"search": {"default_voice": "BV001_streaming", "allowed_voices": ["BV002_streaming"]}}}`, wantErr: true},
+		{name: "max text length above global limit", content: `{"tenants": {"search": {"max_text_length": 1000000}}}`, wantErr: true},
+		{name: "negative max text length", content: `{"tenants": {"search": {"max_text_length": -1}}}`, wantErr: true},
+		{name: "invalid API key", content: `{"tenants": {"search": {"api_keys": ["bad(key)"]}}}`, wantErr: true},
+		{name: "empty API key", content: `{"tenants": {"search": {"api_keys": [""]}}}`, wantErr: true},
+		{name: "API key shared by two tenants", content: `{"tenants": {"a": {"api_keys": ["shared"]}, "b": {"api_keys": ["shared"]}}}`, wantErr: true},
+		{name: "empty tenant", content: `{"tenants": {"search": null}}`, wantErr: true},
+		{name: "invalid JSON", content: `{"tenants":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestTenants(t, tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadTenants() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTenantsLookup(t *testing.T) {
+	tc, err := loadTestTenants(t, `{"tenants": {
+		"default": {"default_voice": "BV001_streaming"},
+		"search": {"api_keys": ["search-key"], "accounts": ["backup"], "default_voice": "BV002_streaming", "max_text_length": 100}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		tenant        *tenantConfig
+		wantTenant    string
+		wantVoice     string
+		wantMaxLength int
+	}{
+		{name: "match tenant key", tenant: tc.match("search-key"), wantTenant: "search", wantVoice: "BV002_streaming", wantMaxLength: 100},
+		{name: "tenant by name", tenant: tc.byName("search"), wantTenant: "search", wantVoice: "BV002_streaming", wantMaxLength: 100},
+		{name: "empty name", tenant: tc.byName(""), wantTenant: defaultTenantName, wantVoice: "BV001_streaming", wantMaxLength: appConfig.MaxTextLength},
+		{name: "unknown name", tenant: tc.byName("missing"), wantTenant: defaultTenantName, wantVoice: "BV001_streaming", wantMaxLength: appConfig.MaxTextLength},
+	}
+
+	for _, tt := range tests {
+		got := tt.tenant
+		if got == nil || got.Name != tt.wantTenant || got.DefaultVoice != tt.wantVoice || got.MaxTextLength != tt.wantMaxLength {
+			t.Errorf("%s: tenant = %+v, want %s (voice %s, max %d)", tt.name, got, tt.wantTenant, tt.wantVoice, tt.wantMaxLength)
+		}
+	}
+	for _, key := range []string{"other-key", "search-ke", ""} {
+		if got := tc.match(key); got != nil {
+			t.Errorf("match(%q) = %s, want nil", key, got.Name)
+		}
+	}
+	if !tc.hasKeys() {
+		t.Error("hasKeys() = false, want true")
+	}
+
+	search := tc.byName("search")
+	if search.accountAllowed("primary") || !search.accountAllowed("backup") {
+		t.Error("search tenant should only use the backup account")
+	}
+	if !tc.byName("").accountAllowed("primary") {
+		t.Error("default tenant should use every account")
+	}
+}
+
+func TestTenantResolveVoice(t *testing.T) {
+	tenant := &tenantConfig{Name: "search", DefaultVoice: "BV002_streaming", AllowedVoices: []string{"BV002_streaming", "BV003_streaming"}}
+	if err := tenant.init(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		voice   string
+		want    string
+		wantErr error
+	}{
+		{voice: "BV003_streaming", want: "BV003_streaming"},
+		{voice: "alloy", want: "BV002_streaming"}, // 没有映射时使用租户的默认语音
+		{voice: "BV001_streaming", wantErr: ErrVoiceNotAllowed},
+	}
+
+	for _, tt := range tests {
+		got, err := tenant.resolveVoice(tt.voice)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("resolveVoice(%q) err = %v, want %v", tt.voice, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("resolveVoice(%q) = %q, want %q", tt.voice, got, tt.want)
+		}
+	}
+}
+
+func TestTenantUpstreamResources(t *testing.T) {
+	content := `{"tenants": {"search": {"api_keys": ["search-key"], "accounts": ["backup"]}}}`
+	tests := []struct {
+		name        string
+		protocol    string
+		targets     []upstreamTarget
+		wantDefault string
+		wantSearch  string
+	}{
+		{name: "v1 account clusters", protocol: protocolV1, targets: testTenantTargets(""), wantDefault: "cluster_a,cluster_b", wantSearch: "cluster_b"},
+		{name: "v1 endpoint cluster", protocol: protocolV1, targets: testTenantTargets("", "cluster_c"), wantDefault: "cluster_a,cluster_b,cluster_c", wantSearch: "cluster_b,cluster_c"},
+		{name: "v3 resource IDs", protocol: protocolV3, targets: testTenantTargets(""), wantDefault: "resource_a,resource_b", wantSearch: "resource_b"},
+		{name: "every endpoint overrides", protocol: protocolV3, targets: testTenantTargets("resource_c", "resource_c"), wantDefault: "resource_c", wantSearch: "resource_c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := appConfig.ByteDanceProtocol
+			appConfig.ByteDanceProtocol = tt.protocol
+			defer func() { appConfig.ByteDanceProtocol = previous }()
+
+			path := filepath.Join(t.TempDir(), "tenants.json")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			tc, err := LoadTenants(path, testTenantAccounts, tt.targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tc.byName("").upstreamResources; got != tt.wantDefault {
+				t.Errorf("default tenant resources = %q, want %q", got, tt.wantDefault)
+			}
+			if got := tc.byName("search").upstreamResources; got != tt.wantSearch {
+				t.Errorf("search tenant resources = %q, want %q", got, tt.wantSearch)
+			}
+		})
+	}
+}
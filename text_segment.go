@@ -0,0 +1,173 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// 句末标点，中英文
+func isSentenceEnd(r rune) bool {
+	switch r {
+	case '。', '！', '？', '；', '…', '!', '?', ';', '\n':
+		return true
+	}
+	return false
+}
+
+// 句中停顿标点，句子过长时作为次选切分点
+func isClausePause(r rune) bool {
+	switch r {
+	case '，', '、', '：', ',', ':':
+		return true
+	}
+	return false
+}
+
+// 紧跟在句末标点之后、应归入同一句的闭合符号
+func isClosingMark(r rune) bool {
+	switch r {
+	case '”', '’', '」', '』', '）', '》', '"', '\'', ')', ']':
+		return true
+	}
+	return false
+}
+
+// 句子缓冲区，增量写入文本并在句子边界切分
+// 英文句点只有后面跟空白时才视为句末，避免切开小数和缩写
+type sentenceBuffer struct {
+	buf      []rune
+	maxRunes int // 单句最大字符数，超过时在停顿标点或直接切分
+}
+
+// 创建句子缓冲区
+func newSentenceBuffer(maxRunes int) *sentenceBuffer {
+	return &sentenceBuffer{maxRunes: maxRunes}
+}
+
+// Write 写入一段文本，返回已完整的句子
+func (b *sentenceBuffer) Write(text string) []string {
+	b.buf = append(b.buf, []rune(text)...)
+
+	var sentences []string
+	for {
+		end := b.sentenceEnd()
+		if end < 0 {
+			break
+		}
+		if sentence := strings.TrimSpace(string(b.buf[:end])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		b.buf = b.buf[end:]
+	}
+	return sentences
+}
+
+// Flush 返回缓冲区中剩余的文本
+func (b *sentenceBuffer) Flush() string {
+	sentence := strings.TrimSpace(string(b.buf))
+	b.buf = nil
+	return sentence
+}
+
+// 查找第一个完整句子的结束位置，没有完整句子时返回-1
+func (b *sentenceBuffer) sentenceEnd() int {
+	for i, r := range b.buf {
+		if i >= b.maxRunes {
+			return b.forcedEnd()
+		}
+
+		isEnd := isSentenceEnd(r)
+		if r == '.' {
+			// 需要看到下一个字符才能判断句点是否为句末
+			if i+1 >= len(b.buf) {
+				return -1
+			}
+			isEnd = unicode.IsSpace(b.buf[i+1])
+		}
+		if !isEnd {
+			continue
+		}
+
+		// 连续的句末标点和闭合符号归入同一句
+		end := i + 1
+		for end < len(b.buf) && (isSentenceEnd(b.buf[end]) || isClosingMark(b.buf[end])) {
+			end++
+		}
+		// 可能还有后续闭合符号未到达
+		if end == len(b.buf) && r != '\n' {
+			return -1
+		}
+		return end
+	}
+
+	return -1
+}
+
+// 句子超过最大长度时的切分位置：优先最后一个停顿标点，其次最后一个空白，否则直接切分
+func (b *sentenceBuffer) forcedEnd() int {
+	return forcedCut(b.buf[:b.maxRunes])
+}
+
+// 在不超过最大长度的文本中选择切分位置
+func forcedCut(runes []rune) int {
+	for i := len(runes) - 1; i > len(runes)/2; i-- {
+		if isClausePause(runes[i]) {
+			return i + 1
+		}
+	}
+	for i := len(runes) - 1; i > len(runes)/2; i-- {
+		if unicode.IsSpace(runes[i]) {
+			return i + 1
+		}
+	}
+	return len(runes)
+}
+
+// 将长文本切分为不超过 maxRunes 个字符的片段
+// 先按句切分，再将相邻的短句合并，尽量减少上游请求次数
+func splitText(text string, maxRunes int) []string {
+	b := newSentenceBuffer(maxRunes)
+	sentences := b.Write(text)
+	if rest := b.Flush(); rest != "" {
+		sentences = append(sentences, rest)
+	}
+
+	var segments []string
+	var current []rune
+	for _, sentence := range sentences {
+		runes := []rune(sentence)
+		// 句末连续的标点可能使句子略超长度，再按长度切分
+		for len(runes) > maxRunes {
+			cut := forcedCut(runes[:maxRunes])
+			if len(current) > 0 {
+				segments = append(segments, string(current))
+				current = nil
+			}
+			segments = append(segments, strings.TrimSpace(string(runes[:cut])))
+			runes = []rune(strings.TrimSpace(string(runes[cut:])))
+		}
+		if len(runes) == 0 {
+			continue
+		}
+
+		if len(current) > 0 && len(current)+1+len(runes) > maxRunes {
+			segments = append(segments, string(current))
+			current = nil
+		}
+		if len(current) > 0 && !isWideRune(current[len(current)-1]) && !isWideRune(runes[0]) {
+			// 切分句子时去掉了空白，英文句子之间补回空格
+			current = append(current, ' ')
+		}
+		current = append(current, runes...)
+	}
+	if len(current) > 0 {
+		segments = append(segments, string(current))
+	}
+	return segments
+}
+
+// 中日韩文字和全角标点，前后不需要空格分隔
+func isWideRune(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		(r >= 0x3000 && r <= 0x303F) || (r >= 0xFF00 && r <= 0xFFEF)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSentenceBuffer(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxRunes  int
+		writes    []string
+		want      []string // 各次写入返回的句子
+		wantFlush string
+	}{
+		{
+			name:      "chinese sentence",
+			maxRunes:  100,
+			writes:    []string{"你好。世界"},
+			want:      []string{"你好。"},
+			wantFlush: "世界",
+		},
+		{
+			name:      "waits for closing marks at end of buffer",
+			maxRunes:  100,
+			writes:    []string{"你好。"},
+			wantFlush: "你好。",
+		},
+		{
+			name:      "closing quote stays with sentence",
+			maxRunes:  100,
+			writes:    []string{"他说：“好。", "”然后"},
+			want:      []string{"他说：“好。”"},
+			wantFlush: "然后",
+		},
+		{
+			name:      "consecutive end marks",
+			maxRunes:  100,
+			writes:    []string{"真的吗？！好"},
+			want:      []string{"真的吗？！"},
+			wantFlush: "好",
+		},
+		{
+			name:      "decimal point is not sentence end",
+			maxRunes:  100,
+			writes:    []string{"Pi is 3.14 today. Next"},
+			want:      []string{"Pi is 3.14 today."},
+			wantFlush: "Next",
+		},
+		{
+			name:      "period waits for next character",
+			maxRunes:  100,
+			writes:    []string{"Hello.", " World"},
+			want:      []string{"Hello."},
+			wantFlush: "World",
+		},
+		{
+			name:     "newline ends sentence immediately",
+			maxRunes: 100,
+			writes:   []string{"first line\n", "second line\n"},
+			want:     []string{"first line", "second line"},
+		},
+		{
+			name:      "sentence split across writes",
+			maxRunes:  100,
+			writes:    []string{"你", "好！再", "见。"},
+			want:      []string{"你好！"},
+			wantFlush: "再见。",
+		},
+		{
+			name:      "long sentence cut at clause pause",
+			maxRunes:  10,
+			writes:    []string{"一二三四五六，七八九十一二"},
+			want:      []string{"一二三四五六，"},
+			wantFlush: "七八九十一二",
+		},
+		{
+			name:      "long sentence cut at whitespace",
+			maxRunes:  12,
+			writes:    []string{"one two three four"},
+			want:      []string{"one two"},
+			wantFlush: "three four",
+		},
+		{
+			name:      "long sentence without break points",
+			maxRunes:  4,
+			writes:    []string{"一二三四五六"},
+			want:      []string{"一二三四"},
+			wantFlush: "五六",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newSentenceBuffer(tt.maxRunes)
+			var got []string
+			for _, w := range tt.writes {
+				got = append(got, b.Write(w)...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sentences = %q, want %q", got, tt.want)
+			}
+			if flushed := b.Flush(); flushed != tt.wantFlush {
+				t.Errorf("Flush() = %q, want %q", flushed, tt.wantFlush)
+			}
+			if flushed := b.Flush(); flushed != "" {
+				t.Errorf("second Flush() = %q, want empty", flushed)
+			}
+		})
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		maxRunes int
+		want     []string
+	}{
+		{
+			name:     "empty text",
+			text:     "",
+			maxRunes: 10,
+		},
+		{
+			name:     "short sentences are merged",
+			text:     "你好。世界。",
+			maxRunes: 100,
+			want:     []string{"你好。世界。"},
+		},
+		{
+			name:     "english sentences keep a space",
+			text:     "Hello world. How are you? Fine.",
+			maxRunes: 100,
+			want:     []string{"Hello world. How are you? Fine."},
+		},
+		{
+			name:     "merge stops at limit",
+			text:     "Hello world. How are you? Fine.",
+			maxRunes: 20,
+			want:     []string{"Hello world.", "How are you? Fine."},
+		},
+		{
+			name:     "long sentence without break points",
+			text:     "一二三四五六七八九十",
+			maxRunes: 4,
+			want:     []string{"一二三四", "五六七八", "九十"},
+		},
+		{
+			name:     "trailing punctuation beyond limit",
+			text:     "啊啊啊！！！！",
+			maxRunes: 4,
+			want:     []string{"啊啊啊！", "！！！"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitText(tt.text, tt.maxRunes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitText() = %q, want %q", got, tt.want)
+			}
+			for _, segment := range got {
+				if n := len([]rune(segment)); n > tt.maxRunes {
+					t.Errorf("segment %q has %d runes, limit %d", segment, n, tt.maxRunes)
+				}
+			}
+		})
+	}
+}
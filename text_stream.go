@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 等待合成的句子队列长度，队列满时写入方等待
+const textStreamQueueSize = 64
+
+// 增量输入被放弃，例如客户端断开或输入出错
+var errTextInputAborted = fmt.Errorf("%w: text input aborted", ErrRequestCancelled)
+
+// 增量输入的文本，V3协议在一个会话中逐段推送
+// 已收到的文本全部保留，合成在输出音频前失败重试时从头重新推送
+type textInput struct {
+	mu     sync.Mutex
+	chunks []string
+	chars  int
+	closed bool          // 输入已结束
+	err    error         // 输入被放弃的原因
+	notify chan struct{} // 有新文本、输入结束或被放弃时关闭并替换
+}
+
+func newTextInput() *textInput {
+	return &textInput{notify: make(chan struct{})}
+}
+
+// 追加一段文本
+func (in *textInput) append(text string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.chunks = append(in.chunks, text)
+	in.chars += utf8.RuneCountInString(text)
+	in.wake()
+}
+
+// 结束输入
+func (in *textInput) close() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.closed = true
+	in.wake()
+}
+
+// 放弃输入，读取方随即返回 err
+func (in *textInput) abort(err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.err == nil {
+		in.err = err
+	}
+	in.wake()
+}
+
+// 通知等待的读取方，调用方需持有锁
+func (in *textInput) wake() {
+	close(in.notify)
+	in.notify = make(chan struct{})
+}
+
+// 读取第 i 段文本，尚未收到时等待
+// 输入已结束且没有更多文本时返回 false；输入被放弃或 ctx 取消时返回错误
+func (in *textInput) next(ctx context.Context, i int) (string, bool, error) {
+	for {
+		in.mu.Lock()
+		switch {
+		case in.err != nil:
+			in.mu.Unlock()
+			return "", false, in.err
+		case i < len(in.chunks):
+			text := in.chunks[i]
+			in.mu.Unlock()
+			return text, true, nil
+		case in.closed:
+			in.mu.Unlock()
+			return "", false, nil
+		}
+		notify := in.notify
+		in.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return "", false, fmt.Errorf("%w: %w", ErrRequestCancelled, context.Cause(ctx))
+		}
+	}
+}
+
+// 是否仍在等待输入文本
+func (in *textInput) pending() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return !in.closed && in.err == nil
+}
+
+// 已收到的字符数
+func (in *textInput) characters() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.chars
+}
+
+// 增量文本合成
+// V3协议在一个上游会话中合成全部输入：开始时发送 StartSession，每段输入文本发送一条 TaskRequest，输入结束后发送 FinishSession；
+// v1协议不支持增量推送，输入文本按句切分，每句通过 streamSynthesize 依次合成。音频按输入顺序连续输出
+// 开始时和每次写入文本时扣除的配额在合成失败且没有输出任何音频时全部退还
+type textStream struct {
+	ctx       context.Context
+	params    synthesisParams
+	onAudio   audioHandler
+	wavHeader bool
+	received  atomic.Bool // 是否已输出音频
+	input     *textInput  // V3协议的增量输入，v1协议为nil
+
+	mu           sync.Mutex
+	sentences    *sentenceBuffer
+	chars        int
+	reservations []*quotaReservation
+
+	queue  chan string
+	failed chan struct{}
+	done   chan struct{}
+	err    error
+	once   sync.Once
+}
+
+// 开始增量文本合成，quota 为开始时扣除的配额
+func startTextStream(ctx context.Context, params synthesisParams, quota *quotaReservation, onAudio audioHandler) *textStream {
+	ts := &textStream{
+		ctx:          ctx,
+		params:       params,
+		onAudio:      onAudio,
+		sentences:    newSentenceBuffer(appConfig.MaxSegmentLength),
+		reservations: []*quotaReservation{quota},
+		queue:        make(chan string, textStreamQueueSize),
+		failed:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if appConfig.ByteDanceProtocol == protocolV3 {
+		// V3协议以pcm合成wav并由会话补充WAV文件头
+		ts.input = newTextInput()
+		ts.params.Input = ts.input
+	} else if ts.params.Encoding == "wav" {
+		// 逐句合成的wav音频无法直接拼接，以pcm合成并只输出一次WAV文件头
+		ts.params.Encoding = "pcm"
+		ts.wavHeader = true
+	}
+
+	go ts.run()
+	return ts
+}
+
+// V3协议在一个上游会话中合成全部输入，v1协议依次合成队列中的句子
+func (ts *textStream) run() {
+	defer close(ts.done)
+
+	if ts.input != nil {
+		if err := streamSynthesize(ts.ctx, ts.params, ts.writeAudio); err != nil {
+			ts.fail(err)
+		}
+		return
+	}
+
+	for sentence := range ts.queue {
+		// 已中止时不再合成剩余句子
+		select {
+		case <-ts.failed:
+			return
+		default:
+		}
+
+		p := ts.params
+		p.Text = sentence
+		if err := streamSynthesize(ts.ctx, p, ts.writeAudio); err != nil {
+			ts.fail(err)
+			return
+		}
+	}
+}
+
+// 输出一段音频，收到第一帧音频时才输出WAV文件头，之前的错误仍可作为普通错误返回
+func (ts *textStream) writeAudio(audio []byte) error {
+	ts.received.Store(true)
+	if ts.wavHeader {
+		ts.wavHeader = false
+		if err := ts.onAudio(wavStreamHeader(audioSampleRate)); err != nil {
+			return err
+		}
+	}
+	return ts.onAudio(audio)
+}
+
+// 合成失败且没有输出任何音频时退还扣除的全部配额
+func (ts *textStream) settle(err error) {
+	if err == nil || ts.received.Load() {
+		return
+	}
+	ts.mu.Lock()
+	reservations := ts.reservations
+	ts.reservations = nil
+	ts.mu.Unlock()
+	for _, r := range reservations {
+		r.refund()
+	}
+}
+
+// 记录合成错误，之后的写入都会失败
+func (ts *textStream) fail(err error) {
+	ts.once.Do(func() {
+		ts.err = err
+		close(ts.failed)
+	})
+}
+
+// 将句子加入合成队列
+func (ts *textStream) enqueue(sentence string) error {
+	select {
+	case ts.queue <- sentence:
+		return nil
+	case <-ts.failed:
+		return ts.err
+	}
+}
+
+// Write 写入一段增量文本，完整的句子立即进入合成队列
+func (ts *textStream) Write(text string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	chars := utf8.RuneCountInString(text)
+	ts.chars += chars
+	if limit := ts.params.tenant().MaxTextLength; ts.chars > limit {
+		return fmt.Errorf("%w: text length exceeds maximum allowed %d", ErrTextTooLong, limit)
+	}
+	if err := takeRateLimit(ts.ctx, 0, chars); err != nil {
+		return err
+	}
+	quota, err := reserveQuota(ts.ctx, 0, chars)
+	if err != nil {
+		return err
+	}
+	ts.reservations = append(ts.reservations, quota)
+
+	if ts.input != nil {
+		select {
+		case <-ts.failed:
+			return ts.err
+		default:
+		}
+		ts.input.append(text)
+		return nil
+	}
+	for _, sentence := range ts.sentences.Write(text) {
+		if err := ts.enqueue(sentence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 合成剩余文本并等待全部音频输出完成
+func (ts *textStream) Close() error {
+	ts.mu.Lock()
+	var err error
+	switch {
+	case ts.chars == 0:
+		err = fmt.Errorf("%w: input text cannot be empty", ErrInvalidRequest)
+		if ts.input != nil {
+			ts.input.abort(errTextInputAborted)
+		}
+	case ts.input != nil:
+		ts.input.close()
+	default:
+		if rest := ts.sentences.Flush(); rest != "" {
+			err = ts.enqueue(rest)
+		}
+	}
+	close(ts.queue)
+	ts.mu.Unlock()
+
+	<-ts.done
+	if ts.err != nil && ts.chars > 0 {
+		err = ts.err
+	}
+	ts.settle(err)
+	return err
+}
+
+// Abort 放弃尚未合成的文本并等待正在进行的合成结束
+func (ts *textStream) Abort() {
+	ts.fail(errors.New("text stream aborted"))
+
+	ts.mu.Lock()
+	if ts.input != nil {
+		ts.input.abort(errTextInputAborted)
+	}
+	close(ts.queue)
+	ts.mu.Unlock()
+
+	// 丢弃队列中剩余的句子
+	for range ts.queue {
+	}
+	<-ts.done
+	ts.settle(ts.err)
+}
+
+// 处理增量文本输入的HTTP请求
+// 请求体为分块上传的纯文本，合成参数通过查询参数传递，音频边收边合成边返回
+func handleOpenAITTSStreamInput(c *gin.Context) {
+	// 增加活动连接计数
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
+
+	// 验证并发连接数
+	currentConnections := activeConnections.Load()
+	if currentConnections > int32(appConfig.MaxConnections) {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "service_overloaded",
+			Code:    http.StatusServiceUnavailable,
+			Message: fmt.Sprintf("Too many concurrent connections, maximum is %d", appConfig.MaxConnections),
+		})
+		return
+	}
+
+	// API密钥验证
+	apiKey := extractAPIKey(c)
+	identity, errResp := authenticateAPIKey(apiKey, scopeSpeech)
+	if errResp != nil {
+		writeErrorResponse(c, errResp)
+		return
+	}
+
+	// 按API密钥和优先级调度并发调用名额
+	ctx, err := callContext(c, apiKey, identity)
+	if err != nil {
+		writeSynthesisError(c, err)
+		return
+	}
+
+	// 解析查询参数
+	req := OpenAITTSRequest{
+		Model:          c.Query("model"),
+		Voice:          c.Query("voice"),
+		ResponseFormat: c.Query("response_format"),
+	}
+	if speed := c.Query("speed"); speed != "" {
+		value, err := strconv.ParseFloat(speed, 64)
+		if err != nil {
+			writeSynthesisError(c, fmt.Errorf("%w: invalid speed %q", ErrInvalidRequest, speed))
+			return
+		}
+		req.Speed = value
+	}
+
+	params, format, err := prepareSynthesisOptions(identity.Tenant, req)
+	if err != nil {
+		writeSynthesisError(c, err)
+		return
+	}
+
+	// HTTP/1.x 默认在写出响应后不能再读取请求体，开启全双工以便边读边写
+	if err := http.NewResponseController(c.Writer).EnableFullDuplex(); err != nil {
+		slog.WarnContext(ctx, "Full duplex not supported, audio is sent after the request body", "error", err)
+	}
+
+	// 设置响应头，收到第一帧音频时才写出
+	started := false
+	startStream := func() {
+		if started {
+			return
+		}
+		started = true
+		c.Header("Content-Type", format.ContentType)
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Trailer", streamErrorTrailer)
+		c.Status(http.StatusOK)
+	}
+
+	pipeline, err := newAudioPipeline(format, func(audio []byte) error {
+		startStream()
+		if _, err := c.Writer.Write(audio); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		writeSynthesisError(c, err)
+		return
+	}
+
+	// 开始时扣除一个请求的配额，字符数的配额在写入文本时扣除，合成失败且没有输出音频时全部退还
+	quota, err := reserveQuota(ctx, 1, 0)
+	if err != nil {
+		pipeline.Abort()
+		writeSynthesisError(c, err)
+		return
+	}
+
+	// 边读取请求体边按句合成
+	u := startUsage(ctx, usageEndpointStream, params, format, "")
+	ts := startTextStream(ctx, params, quota, u.wrap(pipeline.Write))
+	err = copyTextStream(ts, c.Request.Body)
+	if err != nil {
+		ts.Abort()
+	} else {
+		err = ts.Close()
+	}
+	u.finish(ts.chars, err)
+	if err != nil {
+		pipeline.Abort()
+	} else {
+		err = pipeline.Close()
+	}
+
+	if err != nil {
+		// 已开始发送音频，通过trailer报告错误并截断响应流
+		if started {
+			_, errorType := synthesisErrorStatus(err)
+			setErrorType(c, errorType)
+			c.Writer.Header().Set(streamErrorTrailer, err.Error())
+			slog.ErrorContext(ctx, "Error streaming audio data", "error", err)
+			return
+		}
+		writeSynthesisError(c, err)
+		return
+	}
+
+	startStream()
+	c.Writer.Flush()
+}
+
+// 将请求体中的文本逐块写入增量合成
+func copyTextStream(ts *textStream, body io.Reader) error {
+	buf := make([]byte, 4096)
+	var pending []byte
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			// 保留被分块截断的UTF-8字符，等待下一块补全
+			pending = append(pending, buf[:n]...)
+			valid := len(pending)
+			for valid > 0 && !utf8.Valid(pending[:valid]) && len(pending)-valid < utf8.UTFMax {
+				valid--
+			}
+			if valid > 0 {
+				if werr := ts.Write(string(pending[:valid])); werr != nil {
+					return werr
+				}
+				pending = append(pending[:0], pending[valid:]...)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			if len(pending) > 0 {
+				return ts.Write(string(pending))
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		}
+	}
+}
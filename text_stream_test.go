@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// 依次读取增量输入的全部文本，直到输入结束或出错
+func readTextInput(ctx context.Context, in *textInput) ([]string, error) {
+	var chunks []string
+	for i := 0; ; i++ {
+		text, ok, err := in.next(ctx, i)
+		if err != nil || !ok {
+			return chunks, err
+		}
+		chunks = append(chunks, text)
+	}
+}
+
+func TestTextInput(t *testing.T) {
+	tests := []struct {
+		name        string
+		feed        func(in *textInput)
+		want        []string
+		wantErr     error
+		wantPending bool
+		wantChars   int
+	}{
+		{
+			name: "chunks until close",
+			feed: func(in *textInput) {
+				in.append("你好，")
+				in.append("world")
+				in.close()
+			},
+			want:      []string{"你好，", "world"},
+			wantChars: 8,
+		},
+		{
+			name: "abort stops reading",
+			feed: func(in *textInput) {
+				in.append("hello")
+				in.abort(errTextInputAborted)
+				in.abort(errors.New("later error"))
+			},
+			wantErr:   errTextInputAborted,
+			wantChars: 5,
+		},
+		{
+			name:        "reader waits for more input",
+			feed:        func(in *textInput) { in.append("hello") },
+			want:        []string{"hello"},
+			wantErr:     ErrRequestCancelled,
+			wantPending: true,
+			wantChars:   5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := newTextInput()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			tt.feed(in)
+			got, err := readTextInput(ctx, in)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("chunks = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("chunk %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+			if in.pending() != tt.wantPending {
+				t.Errorf("pending = %v, want %v", in.pending(), tt.wantPending)
+			}
+			if in.characters() != tt.wantChars {
+				t.Errorf("characters = %d, want %d", in.characters(), tt.wantChars)
+			}
+		})
+	}
+}
+
+func TestTextInputReplay(t *testing.T) {
+	in := newTextInput()
+	in.append("one")
+	in.append("two")
+	in.close()
+
+	// 重试时从头重新读取，已收到的文本不会丢失
+	for attempt := 0; attempt < 2; attempt++ {
+		got, err := readTextInput(context.Background(), in)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", attempt, err)
+		}
+		if len(got) != 2 || got[0] != "one" || got[1] != "two" {
+			t.Errorf("attempt %d: chunks = %q", attempt, got)
+		}
+	}
+}
+
+func TestTextInputWakesReader(t *testing.T) {
+	in := newTextInput()
+	result := make(chan string, 1)
+	go func() {
+		text, _, _ := in.next(context.Background(), 0)
+		result <- text
+	}()
+
+	select {
+	case text := <-result:
+		t.Fatalf("next returned %q before input arrived", text)
+	case <-time.After(20 * time.Millisecond):
+	}
+	in.append("hello")
+	select {
+	case text := <-result:
+		if text != "hello" {
+			t.Errorf("next = %q, want %q", text, "hello")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader not woken by new input")
+	}
+}
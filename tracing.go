@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 本服务的 tracer，未启用追踪时为 OpenTelemetry 默认的空实现
+var tracer = otel.Tracer("Volcano-Engine-websocket-TTS")
+
+// 初始化 OpenTelemetry 追踪
+// 始终按 W3C traceparent 传播追踪上下文；配置了 OTLP 地址时通过 OTLP/HTTP 导出span，
+// 地址、请求头和超时等由 exporter 按 OTEL_EXPORTER_OTLP_* 环境变量读取
+func initTracing(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if appConfig.OTLPEndpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(appConfig.ServiceName),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// 上游已采样的请求始终采样，新的trace按比例采样
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(appConfig.TraceSampleRatio))),
+	))
+	return nil
+}
+
+// 为每个请求创建服务端span的中间件，健康检查和指标端点不追踪
+func tracingMiddleware() gin.HandlerFunc {
+	return otelgin.Middleware(appConfig.ServiceName, otelgin.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/health" && r.URL.Path != "/metrics"
+	}))
+}
+
+// 在请求的trace中开始一个子span
+// ctx 中没有span时（例如连接池在后台预热连接）返回空span，避免产生大量孤立的trace
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// 结束span，err 不为nil时记录错误
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		var volcErr *VolcanoError
+		if errors.As(err, &volcErr) {
+			span.SetAttributes(attribute.Int("volcano.code", volcErr.Code))
+		}
+	}
+	span.End()
+}
+
+// 上游读取阶段的span
+// volcano.read 覆盖从发送请求后到最后一帧的整个读取循环，其子span volcano.first_frame 覆盖等待第一帧音频的时间
+type readSpans struct {
+	read       trace.Span
+	firstFrame trace.Span
+	once       sync.Once
+}
+
+// 开始读取阶段的span
+func startReadSpans(ctx context.Context) *readSpans {
+	ctx, read := startSpan(ctx, "volcano.read")
+	_, firstFrame := startSpan(ctx, "volcano.first_frame")
+	return &readSpans{read: read, firstFrame: firstFrame}
+}
+
+// 包装音频输出，收到第一帧音频时结束 volcano.first_frame
+func (r *readSpans) wrap(onAudio audioHandler) audioHandler {
+	return func(audio []byte) error {
+		r.once.Do(func() { r.firstFrame.End() })
+		return onAudio(audio)
+	}
+}
+
+// 结束读取阶段，没有收到音频时 volcano.first_frame 随之结束并记录错误
+func (r *readSpans) end(err error) {
+	r.once.Do(func() { endSpan(r.firstFrame, err) })
+	endSpan(r.read, err)
+}
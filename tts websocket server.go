@@ -3,21 +3,29 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Config 应用程序配置
@@ -31,23 +39,110 @@ type Config struct {
 	ByteDanceToken     string
 	ByteDanceCluster   string
 	ByteDanceVoiceType string
+	ByteDanceProtocol  string
+	ByteDanceResource  string
+	ByteDanceEndpoints string
+
+	// 火山引擎账号配置文件路径，为空时使用上面的单个账号
+	AccountsFile    string
+	AccountCooldown time.Duration
+
+	// 语音目录配置文件路径
+	VoiceCatalogFile string
+
+	// 按API密钥配置的调度策略文件路径
+	CallPolicyFile string
+
+	// 租户配置文件路径
+	TenantsFile string
 
 	// OpenAI TTS认证配置
 	OpenAITTSAPIKey string
 
+	// 客户端密钥库文件路径，为空时通过管理接口创建的密钥只保存在内存中
+	APIKeyStoreFile string
+
+	// 管理接口密钥，为空时不开放管理接口
+	AdminAPIKey string
+
+	// 按API密钥和客户端IP的限流额度，0表示不限制
+	RateLimitKey rateLimitConfig
+	RateLimitIP  rateLimitConfig
+
+	// 每个API密钥每天和每月的配额，0表示不限制
+	QuotaKey quotaConfig
+
+	// 配额计数状态文件路径，为空时计数只保存在内存中，服务重启后清零
+	QuotaStateFile string
+
+	// 配额计数写入状态文件的间隔
+	QuotaFlushInterval time.Duration
+
+	// 用量日志文件路径（JSONL），为空时不记录用量
+	UsageLogFile string
+
+	// OTLP 导出地址，为空时不导出追踪数据
+	OTLPEndpoint string
+
+	// 追踪数据中的服务名称
+	ServiceName string
+
+	// 新trace的采样比例，0到1之间
+	TraceSampleRatio float64
+
+	// 信任的反向代理地址，逗号分隔，只有来自这些地址的请求才按 X-Forwarded-For 确定客户端IP
+	TrustedProxies string
+
+	// 本地转码使用的 ffmpeg 路径
+	FFmpegPath string
+
 	// 超时配置
-	DialTimeout  time.Duration
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+	DialTimeout     time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
 
 	// 日志配置
-	LogLevel string
+	LogLevel  string
+	LogFormat string
 
 	// 性能配置
 	MaxConnections     int
 	MaxRequestSizeMB   int
 	MaxTextLength      int
 	MaxConcurrentCalls int
+	MaxSegmentLength   int
+	SegmentParallelism int
+
+	// 并发调用排队配置
+	QueueMaxDepth int
+	QueueMaxWait  time.Duration
+
+	// 上游临时失败的重试配置
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	RetryBudgetRatio float64
+
+	// 上游连接池配置
+	UpstreamPoolMinIdle      int
+	UpstreamPoolMaxSize      int
+	UpstreamPoolIdleTimeout  time.Duration
+	UpstreamPoolPingInterval time.Duration
+
+	// V3协议每条连接上同时进行的最大会话数
+	V3SessionsPerConn int
+
+	// 上游地址熔断器配置
+	BreakerFailureThreshold int
+	BreakerOpenDuration     time.Duration
+	BreakerLatencyThreshold time.Duration
+
+	// 音频缓存配置
+	CacheMemoryMaxMB int
+	CacheDir         string
+	CacheDiskMaxMB   int
+	CacheTTL         time.Duration
 }
 
 // 应用程序配置
@@ -65,43 +160,135 @@ func LoadConfig() *Config {
 		ByteDanceToken:     getEnv("BYTEDANCE_TTS_BEARER_TOKEN", "XXX"),
 		ByteDanceCluster:   getEnv("BYTEDANCE_TTS_CLUSTER", "xxxx"),
 		ByteDanceVoiceType: getEnv("BYTEDANCE_TTS_VOICE_TYPE", ""),
+		ByteDanceProtocol:  getEnv("BYTEDANCE_TTS_PROTOCOL", protocolV1),
+		ByteDanceResource:  getEnv("BYTEDANCE_TTS_RESOURCE_ID", "volc.service_type.10029"),
+		ByteDanceEndpoints: getEnv("BYTEDANCE_TTS_ENDPOINTS", ""),
+
+		// 火山引擎账号配置
+		AccountsFile:    getEnv("BYTEDANCE_ACCOUNTS_FILE", ""),
+		AccountCooldown: getEnvDuration("BYTEDANCE_ACCOUNT_COOLDOWN", 60*time.Second),
+
+		// 语音目录配置文件路径
+		VoiceCatalogFile: getEnv("VOICE_CATALOG_FILE", ""),
+
+		// 按API密钥配置的调度策略文件路径
+		CallPolicyFile: getEnv("CALL_POLICY_FILE", ""),
+
+		// 租户配置文件路径
+		TenantsFile: getEnv("TENANTS_FILE", ""),
 
 		// OpenAI TTS认证配置
 		OpenAITTSAPIKey: getEnv("OPENAI_TTS_API_KEY", ""),
+		APIKeyStoreFile: getEnv("API_KEY_STORE_FILE", ""),
+		AdminAPIKey:     getEnv("ADMIN_API_KEY", ""),
+
+		// 限流配置
+		RateLimitKey: rateLimitConfig{
+			RequestsPerMinute: getEnvInt("RATE_LIMIT_KEY_REQUESTS_PER_MINUTE", 0),
+			CharsPerMinute:    getEnvInt("RATE_LIMIT_KEY_CHARS_PER_MINUTE", 0),
+			CharsPerDay:       getEnvInt("RATE_LIMIT_KEY_CHARS_PER_DAY", 0),
+		},
+		RateLimitIP: rateLimitConfig{
+			RequestsPerMinute: getEnvInt("RATE_LIMIT_IP_REQUESTS_PER_MINUTE", 0),
+			CharsPerMinute:    getEnvInt("RATE_LIMIT_IP_CHARS_PER_MINUTE", 0),
+			CharsPerDay:       getEnvInt("RATE_LIMIT_IP_CHARS_PER_DAY", 0),
+		},
+		TrustedProxies: getEnv("TRUSTED_PROXIES", ""),
+
+		// 配额配置
+		QuotaKey: quotaConfig{
+			RequestsPerDay:   getEnvInt("QUOTA_KEY_REQUESTS_PER_DAY", 0),
+			RequestsPerMonth: getEnvInt("QUOTA_KEY_REQUESTS_PER_MONTH", 0),
+			CharsPerDay:      getEnvInt("QUOTA_KEY_CHARS_PER_DAY", 0),
+			CharsPerMonth:    getEnvInt("QUOTA_KEY_CHARS_PER_MONTH", 0),
+		},
+		QuotaStateFile:     getEnv("QUOTA_STATE_FILE", ""),
+		QuotaFlushInterval: getEnvDuration("QUOTA_FLUSH_INTERVAL", 5*time.Second),
+
+		// 用量日志文件路径
+		UsageLogFile: getEnv("USAGE_LOG_FILE", ""),
+
+		// 追踪配置，OTEL_EXPORTER_OTLP_* 的其余设置由 exporter 直接读取
+		OTLPEndpoint:     getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")),
+		ServiceName:      getEnv("OTEL_SERVICE_NAME", "tts-transit-service"),
+		TraceSampleRatio: getEnvFloat("TRACE_SAMPLE_RATIO", 1.0),
+
+		// 本地转码使用的 ffmpeg 路径
+		FFmpegPath: getEnv("FFMPEG_PATH", "ffmpeg"),
 
 		// 超时配置
-		DialTimeout:  getEnvDuration("DIAL_TIMEOUT", 10*time.Second),
-		ReadTimeout:  getEnvDuration("READ_TIMEOUT", 30*time.Second),
-		WriteTimeout: getEnvDuration("WRITE_TIMEOUT", 30*time.Second),
+		DialTimeout:     getEnvDuration("DIAL_TIMEOUT", 10*time.Second),
+		ReadTimeout:     getEnvDuration("READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:    getEnvDuration("WRITE_TIMEOUT", 30*time.Second),
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
 
 		// 日志配置
-		LogLevel: getEnv("LOG_LEVEL", "info"),
+		LogLevel:  getEnv("LOG_LEVEL", "info"),
+		LogFormat: getEnv("LOG_FORMAT", logFormatText),
 
 		// 性能配置
 		MaxConnections:     getEnvInt("MAX_CONNECTIONS", 100),
 		MaxRequestSizeMB:   getEnvInt("MAX_REQUEST_SIZE_MB", 5),
 		MaxTextLength:      getEnvInt("MAX_TEXT_LENGTH", 5000),
 		MaxConcurrentCalls: getEnvInt("MAX_CONCURRENT_CALLS", 10),
+		MaxSegmentLength:   getEnvInt("MAX_SEGMENT_LENGTH", 300),
+
+		// 并发调用排队配置
+		QueueMaxDepth: getEnvInt("QUEUE_MAX_DEPTH", 100),
+		QueueMaxWait:  getEnvDuration("QUEUE_MAX_WAIT", 10*time.Second),
+
+		// 上游临时失败的重试配置
+		RetryMaxAttempts: getEnvInt("RETRY_MAX_ATTEMPTS", 3),
+		RetryBaseDelay:   getEnvDuration("RETRY_BASE_DELAY", 200*time.Millisecond),
+		RetryMaxDelay:    getEnvDuration("RETRY_MAX_DELAY", 2*time.Second),
+		RetryBudgetRatio: getEnvFloat("RETRY_BUDGET_RATIO", 0.1),
+
+		// 上游连接池配置
+		UpstreamPoolMinIdle:      getEnvInt("UPSTREAM_POOL_MIN_IDLE", 0),
+		UpstreamPoolIdleTimeout:  getEnvDuration("UPSTREAM_POOL_IDLE_TIMEOUT", 60*time.Second),
+		UpstreamPoolPingInterval: getEnvDuration("UPSTREAM_POOL_PING_INTERVAL", 15*time.Second),
+
+		// 上游地址熔断器配置
+		BreakerFailureThreshold: getEnvInt("UPSTREAM_BREAKER_FAILURE_THRESHOLD", 5),
+		BreakerOpenDuration:     getEnvDuration("UPSTREAM_BREAKER_OPEN_DURATION", 30*time.Second),
+		BreakerLatencyThreshold: getEnvDuration("UPSTREAM_BREAKER_LATENCY_THRESHOLD", 5*time.Second),
+
+		// 音频缓存配置
+		CacheMemoryMaxMB: getEnvInt("CACHE_MEMORY_MAX_MB", 64),
+		CacheDir:         getEnv("CACHE_DIR", ""),
+		CacheDiskMaxMB:   getEnvInt("CACHE_DISK_MAX_MB", 1024),
+		CacheTTL:         getEnvDuration("CACHE_TTL", 24*time.Hour),
 	}
 
+	cfg.V3SessionsPerConn = getEnvInt("BYTEDANCE_TTS_V3_SESSIONS_PER_CONN", 1)
+
+	// 连接池最大连接数默认与最大并发调用数一致
+	cfg.UpstreamPoolMaxSize = getEnvInt("UPSTREAM_POOL_MAX_SIZE", cfg.MaxConcurrentCalls)
+
+	// 长文本并行合成的片段数默认为3，不超过最大并发调用数
+	cfg.SegmentParallelism = getEnvInt("SEGMENT_PARALLELISM", min(3, cfg.MaxConcurrentCalls))
+
 	return cfg
 }
 
 // ValidateConfig 验证配置的有效性
 func (c *Config) ValidateConfig() error {
 	// 验证必要的字节跳动配置，收集所有缺失的环境变量
+	// 配置了账号文件时凭据从账号文件读取
 	var missingEnvs []string
 
-	if c.ByteDanceAppID == "XXX" {
-		missingEnvs = append(missingEnvs, "BYTEDANCE_TTS_APP_ID")
-	}
+	if c.AccountsFile == "" {
+		if c.ByteDanceAppID == "XXX" {
+			missingEnvs = append(missingEnvs, "BYTEDANCE_TTS_APP_ID")
+		}
 
-	if c.ByteDanceToken == "XXX" {
-		missingEnvs = append(missingEnvs, "BYTEDANCE_TTS_BEARER_TOKEN")
-	}
+		if c.ByteDanceToken == "XXX" {
+			missingEnvs = append(missingEnvs, "BYTEDANCE_TTS_BEARER_TOKEN")
+		}
 
-	if c.ByteDanceCluster == "xxxx" {
-		missingEnvs = append(missingEnvs, "BYTEDANCE_TTS_CLUSTER")
+		if c.ByteDanceCluster == "xxxx" {
+			missingEnvs = append(missingEnvs, "BYTEDANCE_TTS_CLUSTER")
+		}
 	}
 
 	if c.ByteDanceVoiceType == "" {
@@ -113,6 +300,20 @@ func (c *Config) ValidateConfig() error {
 		return fmt.Errorf("missing required environment variables: %v", missingEnvs)
 	}
 
+	// 验证上游协议
+	if c.ByteDanceProtocol != protocolV1 && c.ByteDanceProtocol != protocolV3 {
+		return fmt.Errorf("BYTEDANCE_TTS_PROTOCOL must be %q or %q", protocolV1, protocolV3)
+	}
+
+	// 验证上游地址列表
+	if _, err := c.upstreamTargets(); err != nil {
+		return err
+	}
+
+	if c.AccountCooldown <= 0 {
+		return fmt.Errorf("BYTEDANCE_ACCOUNT_COOLDOWN must be positive")
+	}
+
 	// 验证超时设置
 	if c.DialTimeout <= 0 {
 		return fmt.Errorf("DIAL_TIMEOUT must be positive")
@@ -126,6 +327,10 @@ func (c *Config) ValidateConfig() error {
 		return fmt.Errorf("WRITE_TIMEOUT must be positive")
 	}
 
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must be positive")
+	}
+
 	// 验证性能限制
 	if c.MaxConnections <= 0 {
 		return fmt.Errorf("MAX_CONNECTIONS must be positive")
@@ -143,6 +348,113 @@ func (c *Config) ValidateConfig() error {
 		return fmt.Errorf("MAX_CONCURRENT_CALLS must be positive")
 	}
 
+	if c.MaxSegmentLength <= 0 || c.MaxSegmentLength > c.MaxTextLength {
+		return fmt.Errorf("MAX_SEGMENT_LENGTH must be between 1 and MAX_TEXT_LENGTH")
+	}
+
+	if c.SegmentParallelism <= 0 || c.SegmentParallelism > c.MaxConcurrentCalls {
+		return fmt.Errorf("SEGMENT_PARALLELISM must be between 1 and MAX_CONCURRENT_CALLS")
+	}
+
+	if c.QueueMaxDepth < 0 {
+		return fmt.Errorf("QUEUE_MAX_DEPTH must not be negative")
+	}
+
+	if c.QueueMaxWait <= 0 {
+		return fmt.Errorf("QUEUE_MAX_WAIT must be positive")
+	}
+
+	// 验证重试设置
+	if c.RetryMaxAttempts <= 0 {
+		return fmt.Errorf("RETRY_MAX_ATTEMPTS must be positive")
+	}
+
+	if c.RetryBaseDelay <= 0 || c.RetryMaxDelay < c.RetryBaseDelay {
+		return fmt.Errorf("RETRY_BASE_DELAY must be positive and not greater than RETRY_MAX_DELAY")
+	}
+
+	if c.RetryBudgetRatio < 0 || c.RetryBudgetRatio > 1 {
+		return fmt.Errorf("RETRY_BUDGET_RATIO must be between 0 and 1")
+	}
+
+	// 验证上游连接池设置
+	if c.UpstreamPoolMaxSize < 0 || c.UpstreamPoolMaxSize > c.MaxConcurrentCalls {
+		return fmt.Errorf("UPSTREAM_POOL_MAX_SIZE must be between 0 and MAX_CONCURRENT_CALLS")
+	}
+
+	if c.UpstreamPoolMinIdle < 0 || c.UpstreamPoolMinIdle > c.UpstreamPoolMaxSize {
+		return fmt.Errorf("UPSTREAM_POOL_MIN_IDLE must be between 0 and UPSTREAM_POOL_MAX_SIZE")
+	}
+
+	if c.UpstreamPoolIdleTimeout <= 0 {
+		return fmt.Errorf("UPSTREAM_POOL_IDLE_TIMEOUT must be positive")
+	}
+
+	if c.UpstreamPoolPingInterval <= 0 {
+		return fmt.Errorf("UPSTREAM_POOL_PING_INTERVAL must be positive")
+	}
+
+	if c.V3SessionsPerConn <= 0 {
+		return fmt.Errorf("BYTEDANCE_TTS_V3_SESSIONS_PER_CONN must be positive")
+	}
+
+	// 验证熔断器设置
+	if c.BreakerFailureThreshold <= 0 {
+		return fmt.Errorf("UPSTREAM_BREAKER_FAILURE_THRESHOLD must be positive")
+	}
+
+	if c.BreakerOpenDuration <= 0 {
+		return fmt.Errorf("UPSTREAM_BREAKER_OPEN_DURATION must be positive")
+	}
+
+	if c.BreakerLatencyThreshold < 0 {
+		return fmt.Errorf("UPSTREAM_BREAKER_LATENCY_THRESHOLD must not be negative")
+	}
+
+	// 验证限流设置
+	if err := c.RateLimitKey.validate(); err != nil {
+		return fmt.Errorf("RATE_LIMIT_KEY_*: %w", err)
+	}
+
+	if err := c.RateLimitIP.validate(); err != nil {
+		return fmt.Errorf("RATE_LIMIT_IP_*: %w", err)
+	}
+
+	// 验证配额设置
+	if err := c.QuotaKey.validate(); err != nil {
+		return fmt.Errorf("QUOTA_KEY_*: %w", err)
+	}
+
+	if c.QuotaFlushInterval <= 0 {
+		return fmt.Errorf("QUOTA_FLUSH_INTERVAL must be positive")
+	}
+
+	// 验证日志设置
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if err := validateLogFormat(c.LogFormat); err != nil {
+		return err
+	}
+
+	// 验证追踪设置
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return fmt.Errorf("TRACE_SAMPLE_RATIO must be between 0 and 1")
+	}
+
+	// 验证音频缓存设置
+	if c.CacheMemoryMaxMB < 0 {
+		return fmt.Errorf("CACHE_MEMORY_MAX_MB must not be negative")
+	}
+
+	if c.CacheDir != "" && c.CacheDiskMaxMB <= 0 {
+		return fmt.Errorf("CACHE_DISK_MAX_MB must be positive when CACHE_DIR is set")
+	}
+
+	if c.CacheTTL <= 0 {
+		return fmt.Errorf("CACHE_TTL must be positive")
+	}
+
 	return nil
 }
 
@@ -174,14 +486,27 @@ func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
-var byteDanceURL *url.URL
+// 从环境变量获取浮点数值，如果不存在或解析失败则返回默认值
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
 var activeConnections atomic.Int32 // 使用原子计数器替代WaitGroup
-var semaphore chan struct{}        // 用于控制并发调用数量
 var startTime time.Time            // 服务启动时间
+var cancelledCalls atomic.Int64    // 因客户端断开而中止的上游合成次数
 
 // 协议相关常量
 const (
 	optSubmit string = "submit"
+
+	// 上游协议
+	protocolV1 = "v1" // ws_binary 单向流式协议
+	protocolV3 = "v3" // 双向流式事件协议
 )
 
 // 错误定义
@@ -196,6 +521,18 @@ var (
 	ErrAudioWriteFailed    = errors.New("failed to write audio data")
 	ErrInvalidAPIKey       = errors.New("invalid API key format")
 	ErrUnauthorized        = errors.New("unauthorized access")
+	ErrVoiceNotAllowed     = errors.New("voice not allowed")
+	ErrUnsupportedFormat   = errors.New("unsupported response format")
+	ErrTranscodeFailed     = errors.New("audio transcoding failed")
+	ErrRequestCancelled    = errors.New("request cancelled")
+	ErrUpstreamUnavailable = errors.New("no healthy upstream endpoint")
+	ErrUpstreamAuthFailed  = errors.New("upstream authentication failed")
+	ErrAPIKeyDisabled      = errors.New("API key is disabled")
+	ErrAPIKeyExpired       = errors.New("API key has expired")
+	ErrAPIKeyNotFound      = errors.New("API key not found")
+	ErrInsufficientScope   = errors.New("insufficient scope")
+	ErrRateLimited         = errors.New("rate limit exceeded")
+	ErrQuotaExceeded       = errors.New("quota exceeded")
 )
 
 // isValidAPIKey 验证API密钥格式是否合法
@@ -229,14 +566,49 @@ type OpenAITTSRequest struct {
 	Voice          string  `json:"voice" binding:"required"`
 	ResponseFormat string  `json:"response_format,omitempty"`
 	Speed          float64 `json:"speed,omitempty"`
+	StreamFormat   string  `json:"stream_format,omitempty"`
 }
 
+// 流式输出方式
+const (
+	streamFormatAudio = "audio" // 直接输出音频字节流
+	streamFormatSSE   = "sse"   // 以Server-Sent Events输出base64音频
+)
+
 // 合成响应结构
 type SynthResp struct {
 	Audio  []byte
 	IsLast bool
 }
 
+// 合成参数
+type synthesisParams struct {
+	Text      string
+	VoiceType string // 火山引擎语音，由租户的 resolveVoice 解析得到
+	Encoding  string // 火山引擎音频编码
+	Speed     float64
+	Tenant    *tenantConfig // 发起请求的租户
+	Input     *textInput    // 增量输入的文本，不为nil时在一个上游会话中边输入边合成，只有V3协议支持
+}
+
+// 发起请求的租户，未设置时为默认租户
+func (p synthesisParams) tenant() *tenantConfig {
+	if p.Tenant != nil {
+		return p.Tenant
+	}
+	return tenants.defaultTenant
+}
+
+// 音频数据回调，每收到一帧火山引擎音频调用一次
+// 返回错误时中止合成
+type audioHandler func(audio []byte) error
+
+// 流式响应出错时用于报告错误的trailer
+const streamErrorTrailer = "X-Stream-Error"
+
+// 客户端在响应前断开连接时记录的状态码，沿用 nginx 的约定
+const statusClientClosedRequest = 499
+
 // 初始化函数
 func init() {
 	// 记录服务启动时间
@@ -245,50 +617,53 @@ func init() {
 	// 初始化应用配置
 	appConfig = LoadConfig()
 
-	// 初始化字节跳动URL - 直接硬编码完整URL
-	byteDanceURL = &url.URL{
-		Scheme: "wss",
-		Host:   "openspeech.bytedance.com",
-		Path:   "/api/v1/tts/ws_binary",
+	// 初始化上游重试策略
+	upstreamRetry = &retryPolicy{
+		maxAttempts: appConfig.RetryMaxAttempts,
+		baseDelay:   appConfig.RetryBaseDelay,
+		maxDelay:    appConfig.RetryMaxDelay,
+		budget:      newRetryBudget(appConfig.RetryBudgetRatio),
 	}
 
-	// 初始化并发控制信号量
-	semaphore = make(chan struct{}, appConfig.MaxConcurrentCalls)
+	// 初始化并发调用准入队列
+	callQueue = newAdmissionQueue(appConfig.MaxConcurrentCalls, appConfig.QueueMaxDepth, appConfig.QueueMaxWait)
 }
 
 // 设置字节跳动TTS请求参数
-// 注意：voice_type 参数来自环境变量 BYTEDANCE_TTS_VOICE_TYPE，忽略任何传入的 voiceType 值
-func setupByteDanceInput(text, opt string, speed float64) ([]byte, error) {
-	// 验证文本长度
-	if len(text) > appConfig.MaxTextLength {
-		return nil, fmt.Errorf("%w: text length %d exceeds maximum allowed %d",
-			ErrTextTooLong, len(text), appConfig.MaxTextLength)
-	}
-
-	// 直接使用appConfig中的配置值
-	// voice_type 参数来自环境变量 BYTEDANCE_TTS_VOICE_TYPE
-	appID := appConfig.ByteDanceAppID
-	token := appConfig.ByteDanceToken
-	cluster := appConfig.ByteDanceCluster
-	voiceType := appConfig.ByteDanceVoiceType
-
-	reqID := uuid.NewV4().String()
+// 语音为空时使用环境变量 BYTEDANCE_TTS_VOICE_TYPE，编码为空时使用mp3
+func setupByteDanceInput(p synthesisParams, account volcanoAccount, reqID, opt string) ([]byte, error) {
+	// 验证单次上游请求的文本长度，长文本应先经 splitText 切分
+	if n := utf8.RuneCountInString(p.Text); n > appConfig.MaxSegmentLength {
+		return nil, fmt.Errorf("%w: segment length %d exceeds maximum allowed %d",
+			ErrTextTooLong, n, appConfig.MaxSegmentLength)
+	}
+
+	voiceType := p.VoiceType
+	if voiceType == "" {
+		voiceType = p.tenant().DefaultVoice
+	}
+	encoding := p.Encoding
+	if encoding == "" {
+		encoding = "mp3"
+	}
+
 	params := make(map[string]map[string]interface{})
 	params["app"] = make(map[string]interface{})
-	params["app"]["appid"] = appID
-	params["app"]["token"] = token
-	params["app"]["cluster"] = cluster
+	params["app"]["appid"] = account.AppID
+	params["app"]["token"] = account.Token
+	params["app"]["cluster"] = account.Cluster
 	params["user"] = make(map[string]interface{})
 	params["user"]["uid"] = "uid"
 	params["audio"] = make(map[string]interface{})
 	params["audio"]["voice_type"] = voiceType
-	params["audio"]["encoding"] = "mp3"
-	params["audio"]["speed_ratio"] = speed
+	params["audio"]["encoding"] = encoding
+	params["audio"]["rate"] = audioSampleRate
+	params["audio"]["speed_ratio"] = p.Speed
 	params["audio"]["volume_ratio"] = 1.0
 	params["audio"]["pitch_ratio"] = 1.0
 	params["request"] = make(map[string]interface{})
 	params["request"]["reqid"] = reqID
-	params["request"]["text"] = text
+	params["request"]["text"] = p.Text
 	params["request"]["text_type"] = "plain"
 	params["request"]["operation"] = opt
 
@@ -314,20 +689,20 @@ func gzipDecompress(input []byte) []byte {
 	b := bytes.NewBuffer(input)
 	r, err := gzip.NewReader(b)
 	if err != nil {
-		fmt.Printf("gzip decompress error: %v\n", err)
+		slog.Warn("Gzip decompress failed", "error", err)
 		return input
 	}
 	defer r.Close()
 	out, err := io.ReadAll(r)
 	if err != nil {
-		fmt.Printf("read decompressed data error: %v\n", err)
+		slog.Warn("Reading decompressed data failed", "error", err)
 		return input
 	}
 	return out
 }
 
 // 解析字节跳动TTS响应
-func parseByteDanceResponse(res []byte) (resp SynthResp, err error) {
+func parseByteDanceResponse(ctx context.Context, res []byte) (resp SynthResp, err error) {
 	if len(res) < 4 {
 		return resp, errors.New("invalid response: too short")
 	}
@@ -385,8 +760,7 @@ func parseByteDanceResponse(res []byte) (resp SynthResp, err error) {
 			errorData = gzipDecompress(errorData)
 		}
 
-		errorMsg := string(errorData)
-		err = fmt.Errorf("server error (code: %d): %s", code, errorMsg)
+		err = &VolcanoError{Code: int(code), Message: string(errorData)}
 
 	case 0xc: // frontend message
 		if len(payload) < 4 {
@@ -401,7 +775,7 @@ func parseByteDanceResponse(res []byte) (resp SynthResp, err error) {
 			frontendPayload = gzipDecompress(frontendPayload)
 		}
 
-		fmt.Printf("Frontend message: %s\n", string(frontendPayload))
+		slog.DebugContext(ctx, "Frontend message", "payload", string(frontendPayload))
 
 	default:
 		err = fmt.Errorf("unknown message type: %d", messageType)
@@ -410,26 +784,64 @@ func parseByteDanceResponse(res []byte) (resp SynthResp, err error) {
 	return resp, err
 }
 
-// 实现流式合成并返回音频数据
-// 注意：voiceType 参数被忽略，实际使用的 voice_type 来自环境变量 BYTEDANCE_TTS_VOICE_TYPE
-func streamSynthesize(text, voiceType string, speed float64) ([]byte, error) {
-	// 明确忽略 voiceType 参数以消除静态分析警告
-	_ = voiceType
+// 上游TTS客户端，对应火山引擎的一种WebSocket协议
+type ttsUpstream interface {
+	// 完成一次合成，每收到一帧音频即交给 onAudio 处理
+	// p.Input 不为nil时边读取增量输入的文本边合成，直到输入结束
+	// ctx 取消时立即关闭或取消上游会话并返回 ErrRequestCancelled
+	synthesize(ctx context.Context, p synthesisParams, onAudio audioHandler) error
+	// 后台维护上游连接
+	run()
+	// 上游连接统计信息
+	stats() map[string]interface{}
+}
 
-	// 获取并发控制信号量
-	select {
-	case semaphore <- struct{}{}:
-		defer func() { <-semaphore }()
-	default:
-		return nil, fmt.Errorf("%w: maximum concurrent calls (%d) reached",
-			ErrTooManyConnections, appConfig.MaxConcurrentCalls)
+// 上游请求路由，在 main 中根据上游地址和账号配置创建
+var upstream *upstreamRouter
+
+// 实现流式合成，每收到一帧音频即交给 onAudio 处理
+func streamSynthesize(ctx context.Context, p synthesisParams, onAudio audioHandler) error {
+	// 获取并发调用名额，名额用尽时排队等待
+	class := callClassFromContext(ctx)
+	_, span := startSpan(ctx, "call_queue.acquire",
+		attribute.String("tts.call_policy", class.policy.Name),
+		attribute.String("tts.priority", class.priority))
+	release, err := callQueue.acquire(ctx)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = synthesizeWithRetry(ctx, p, onAudio)
+	if errors.Is(err, ErrRequestCancelled) {
+		cancelledCalls.Add(1)
 	}
+	return err
+}
+
+// 火山引擎v1 ws_binary 协议客户端
+type v1Upstream struct {
+	pool    *upstreamPool
+	account volcanoAccount
+}
+
+// 后台维护连接池
+func (u *v1Upstream) run() {
+	u.pool.run()
+}
+
+// 连接池统计信息
+func (u *v1Upstream) stats() map[string]interface{} {
+	return u.pool.stats()
+}
 
+// 以单条 submit 消息完成一次合成
+func (u *v1Upstream) synthesize(ctx context.Context, p synthesisParams, onAudio audioHandler) error {
 	// 设置输入参数
-	// 注意：voiceType 参数被忽略，实际使用的 voice_type 来自环境变量 BYTEDANCE_TTS_VOICE_TYPE
-	input, err := setupByteDanceInput(text, optSubmit, speed)
+	input, err := setupByteDanceInput(p, u.account, volcanoReqIDFromContext(ctx), optSubmit)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	input = gzipCompress(input)
@@ -443,92 +855,278 @@ func streamSynthesize(text, voiceType string, speed float64) ([]byte, error) {
 	clientRequest = append(clientRequest, payloadArr...)
 	clientRequest = append(clientRequest, input...)
 
-	// 创建WebSocket连接配置
-	dialer := websocket.Dialer{
-		HandshakeTimeout: appConfig.DialTimeout,
-		ReadBufferSize:   1024 * 1024, // 1MB
-		WriteBufferSize:  1024 * 1024, // 1MB
+	// 获取上游连接，优先复用连接池中的空闲连接
+	conn, reused, err := u.pool.get(ctx)
+	if err != nil {
+		return err
 	}
 
-	// 创建WebSocket连接
-	header := http.Header{"Authorization": []string{fmt.Sprintf("Bearer;%s", appConfig.ByteDanceToken)}}
-	c, _, err := dialer.Dial(byteDanceURL.String(), header)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrWebSocketDialFailed, err)
+	received := false
+	reusable, err := runUpstreamSession(ctx, conn, clientRequest, func(audio []byte) error {
+		received = true
+		return onAudio(audio)
+	})
+
+	// 复用的连接可能已被服务端关闭，尚未收到音频时换一条新连接重试，计入本次合成的上游调用次数
+	if err != nil && reused && !received &&
+		(errors.Is(err, ErrMessageWriteFailed) || errors.Is(err, ErrMessageReadFailed)) &&
+		takeUpstreamAttempt(ctx) {
+		u.pool.discard(conn)
+		conn, err = u.pool.dialConn(ctx)
+		if err != nil {
+			return err
+		}
+		reusable, err = runUpstreamSession(ctx, conn, clientRequest, onAudio)
 	}
 
-	// 设置连接超时
-	c.SetReadDeadline(time.Now().Add(appConfig.ReadTimeout))
-	c.SetWriteDeadline(time.Now().Add(appConfig.WriteTimeout))
+	if reusable {
+		u.pool.put(conn)
+	} else {
+		u.pool.discard(conn)
+	}
+	return err
+}
 
-	defer c.Close()
+// 在一条上游连接上完成一次合成，返回连接是否可以归还连接池
+// ctx 取消时关闭连接，使阻塞的读写立即返回
+func runUpstreamSession(ctx context.Context, c *upstreamConn, clientRequest []byte, onAudio audioHandler) (bool, error) {
+	stop := context.AfterFunc(ctx, c.close)
+	reusable, err := exchangeUpstreamMessages(ctx, c, clientRequest, onAudio)
+	if !stop() {
+		// 连接已因请求取消被关闭
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrRequestCancelled, context.Cause(ctx))
+		}
+		return false, err
+	}
+	return reusable, err
+}
 
+// 发送合成请求并接收音频直到最后一帧
+func exchangeUpstreamMessages(ctx context.Context, c *upstreamConn, clientRequest []byte, onAudio audioHandler) (reusable bool, err error) {
 	// 发送请求
-	err = c.WriteMessage(websocket.BinaryMessage, clientRequest)
+	_, span := startSpan(ctx, "volcano.write_request")
+	err = c.writeMessage(clientRequest, appConfig.WriteTimeout)
+	endSpan(span, err)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrMessageWriteFailed, err)
+		return false, fmt.Errorf("%w: %v", ErrMessageWriteFailed, err)
 	}
 
 	// 接收音频数据
-	var audio []byte
+	spans := startReadSpans(ctx)
+	defer func() { spans.end(err) }()
+	onAudio = spans.wrap(onAudio)
+	received := false
 	for {
-		// 更新读取超时
-		c.SetReadDeadline(time.Now().Add(appConfig.ReadTimeout))
-
-		_, message, err := c.ReadMessage()
+		message, err := c.readMessage(appConfig.ReadTimeout)
 		if err != nil {
-			// 如果是连接关闭错误且已收到一些音频数据，仍然返回已接收的音频
-			if len(audio) > 0 && websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				fmt.Printf("Warning: connection closed with partial audio received: %v\n", err)
-				return audio, nil
+			// 如果是连接关闭错误且已发送一些音频数据，视为合成结束
+			if received && websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				slog.WarnContext(ctx, "Connection closed with partial audio received", "error", err)
+				return false, nil
 			}
-			return nil, fmt.Errorf("%w: %v", ErrMessageReadFailed, err)
+			return false, fmt.Errorf("%w: %v", ErrMessageReadFailed, err)
 		}
 
-		resp, err := parseByteDanceResponse(message)
+		resp, err := parseByteDanceResponse(ctx, message)
 		if err != nil {
-			return nil, fmt.Errorf("%w: %v", ErrResponseParseFailed, err)
+			return false, fmt.Errorf("%w: %w", ErrResponseParseFailed, err)
 		}
 
-		// 添加音频数据
-		audio = append(audio, resp.Audio...)
+		// 立即转发音频数据
+		if len(resp.Audio) > 0 {
+			received = true
+			if err := onAudio(resp.Audio); err != nil {
+				return false, fmt.Errorf("%w: %v", ErrAudioWriteFailed, err)
+			}
+		}
 
-		// 检查是否为最后一条消息
+		// 检查是否为最后一条消息，完整结束的连接可以复用
 		if resp.IsLast {
-			break
+			return true, nil
 		}
 	}
+}
 
-	return audio, nil
+// 错误响应结构
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	// RequestID 请求ID，与响应头 X-Request-ID 一致，反馈问题时提供该ID即可在日志和火山引擎侧找到对应的调用
+	RequestID string `json:"request_id,omitempty"`
 }
 
-// 将OpenAI语音映射到字节跳动语音
-// 注意：此函数的返回值在当前实现中被忽略，仅用于保持接口兼容性
-func mapOpenAIVoiceToByteDance(openAIVoice string) string {
-	// 这里可以根据实际情况添加映射关系
-	// 注意：实际使用的 voice_type 来自环境变量 BYTEDANCE_TTS_VOICE_TYPE
-	voiceMap := map[string]string{
-		"alloy":   "alloy", // 需要根据实际的字节跳动语音ID进行映射
-		"echo":    "echo",
-		"fable":   "fable",
-		"onyx":    "onyx",
-		"nova":    "nova",
-		"shimmer": "shimmer",
+// 根据合成错误类型返回适当的HTTP状态码和错误类型
+func synthesisErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrTextTooLong),
+		errors.Is(err, ErrUnsupportedFormat), errors.Is(err, ErrVoiceNotAllowed):
+		return http.StatusBadRequest, "invalid_request"
+	case errors.Is(err, ErrRequestCancelled):
+		return statusClientClosedRequest, "client_closed_request"
+	case errors.Is(err, ErrTooManyConnections):
+		return http.StatusServiceUnavailable, "service_overloaded"
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, "rate_limit_exceeded"
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusTooManyRequests, "quota_exceeded"
+	case errors.Is(err, ErrWebSocketDialFailed), errors.Is(err, ErrUpstreamUnavailable), isRetryable(err):
+		return http.StatusServiceUnavailable, "upstream_service_unavailable"
+	case errors.Is(err, ErrInvalidAPIKey):
+		return http.StatusUnauthorized, "invalid_api_key"
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized, "unauthorized"
 	}
 
-	if mappedVoice, exists := voiceMap[openAIVoice]; exists {
-		return mappedVoice
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// 根据合成错误类型返回JSON错误响应
+func writeSynthesisError(c *gin.Context, err error) {
+	statusCode, errorType := synthesisErrorStatus(err)
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(limited.retryAfter)))
+	}
+	var exhausted *quotaError
+	if errors.As(err, &exhausted) {
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(time.Until(exhausted.resetAt))))
 	}
+	writeErrorResponse(c, &ErrorResponse{
+		Error:   errorType,
+		Code:    statusCode,
+		Message: err.Error(),
+	})
+}
 
-	// 默认返回alloy
-	return "alloy"
+// 从请求头提取API密钥，移除可能的Bearer前缀
+func extractAPIKey(c *gin.Context) string {
+	apiKey := c.GetHeader("Authorization")
+	if len(apiKey) > 7 && apiKey[:7] == "Bearer " {
+		apiKey = apiKey[7:]
+	}
+	return apiKey
 }
 
-// 错误响应结构
-type ErrorResponse struct {
-	Error   string `json:"error"`
-	Code    int    `json:"code"`
-	Message string `json:"message,omitempty"`
+// 验证客户端API密钥是否拥有 scope 权限，并返回密钥的身份和所属的租户，验证失败时返回错误响应
+// 依次查找密钥库、租户配置文件和 OPENAI_TTS_API_KEY，都不匹配时拒绝请求；
+// 租户配置文件中的密钥和 OPENAI_TTS_API_KEY 拥有 speech 和 voices 权限
+func authenticateAPIKey(apiKey, scope string) (*apiKeyIdentity, *ErrorResponse) {
+	// 验证密钥格式
+	if !isValidAPIKey(apiKey) {
+		return nil, &ErrorResponse{
+			Error:   "invalid_api_key",
+			Code:    http.StatusUnauthorized,
+			Message: "API key format is invalid, must not contain illegal characters",
+		}
+	}
+
+	// 密钥库中的密钥
+	if k, ok := apiKeys.verify(apiKey); ok {
+		if err := k.check(scope, time.Now()); err != nil {
+			return nil, apiKeyErrorResponse(err)
+		}
+		return &apiKeyIdentity{ID: k.ID, Name: k.Name, Tenant: tenants.byName(k.Tenant), Quota: appConfig.QuotaKey.merge(k.Quota)}, nil
+	}
+
+	// 租户配置文件中的密钥和 OPENAI_TTS_API_KEY
+	tenant := tenants.match(apiKey)
+	if tenant == nil && appConfig.OpenAITTSAPIKey != "" &&
+		subtle.ConstantTimeCompare([]byte(apiKey), []byte(appConfig.OpenAITTSAPIKey)) == 1 {
+		tenant = tenants.defaultTenant
+	}
+	if tenant == nil {
+		return nil, &ErrorResponse{
+			Error:   "unauthorized",
+			Code:    http.StatusUnauthorized,
+			Message: "Invalid API key",
+		}
+	}
+	if !slices.Contains(legacyKeyScopes, scope) {
+		return nil, apiKeyErrorResponse(fmt.Errorf("%w: API key does not have the %s scope", ErrInsufficientScope, scope))
+	}
+	return &apiKeyIdentity{ID: hashedAPIKeyID(apiKey), Name: tenant.Name, Tenant: tenant, Quota: appConfig.QuotaKey}, nil
+}
+
+// 将密钥检查错误转换为错误响应
+func apiKeyErrorResponse(err error) *ErrorResponse {
+	if errors.Is(err, ErrInsufficientScope) {
+		return &ErrorResponse{
+			Error:   "insufficient_scope",
+			Code:    http.StatusForbidden,
+			Message: err.Error(),
+		}
+	}
+	return &ErrorResponse{
+		Error:   "unauthorized",
+		Code:    http.StatusUnauthorized,
+		Message: err.Error(),
+	}
+}
+
+// 按租户的设置验证OpenAI TTS请求参数，并转换为合成参数和输出格式
+func prepareSynthesis(t *tenantConfig, req OpenAITTSRequest) (synthesisParams, audioFormat, error) {
+	// 验证请求参数
+	if req.Input == "" {
+		return synthesisParams{}, audioFormat{}, fmt.Errorf("%w: input text cannot be empty", ErrInvalidRequest)
+	}
+
+	// 按字符数验证文本长度，超过单段长度的文本会切分后合成
+	if n := utf8.RuneCountInString(req.Input); n > t.MaxTextLength {
+		return synthesisParams{}, audioFormat{}, fmt.Errorf("%w: text length %d exceeds maximum allowed %d",
+			ErrTextTooLong, n, t.MaxTextLength)
+	}
+
+	switch req.StreamFormat {
+	case "", streamFormatAudio, streamFormatSSE:
+	default:
+		return synthesisParams{}, audioFormat{}, fmt.Errorf("%w: unsupported stream_format %q", ErrInvalidRequest, req.StreamFormat)
+	}
+
+	params, format, err := prepareSynthesisOptions(t, req)
+	if err != nil {
+		return synthesisParams{}, audioFormat{}, err
+	}
+
+	params.Text = req.Input
+	return params, format, nil
+}
+
+// 验证除输入文本以外的请求参数，用于增量文本输入
+func prepareSynthesisOptions(t *tenantConfig, req OpenAITTSRequest) (synthesisParams, audioFormat, error) {
+	if req.Voice == "" {
+		return synthesisParams{}, audioFormat{}, fmt.Errorf("%w: voice parameter cannot be empty", ErrInvalidRequest)
+	}
+
+	// 解析响应格式，默认mp3
+	format, err := lookupAudioFormat(req.ResponseFormat)
+	if err != nil {
+		return synthesisParams{}, audioFormat{}, err
+	}
+
+	speed := req.Speed
+	if speed == 0 {
+		speed = 1.0
+	}
+
+	// 限制速度范围
+	if speed < 0.5 || speed > 2.0 {
+		return synthesisParams{}, audioFormat{}, fmt.Errorf("%w: speed must be between 0.5 and 2.0", ErrInvalidRequest)
+	}
+
+	// 映射语音类型，并验证租户是否可以使用
+	voiceType, err := t.resolveVoice(req.Voice)
+	if err != nil {
+		return synthesisParams{}, audioFormat{}, err
+	}
+
+	return synthesisParams{
+		VoiceType: voiceType,
+		Encoding:  format.Encoding,
+		Speed:     speed,
+		Tenant:    t,
+	}, format, nil
 }
 
 // 处理OpenAI TTS请求的处理函数
@@ -540,7 +1138,7 @@ func handleOpenAITTSRequest(c *gin.Context) {
 	// 验证并发连接数
 	currentConnections := activeConnections.Load()
 	if currentConnections > int32(appConfig.MaxConnections) {
-		c.JSON(http.StatusServiceUnavailable, ErrorResponse{
+		writeErrorResponse(c, &ErrorResponse{
 			Error:   "service_overloaded",
 			Code:    http.StatusServiceUnavailable,
 			Message: fmt.Sprintf("Too many concurrent connections, maximum is %d", appConfig.MaxConnections),
@@ -549,38 +1147,24 @@ func handleOpenAITTSRequest(c *gin.Context) {
 	}
 
 	// API密钥验证
-	apiKey := c.GetHeader("Authorization")
-	// 移除可能的Bearer前缀
-	if len(apiKey) > 7 && apiKey[:7] == "Bearer " {
-		apiKey = apiKey[7:]
-	}
-
-	// 验证密钥格式
-	if !isValidAPIKey(apiKey) {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Error:   "invalid_api_key",
-			Code:    http.StatusUnauthorized,
-			Message: "API key format is invalid, must not contain illegal characters",
-		})
+	apiKey := extractAPIKey(c)
+	identity, errResp := authenticateAPIKey(apiKey, scopeSpeech)
+	if errResp != nil {
+		writeErrorResponse(c, errResp)
 		return
 	}
 
-	// 如果服务器配置了API密钥，则验证客户端密钥是否匹配
-	if appConfig.OpenAITTSAPIKey != "" {
-		if apiKey != appConfig.OpenAITTSAPIKey {
-			c.JSON(http.StatusUnauthorized, ErrorResponse{
-				Error:   "unauthorized",
-				Code:    http.StatusUnauthorized,
-				Message: "Invalid API key",
-			})
-			return
-		}
+	// 按API密钥和优先级调度并发调用名额
+	ctx, err := callContext(c, apiKey, identity)
+	if err != nil {
+		writeSynthesisError(c, err)
+		return
 	}
 
 	// 解析请求体
 	var req OpenAITTSRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
+		writeErrorResponse(c, &ErrorResponse{
 			Error:   "invalid_request",
 			Code:    http.StatusBadRequest,
 			Message: fmt.Sprintf("Invalid request format: %v", err),
@@ -588,113 +1172,172 @@ func handleOpenAITTSRequest(c *gin.Context) {
 		return
 	}
 
-	// 验证请求参数
-	if req.Input == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "invalid_request",
-			Code:    http.StatusBadRequest,
-			Message: "Input text cannot be empty",
-		})
+	// 按租户的设置验证请求参数并转换为合成参数
+	params, format, err := prepareSynthesis(identity.Tenant, req)
+	if err != nil {
+		writeSynthesisError(c, err)
 		return
 	}
 
-	if req.Voice == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "invalid_request",
-			Code:    http.StatusBadRequest,
-			Message: "Voice parameter cannot be empty",
-		})
+	// 选择流式输出方式，音频输出管道在扣除额度前创建，需要转码的格式经过 ffmpeg 后再写出
+	var stream speechStream = &speechAudioStream{c: c, ctx: ctx, format: format}
+	if req.StreamFormat == streamFormatSSE {
+		stream = &speechEventStream{c: c, ctx: ctx, params: params}
+	}
+	pipeline, err := newAudioPipeline(format, stream.writeAudio)
+	if err != nil {
+		writeSynthesisError(c, err)
 		return
 	}
 
-	// 设置默认值
-	responseFormat := req.ResponseFormat
-	if responseFormat == "" {
-		responseFormat = "mp3"
+	// 扣除输入字符数的限流额度
+	err = takeRateLimit(ctx, 0, utf8.RuneCountInString(params.Text))
+	setRateLimitHeaders(c)
+	if err != nil {
+		pipeline.Abort()
+		writeSynthesisError(c, err)
+		return
 	}
 
-	speed := req.Speed
-	if speed == 0 {
-		speed = 1.0
+	// 在调用火山引擎之前扣除配额，合成失败且没有返回音频时退还
+	quota, err := reserveQuota(ctx, 1, utf8.RuneCountInString(params.Text))
+	if err != nil {
+		pipeline.Abort()
+		writeSynthesisError(c, err)
+		return
 	}
 
-	// 限制速度范围
-	if speed < 0.5 || speed > 2.0 {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error:   "invalid_request",
-			Code:    http.StatusBadRequest,
-			Message: "Speed must be between 0.5 and 2.0",
-		})
-		return
+	// 查找音频缓存，缓存状态在写出音频前即可确定
+	cacheStatus, cacheKey, synthesize := cachedSynthesis(ctx, params)
+	synthesize = quota.settle(meteredSynthesis(ctx, usageEndpointSpeech, params, format, cacheStatus, synthesize))
+	c.Header("X-Cache", cacheStatus)
+	if cacheKey != "" {
+		c.Header("X-Cache-Key", cacheKey)
 	}
 
-	// 映射语音类型（注意：此参数在实际调用中被忽略，仅用于保持接口兼容性）
-	// 实际使用的 voice_type 来自环境变量 BYTEDANCE_TTS_VOICE_TYPE
-	byteDanceVoice := mapOpenAIVoiceToByteDance(req.Voice)
+	// 创建流式合成，每帧音频到达后立即写出并刷新，长文本切分后按顺序输出
+	err = synthesize(pipeline.Write)
+	if err != nil {
+		pipeline.Abort()
+	} else {
+		err = pipeline.Close()
+	}
+	stream.finish(err)
+}
 
-	// 设置响应头
-	c.Header("Content-Type", "audio/mpeg")
-	c.Header("Transfer-Encoding", "chunked")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("X-Content-Type-Options", "nosniff")
+// 语音合成接口的响应输出方式
+type speechStream interface {
+	// 写出一段（转码后的）音频
+	writeAudio(audio []byte) error
+	// 合成结束后完成响应，err 为合成或转码的错误
+	finish(err error)
+}
 
-	// 创建流式合成并返回数据
-	// 注意：byteDanceVoice 参数在 streamSynthesize 中被忽略
-	audioData, err := streamSynthesize(req.Input, byteDanceVoice, speed)
-	if err != nil {
-		// 根据错误类型返回适当的HTTP状态码
-		statusCode := http.StatusInternalServerError
-		errorType := "internal_error"
-
-		// 处理已知错误类型
-		switch {
-		case errors.Is(err, ErrTextTooLong):
-			statusCode = http.StatusBadRequest
-			errorType = "invalid_request"
-		case errors.Is(err, ErrTooManyConnections):
-			statusCode = http.StatusServiceUnavailable
-			errorType = "service_overloaded"
-		case errors.Is(err, ErrWebSocketDialFailed):
-			statusCode = http.StatusServiceUnavailable
-			errorType = "upstream_service_unavailable"
-		case errors.Is(err, ErrInvalidAPIKey):
-			statusCode = http.StatusUnauthorized
-			errorType = "invalid_api_key"
-		case errors.Is(err, ErrUnauthorized):
-			statusCode = http.StatusUnauthorized
-			errorType = "unauthorized"
-		}
+// 直接输出音频字节流的响应
+type speechAudioStream struct {
+	c       *gin.Context
+	ctx     context.Context
+	format  audioFormat
+	started bool
+}
 
-		c.JSON(statusCode, ErrorResponse{
-			Error:   errorType,
-			Code:    statusCode,
-			Message: err.Error(),
-		})
+// 写出响应头，收到第一帧音频时才写出，以便在此之前仍可返回JSON错误
+func (s *speechAudioStream) start() {
+	if s.started {
 		return
 	}
+	s.started = true
+	s.c.Header("Content-Type", s.format.ContentType)
+	s.c.Header("Transfer-Encoding", "chunked")
+	s.c.Header("Cache-Control", "no-cache")
+	s.c.Header("Connection", "keep-alive")
+	s.c.Header("X-Content-Type-Options", "nosniff")
+	s.c.Header("Trailer", streamErrorTrailer)
+	s.c.Status(http.StatusOK)
+}
 
-	// 写入音频数据
-	_, err = c.Writer.Write(audioData)
+func (s *speechAudioStream) writeAudio(audio []byte) error {
+	s.start()
+	if _, err := s.c.Writer.Write(audio); err != nil {
+		return err
+	}
+	s.c.Writer.Flush()
+	return nil
+}
+
+func (s *speechAudioStream) finish(err error) {
+	c := s.c
 	if err != nil {
-		fmt.Printf("Error writing audio data: %v\n", err)
+		// 已开始发送音频，无法再修改状态码：通过trailer报告错误并截断响应流
+		if s.started {
+			_, errorType := synthesisErrorStatus(err)
+			setErrorType(c, errorType)
+			c.Writer.Header().Set(streamErrorTrailer, err.Error())
+			slog.ErrorContext(s.ctx, "Error streaming audio data", "error", err)
+			return
+		}
+
+		writeSynthesisError(c, err)
 		return
 	}
 
-	// 刷新缓冲区
+	// 没有收到任何音频时也返回空的音频响应
+	s.start()
 	c.Writer.Flush()
 }
 
+// 返回租户可以使用的语音：语音别名及其对应的火山引擎语音、语音白名单和默认语音
+// allowed 为空表示不限制火山引擎语音
+func handleListVoices(c *gin.Context) {
+	identity, errResp := authenticateAPIKey(extractAPIKey(c), scopeVoices)
+	if errResp != nil {
+		writeErrorResponse(c, errResp)
+		return
+	}
+	tenant := identity.Tenant
+
+	aliases := make(map[string]string, len(voiceCatalog.Aliases))
+	for alias, voiceType := range voiceCatalog.Aliases {
+		if tenant.voiceAllowed(voiceType) {
+			aliases[alias] = voiceType
+		}
+	}
+	allowed := voiceCatalog.Allowed
+	if len(tenant.AllowedVoices) > 0 {
+		allowed = make([]string, 0, len(tenant.AllowedVoices))
+		for _, voiceType := range tenant.AllowedVoices {
+			if voiceCatalog.isAllowed(voiceType) {
+				allowed = append(allowed, voiceType)
+			}
+		}
+	}
+	if allowed == nil {
+		allowed = []string{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"default_voice": tenant.DefaultVoice,
+		"aliases":       aliases,
+		"allowed":       allowed,
+	})
+}
+
 // 健康检查端点
 func healthCheck(c *gin.Context) {
 	// 获取当前活动连接数
 	activeConns := activeConnections.Load()
 
 	// 获取当前并发调用数
-	currentCalls := len(semaphore)
+	currentCalls := callQueue.active()
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":               "ok",
+	// 有上游地址的熔断器未关闭时服务降级
+	status := "ok"
+	if !upstream.healthy() {
+		status = "degraded"
+	}
+
+	health := gin.H{
+		"status":               status,
 		"timestamp":            time.Now().Unix(),
 		"timestamp_iso":        time.Now().Format(time.RFC3339),
 		"service":              "TTS-Transit-Service",
@@ -704,11 +1347,30 @@ func healthCheck(c *gin.Context) {
 		"current_calls":        currentCalls,
 		"max_concurrent_calls": appConfig.MaxConcurrentCalls,
 		"uptime_seconds":       int(time.Since(startTime).Seconds()),
-	})
+		"call_queue":           callQueue.stats(),
+		"cancelled_calls":      cancelledCalls.Load(),
+		"upstream_retries":     upstreamRetry.stats(),
+		"upstream_protocol":    appConfig.ByteDanceProtocol,
+		"upstream":             upstream.stats(),
+	}
+	if requestLimiter != nil {
+		health["rate_limit"] = requestLimiter.stats()
+	}
+	if usageRecorder != nil {
+		health["usage"] = usageRecorder.stats()
+	}
+	health["quota"] = quotas.stats()
+	c.JSON(http.StatusOK, health)
 }
 
 // 设置路由
 func setupRoutes(router *gin.Engine) {
+	// 为每个请求创建追踪span，并接受客户端传入的 traceparent
+	router.Use(tracingMiddleware())
+
+	// 按路由、状态码和错误类型统计请求数
+	router.Use(metricsMiddleware)
+
 	// 添加请求大小限制中间件
 	router.Use(gin.HandlerFunc(func(c *gin.Context) {
 		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(appConfig.MaxRequestSizeMB)*1024*1024)
@@ -719,7 +1381,8 @@ func setupRoutes(router *gin.Engine) {
 	router.Use(gin.HandlerFunc(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, "+priorityHeader+", "+requestIDHeader)
+		c.Header("Access-Control-Expose-Headers", requestIDHeader)
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusOK)
@@ -732,8 +1395,37 @@ func setupRoutes(router *gin.Engine) {
 	// 健康检查端点
 	router.GET("/health", healthCheck)
 
+	// Prometheus 指标端点
+	router.GET("/metrics", handleMetrics)
+
+	// 客户端端点按API密钥和客户端IP限流
+	api := router.Group("", rateLimit)
+
 	// OpenAI TTS API兼容端点
-	router.POST("/v1/audio/speech", handleOpenAITTSRequest)
+	api.POST("/v1/audio/speech", handleOpenAITTSRequest)
+
+	// 增量文本输入端点
+	api.POST("/v1/audio/speech/stream", handleOpenAITTSStreamInput)
+
+	// WebSocket TTS端点
+	api.GET("/tts/websocket", handleTTSWebSocket)
+
+	// 可用语音列表
+	api.GET("/v1/voices", handleListVoices)
+
+	// 管理端点
+	admin := router.Group("/admin", adminAuth)
+	admin.GET("/cache", handleCacheStats)
+	admin.DELETE("/cache", handleCachePurge)
+	admin.DELETE("/cache/:key", handleCachePurgeKey)
+	admin.GET("/keys", handleListAPIKeys)
+	admin.POST("/keys", handleCreateAPIKey)
+	admin.PATCH("/keys/:id", handleUpdateAPIKey)
+	admin.POST("/keys/:id/rotate", handleRotateAPIKey)
+	admin.DELETE("/keys/:id", handleRevokeAPIKey)
+	admin.GET("/keys/:id/quota", handleGetAPIKeyQuota)
+	admin.DELETE("/keys/:id/quota", handleResetAPIKeyQuota)
+	admin.GET("/usage", handleUsageReport)
 }
 
 // 主函数
@@ -741,13 +1433,103 @@ func main() {
 	// 验证配置
 	err := appConfig.ValidateConfig()
 	if err != nil {
-		fmt.Printf("Configuration validation failed: %v\n", err)
-		fmt.Println("Please set the missing environment variables before starting the service.")
-		fmt.Println("Example usage:")
-		fmt.Println("  BYTEDANCE_TTS_APP_ID=your_app_id BYTEDANCE_TTS_BEARER_TOKEN=your_token BYTEDANCE_TTS_CLUSTER=your_cluster BYTEDANCE_TTS_VOICE_TYPE=your_voice_type ./tts_websocket_server")
-		os.Exit(1)
+		fatal("Configuration validation failed", err,
+			"hint", "set the missing environment variables before starting the service",
+			"example", "BYTEDANCE_TTS_APP_ID=your_app_id BYTEDANCE_TTS_BEARER_TOKEN=your_token BYTEDANCE_TTS_CLUSTER=your_cluster BYTEDANCE_TTS_VOICE_TYPE=your_voice_type ./tts_websocket_server")
+	}
+
+	// 初始化日志
+	initLogging()
+
+	// 加载语音目录
+	voiceCatalog, err = LoadVoiceCatalog(appConfig.VoiceCatalogFile)
+	if err != nil {
+		fatal("Failed to load voice catalog", err)
+	}
+
+	// 加载调度策略
+	callPolicies, err = LoadCallPolicies(appConfig.CallPolicyFile)
+	if err != nil {
+		fatal("Failed to load call policies", err)
 	}
 
+	// 加载火山引擎账号
+	accounts, err := LoadVolcanoAccounts(appConfig.AccountsFile)
+	if err != nil {
+		fatal("Failed to load Volcano accounts", err)
+	}
+	accountPool := newAccountPool(accounts, appConfig.AccountCooldown)
+	if capacity := accountPool.capacity(); capacity < appConfig.MaxConcurrentCalls {
+		slog.Warn("Volcano accounts allow fewer concurrent calls in total than MAX_CONCURRENT_CALLS",
+			"capacity", capacity, "max_concurrent_calls", appConfig.MaxConcurrentCalls)
+	}
+
+	// 初始化上游TTS客户端
+	targets, _ := appConfig.upstreamTargets()
+	upstream = newUpstreamRouter(targets, accountPool, upstreamPoolConfig{
+		MinIdle:      appConfig.UpstreamPoolMinIdle,
+		MaxSize:      appConfig.UpstreamPoolMaxSize,
+		IdleTimeout:  appConfig.UpstreamPoolIdleTimeout,
+		PingInterval: appConfig.UpstreamPoolPingInterval,
+	}, breakerConfig{
+		FailureThreshold: appConfig.BreakerFailureThreshold,
+		OpenDuration:     appConfig.BreakerOpenDuration,
+		LatencyThreshold: appConfig.BreakerLatencyThreshold,
+	})
+
+	// 加载租户配置
+	tenants, err = LoadTenants(appConfig.TenantsFile, accounts, targets)
+	if err != nil {
+		fatal("Failed to load tenants", err)
+	}
+
+	// 加载客户端密钥库
+	apiKeys, err = LoadAPIKeyStore(appConfig.APIKeyStoreFile)
+	if err != nil {
+		fatal("Failed to load API key store", err)
+	}
+	if apiKeys.len() == 0 && !tenants.hasKeys() && appConfig.OpenAITTSAPIKey == "" {
+		slog.Warn("No client API keys configured, all synthesis requests will be rejected until keys are created via the admin API")
+	}
+
+	// 加载配额计数
+	quotas, err = LoadQuotaStore(appConfig.QuotaStateFile)
+	if err != nil {
+		fatal("Failed to load quota state", err)
+	}
+	go quotas.run(appConfig.QuotaFlushInterval)
+
+	// 检查本地转码是否可用
+	if path, err := exec.LookPath(appConfig.FFmpegPath); err == nil {
+		ffmpegPath = path
+	} else {
+		slog.Warn("ffmpeg not found, aac and flac response formats are disabled", "error", err)
+	}
+
+	// 创建音频缓存
+	if appConfig.CacheMemoryMaxMB > 0 || appConfig.CacheDir != "" {
+		synthesisCache, err = newAudioCache(audioCacheConfig{
+			MemoryMaxBytes: int64(appConfig.CacheMemoryMaxMB) * 1024 * 1024,
+			Dir:            appConfig.CacheDir,
+			DiskMaxBytes:   int64(appConfig.CacheDiskMaxMB) * 1024 * 1024,
+			TTL:            appConfig.CacheTTL,
+		})
+		if err != nil {
+			fatal("Failed to create audio cache", err)
+		}
+	}
+
+	// 打开用量日志
+	if appConfig.UsageLogFile != "" {
+		usageRecorder, err = openUsageLog(appConfig.UsageLogFile)
+		if err != nil {
+			fatal("Failed to open usage log", err)
+		}
+	}
+
+	// 启动上游连接维护
+	go upstream.run()
+
 	// 设置Gin模式
 	if appConfig.LogLevel == "debug" {
 		gin.SetMode(gin.DebugMode)
@@ -755,11 +1537,31 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// 初始化追踪
+	if err := initTracing(context.Background()); err != nil {
+		fatal("Failed to initialize tracing", err)
+	}
+
+	// 创建限流器
+	requestLimiter = newRateLimiter(appConfig.RateLimitKey, appConfig.RateLimitIP)
+
 	// 创建Gin路由器
 	router := gin.New()
 
+	// 只信任配置的反向代理转发的客户端IP
+	var trustedProxies []string
+	if appConfig.TrustedProxies != "" {
+		trustedProxies = strings.Split(appConfig.TrustedProxies, ",")
+		for i := range trustedProxies {
+			trustedProxies[i] = strings.TrimSpace(trustedProxies[i])
+		}
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		fatal("Invalid TRUSTED_PROXIES", err)
+	}
+
 	// 添加日志和恢复中间件
-	router.Use(gin.Logger())
+	router.Use(requestLogger)
 	router.Use(gin.Recovery())
 
 	// 设置路由
@@ -767,20 +1569,66 @@ func main() {
 
 	// 启动服务器
 	serverAddr := fmt.Sprintf("%s:%s", appConfig.ServerHost, appConfig.ServerPort)
-	fmt.Printf("Starting TTS Transit Service on %s\n", serverAddr)
-	fmt.Printf("Health check: http://%s/health\n", serverAddr)
-	fmt.Printf("TTS endpoint: http://%s/v1/audio/speech\n", serverAddr)
-	fmt.Printf("Configuration:\n")
-	fmt.Printf("  - Max Connections: %d\n", appConfig.MaxConnections)
-	fmt.Printf("  - Max Concurrent Calls: %d\n", appConfig.MaxConcurrentCalls)
-	fmt.Printf("  - Max Text Length: %d characters\n", appConfig.MaxTextLength)
-	fmt.Printf("  - Read Timeout: %v\n", appConfig.ReadTimeout)
-	fmt.Printf("  - Write Timeout: %v\n", appConfig.WriteTimeout)
-	fmt.Printf("  - Dial Timeout: %v\n", appConfig.DialTimeout)
-
-	err = router.Run(serverAddr)
-	if err != nil {
-		fmt.Printf("Failed to start server: %v\n", err)
-		os.Exit(1)
+	slog.Info("Starting TTS Transit Service",
+		"addr", serverAddr,
+		"health", fmt.Sprintf("http://%s/health", serverAddr),
+		"metrics", fmt.Sprintf("http://%s/metrics", serverAddr),
+		"tts_endpoint", fmt.Sprintf("http://%s/v1/audio/speech", serverAddr),
+		"websocket_endpoint", fmt.Sprintf("ws://%s/tts/websocket", serverAddr))
+	config := []any{
+		"max_connections", appConfig.MaxConnections,
+		"max_concurrent_calls", appConfig.MaxConcurrentCalls,
+		"max_text_length", appConfig.MaxTextLength,
+		"max_segment_length", appConfig.MaxSegmentLength,
+		"read_timeout", appConfig.ReadTimeout,
+		"write_timeout", appConfig.WriteTimeout,
+		"dial_timeout", appConfig.DialTimeout,
+		"upstream_protocol", appConfig.ByteDanceProtocol,
+		"upstream_endpoints", len(upstream.endpoints),
+		"volcano_accounts", len(accounts),
+		"upstream_pool_min_idle", appConfig.UpstreamPoolMinIdle,
+		"upstream_pool_max_size", appConfig.UpstreamPoolMaxSize,
+		"voice_aliases", len(voiceCatalog.Aliases),
+		"tenants", len(tenants.Tenants),
+		"api_keys", apiKeys.len(),
+		"log_level", appConfig.LogLevel,
+	}
+	if requestLimiter != nil {
+		config = append(config, "rate_limit_per_key", appConfig.RateLimitKey, "rate_limit_per_ip", appConfig.RateLimitIP)
+	}
+	if appConfig.OTLPEndpoint != "" {
+		config = append(config, "tracing", appConfig.OTLPEndpoint, "trace_sample_ratio", appConfig.TraceSampleRatio)
+	}
+	if !appConfig.QuotaKey.unlimited() {
+		config = append(config, "quota_per_key", appConfig.QuotaKey)
+	}
+	slog.Info("Configuration", config...)
+
+	// 收到 SIGINT 或 SIGTERM 时停止接受新请求，等待进行中的请求结束后保存配额计数再退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: serverAddr, Handler: router}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		fatal("Failed to start server", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("Shutting down", "timeout", appConfig.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), appConfig.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Server did not shut down cleanly", "error", err)
+	}
+	if err := quotas.flush(); err != nil {
+		slog.Error("Failed to save quota state", "error", err)
 	}
+	slog.Info("Server stopped")
 }
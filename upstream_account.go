@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 火山引擎账号凭据和调用限制
+type volcanoAccount struct {
+	// Name 账号名称，用于日志和统计信息
+	Name string `json:"name"`
+	// AppID 火山引擎 App ID，v3 协议的 X-Api-App-Key
+	AppID string `json:"app_id"`
+	// Token 火山引擎认证令牌，v3 协议的 X-Api-Access-Key
+	Token string `json:"token"`
+	// Cluster v1 协议使用的集群，默认 BYTEDANCE_TTS_CLUSTER
+	Cluster string `json:"cluster,omitempty"`
+	// ResourceID v3 协议使用的资源ID，默认 BYTEDANCE_TTS_RESOURCE_ID
+	ResourceID string `json:"resource_id,omitempty"`
+	// MaxConcurrent 该账号的并发调用上限，默认 MAX_CONCURRENT_CALLS
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// Weight 分配调用时的权重，默认1
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// 账号在指定上游地址上使用的凭据，地址指定的集群或资源ID优先
+func (a volcanoAccount) forTarget(t upstreamTarget) volcanoAccount {
+	if t.Cluster != "" {
+		a.Cluster = t.Cluster
+	}
+	if t.Resource != "" {
+		a.ResourceID = t.Resource
+	}
+	return a
+}
+
+// 日志中只输出账号名称和 App ID，不输出令牌
+func (a volcanoAccount) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("name", a.Name), slog.String("app_id", a.AppID))
+}
+
+// VolcanoAccounts 账号配置文件
+type VolcanoAccounts struct {
+	Accounts []volcanoAccount `json:"accounts"`
+}
+
+// LoadVolcanoAccounts 从JSON配置文件加载火山引擎账号，路径为空时使用环境变量配置的单个账号
+func LoadVolcanoAccounts(path string) ([]volcanoAccount, error) {
+	if path == "" {
+		return []volcanoAccount{{
+			Name:       "default",
+			AppID:      appConfig.ByteDanceAppID,
+			Token:      appConfig.ByteDanceToken,
+			Cluster:    appConfig.ByteDanceCluster,
+			ResourceID: appConfig.ByteDanceResource,
+		}}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account file: %w", err)
+	}
+	var cfg VolcanoAccounts
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse account file: %w", err)
+	}
+	if len(cfg.Accounts) == 0 {
+		return nil, fmt.Errorf("account file must contain at least one account")
+	}
+
+	names := make(map[string]bool)
+	for i := range cfg.Accounts {
+		a := &cfg.Accounts[i]
+		if a.Name == "" {
+			a.Name = fmt.Sprintf("account-%d", i+1)
+		}
+		if names[a.Name] {
+			return nil, fmt.Errorf("duplicate account name %q", a.Name)
+		}
+		names[a.Name] = true
+
+		if a.AppID == "" || a.Token == "" {
+			return nil, fmt.Errorf("account %s: app_id and token are required", a.Name)
+		}
+		if a.Cluster == "" && appConfig.ByteDanceCluster != "xxxx" {
+			a.Cluster = appConfig.ByteDanceCluster
+		}
+		if a.Cluster == "" && appConfig.ByteDanceProtocol == protocolV1 {
+			return nil, fmt.Errorf("account %s: cluster is required when BYTEDANCE_TTS_CLUSTER is not set", a.Name)
+		}
+		if a.ResourceID == "" {
+			a.ResourceID = appConfig.ByteDanceResource
+		}
+		if a.MaxConcurrent < 0 || a.Weight < 0 {
+			return nil, fmt.Errorf("account %s: max_concurrent and weight must not be negative", a.Name)
+		}
+		registerSecrets("account "+a.Name, a.Token)
+	}
+
+	return cfg.Accounts, nil
+}
+
+// 与账号有关的火山引擎错误码，换用其他账号可能成功；值为 true 的错误码表示账号本身不可用，需要冷却
+// v1 协议和 V3 协议经过同一个网关鉴权和计量，连接建立后以错误帧（v1）或 SessionFailed、ConnectionFailed 事件（V3）
+// 返回的鉴权和配额错误码相同
+var accountVolcanoCodes = map[int]bool{
+	3003:     false, // v1 协议账号并发超限，是临时的，不冷却
+	45000010: true,  // 鉴权失败：App ID 或令牌无效
+	45000030: true,  // 资源未开通：账号没有 cluster 或 resource_id 的使用权限
+	45000292: true,  // 配额用尽：账号的调用量或字符数超过额度
+}
+
+// 鉴权失败、资源未开通、配额用尽或账号并发超限，换用其他账号可能成功
+func isAccountError(err error) bool {
+	if errors.Is(err, ErrUpstreamAuthFailed) {
+		return true
+	}
+	var volcErr *VolcanoError
+	if !errors.As(err, &volcErr) {
+		return false
+	}
+	_, ok := accountVolcanoCodes[volcErr.Code]
+	return ok
+}
+
+// 账号本身不可用，需要冷却：握手返回 401/403，或连接建立后返回鉴权、资源未开通和配额用尽的错误码
+// 并发超限是临时的，只换用其他账号，不冷却
+func needsCooldown(err error) bool {
+	if errors.Is(err, ErrUpstreamAuthFailed) {
+		return true
+	}
+	var volcErr *VolcanoError
+	return errors.As(err, &volcErr) && accountVolcanoCodes[volcErr.Code]
+}
+
+// 账号的运行状态
+type accountState struct {
+	index   int // 在账号列表中的位置，也是各地址客户端列表中的位置
+	account volcanoAccount
+
+	// 以下字段由 accountPool 的锁保护
+	inUse        int
+	coolingUntil time.Time // 冷却结束时间，冷却期间不分配调用
+	calls        int64     // 分配到该账号的调用次数
+	succeeded    int64     // 成功的调用次数
+	failed       int64     // 失败的调用次数
+	characters   int64     // 成功合成的字符数
+	cooldowns    int64     // 进入冷却的次数
+	lastError    string    // 最近一次账号错误
+}
+
+// 火山引擎账号池
+// 按权重把调用分配给负载最低的账号，每个账号的并发调用数不超过其 max_concurrent；
+// 返回配额或鉴权错误的账号冷却一段时间
+type accountPool struct {
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	accounts []*accountState
+}
+
+// 创建账号池，补全并发上限和权重的默认值
+func newAccountPool(accounts []volcanoAccount, cooldown time.Duration) *accountPool {
+	ap := &accountPool{cooldown: cooldown}
+	for i, a := range accounts {
+		if a.MaxConcurrent == 0 {
+			a.MaxConcurrent = appConfig.MaxConcurrentCalls
+		}
+		if a.Weight == 0 {
+			a.Weight = 1
+		}
+		ap.accounts = append(ap.accounts, &accountState{index: i, account: a})
+	}
+	return ap
+}
+
+// 账号池的并发上限之和
+func (ap *accountPool) capacity() int {
+	total := 0
+	for _, s := range ap.accounts {
+		total += s.account.MaxConcurrent
+	}
+	return total
+}
+
+// 为租户的一次调用分配账号，跳过租户不能使用的账号和 tried 中已经失败的账号，返回释放账号名额的函数
+// 优先选择不在冷却中的账号；所有账号都在冷却时使用冷却最早结束的账号，不让单账号部署完全不可用
+func (ap *accountPool) acquire(t *tenantConfig, tried map[int]bool) (*accountState, func(), error) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	now := time.Now()
+	var best, cooling *accountState
+	available := false // 是否有不在冷却中的账号，无论是否还有并发名额
+	for _, s := range ap.accounts {
+		if tried[s.index] || !t.accountAllowed(s.account.Name) {
+			continue
+		}
+		if now.Before(s.coolingUntil) {
+			if s.inUse < s.account.MaxConcurrent && (cooling == nil || s.coolingUntil.Before(cooling.coolingUntil)) {
+				cooling = s
+			}
+			continue
+		}
+		available = true
+		if s.inUse >= s.account.MaxConcurrent {
+			continue
+		}
+		// 加入本次调用后的负载越低越优先
+		if best == nil || float64(s.inUse+1)/s.account.Weight < float64(best.inUse+1)/best.account.Weight {
+			best = s
+		}
+	}
+	if best == nil && !available {
+		best = cooling
+	}
+	if best == nil {
+		if available {
+			return nil, nil, fmt.Errorf("%w: all Volcano accounts are at their concurrency limit", ErrTooManyConnections)
+		}
+		return nil, nil, fmt.Errorf("%w: no Volcano account left to try", ErrUpstreamUnavailable)
+	}
+
+	best.inUse++
+	best.calls++
+	var once sync.Once
+	return best, func() {
+		once.Do(func() {
+			ap.mu.Lock()
+			defer ap.mu.Unlock()
+			best.inUse--
+		})
+	}, nil
+}
+
+// 记录一次调用的结果，账号不可用时开始冷却
+func (ap *accountPool) record(ctx context.Context, s *accountState, p synthesisParams, err error) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	switch {
+	case err == nil:
+		s.succeeded++
+		if p.Input != nil {
+			s.characters += int64(p.Input.characters())
+		} else {
+			s.characters += int64(utf8.RuneCountInString(p.Text))
+		}
+	case needsCooldown(err):
+		s.failed++
+		s.lastError = err.Error()
+		s.coolingUntil = time.Now().Add(ap.cooldown)
+		s.cooldowns++
+		slog.WarnContext(ctx, "Volcano account is cooling down", "account", s.account.Name, "cooldown", ap.cooldown, "error", err)
+	case errors.Is(err, ErrRequestCancelled):
+	default:
+		s.failed++
+	}
+}
+
+// 各账号的使用情况，不包含凭据
+func (ap *accountPool) stats() []map[string]interface{} {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]map[string]interface{}, 0, len(ap.accounts))
+	for _, s := range ap.accounts {
+		account := map[string]interface{}{
+			"name":           s.account.Name,
+			"weight":         s.account.Weight,
+			"max_concurrent": s.account.MaxConcurrent,
+			"in_use":         s.inUse,
+			"calls":          s.calls,
+			"succeeded":      s.succeeded,
+			"failed":         s.failed,
+			"characters":     s.characters,
+			"cooldowns":      s.cooldowns,
+		}
+		if now.Before(s.coolingUntil) {
+			account["cooldown_remaining_ms"] = s.coolingUntil.Sub(now).Milliseconds()
+		}
+		if s.lastError != "" {
+			account["last_error"] = s.lastError
+		}
+		stats = append(stats, account)
+	}
+	return stats
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAccountPoolAcquire(t *testing.T) {
+	type accountSetup struct {
+		weight  float64
+		max     int
+		inUse   int
+		cooling time.Duration // 剩余冷却时间，0 表示不在冷却中
+	}
+	tests := []struct {
+		name     string
+		accounts []accountSetup
+		tenant   []string // 租户可以使用的账号，为空表示全部
+		tried    map[int]bool
+		want     int
+		wantErr  error
+	}{
+		{
+			name:     "least loaded account",
+			accounts: []accountSetup{{weight: 1, max: 4, inUse: 2}, {weight: 1, max: 4, inUse: 1}},
+			want:     1,
+		},
+		{
+			name:     "weight scales the load",
+			accounts: []accountSetup{{weight: 1, max: 4, inUse: 1}, {weight: 3, max: 4, inUse: 2}},
+			want:     1,
+		},
+		{
+			name:     "account at its concurrency limit is skipped",
+			accounts: []accountSetup{{weight: 1, max: 1, inUse: 1}, {weight: 1, max: 4, inUse: 3}},
+			want:     1,
+		},
+		{
+			name:     "tried account is skipped",
+			accounts: []accountSetup{{weight: 1, max: 4}, {weight: 1, max: 4, inUse: 2}},
+			tried:    map[int]bool{0: true},
+			want:     1,
+		},
+		{
+			name:     "account outside the tenant is skipped",
+			accounts: []accountSetup{{weight: 1, max: 4}, {weight: 1, max: 4, inUse: 3}},
+			tenant:   []string{"account-1"},
+			want:     1,
+		},
+		{
+			name:     "cooling account is skipped",
+			accounts: []accountSetup{{weight: 1, max: 4, cooling: time.Minute}, {weight: 1, max: 4, inUse: 3}},
+			want:     1,
+		},
+		{
+			name:     "all cooling uses the one that recovers first",
+			accounts: []accountSetup{{weight: 1, max: 4, cooling: time.Hour}, {weight: 1, max: 4, cooling: time.Minute}},
+			want:     1,
+		},
+		{
+			name:     "all available accounts busy",
+			accounts: []accountSetup{{weight: 1, max: 1, inUse: 1}, {weight: 1, max: 4, cooling: time.Minute}},
+			wantErr:  ErrTooManyConnections,
+		},
+		{
+			name:     "every account tried",
+			accounts: []accountSetup{{weight: 1, max: 4}, {weight: 1, max: 4}},
+			tried:    map[int]bool{0: true, 1: true},
+			wantErr:  ErrUpstreamUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var accounts []volcanoAccount
+			for i, a := range tt.accounts {
+				accounts = append(accounts, volcanoAccount{Name: fmt.Sprintf("account-%d", i), Weight: a.weight, MaxConcurrent: a.max})
+			}
+			ap := newAccountPool(accounts, time.Minute)
+			for i, a := range tt.accounts {
+				ap.accounts[i].inUse = a.inUse
+				if a.cooling > 0 {
+					ap.accounts[i].coolingUntil = time.Now().Add(a.cooling)
+				}
+			}
+
+			tenant := &tenantConfig{Name: "test", DefaultVoice: "BV001_streaming", Accounts: tt.tenant}
+			if err := tenant.init(map[string]struct{}{"account-0": {}, "account-1": {}}); err != nil {
+				t.Fatal(err)
+			}
+
+			s, release, err := ap.acquire(tenant, tt.tried)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("acquire() err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if s.index != tt.want {
+				t.Errorf("acquire() = account %d, want %d", s.index, tt.want)
+			}
+			inUse := s.inUse
+			release()
+			release() // 重复释放只生效一次
+			if s.inUse != inUse-1 {
+				t.Errorf("inUse after release = %d, want %d", s.inUse, inUse-1)
+			}
+		})
+	}
+}
+
+func TestAccountPoolCooldown(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCooling bool
+		wantFailed  int64
+	}{
+		{name: "success", err: nil},
+		{name: "authentication failure", err: fmt.Errorf("%w: bad token", ErrUpstreamAuthFailed), wantCooling: true, wantFailed: 1},
+		{name: "v1 concurrency limit is not cooled down", err: &VolcanoError{Code: 3003, Message: "concurrency exceeded"}, wantFailed: 1},
+		{name: "v1 quota error frame", err: &VolcanoError{Code: 45000292, Message: "quota exceeded"}, wantCooling: true, wantFailed: 1},
+		{name: "v3 session failed with auth error", err: v3Frame{event: v3EventSessionFailed, payload: []byte(`{"status_code":45000010,"message":"invalid token"}`)}.err(), wantCooling: true, wantFailed: 1},
+		{name: "invalid text", err: &VolcanoError{Code: 3011, Message: "invalid text"}, wantFailed: 1},
+		{name: "cancelled", err: ErrRequestCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ap := newAccountPool([]volcanoAccount{{Name: "a", MaxConcurrent: 1}, {Name: "b", MaxConcurrent: 1}}, time.Minute)
+			s, release, err := ap.acquire(tenants.defaultTenant, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+			ap.record(context.Background(), s, synthesisParams{Text: "你好"}, tt.err)
+
+			if cooling := time.Now().Before(s.coolingUntil); cooling != tt.wantCooling {
+				t.Errorf("cooling = %v, want %v", cooling, tt.wantCooling)
+			}
+			if s.failed != tt.wantFailed {
+				t.Errorf("failed = %d, want %d", s.failed, tt.wantFailed)
+			}
+			if tt.err == nil && s.characters != 2 {
+				t.Errorf("characters = %d, want 2", s.characters)
+			}
+
+			// 冷却中的账号不再分配调用
+			next, release, err := ap.acquire(tenants.defaultTenant, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+			if tt.wantCooling && next == s {
+				t.Error("acquire() returned the cooling account")
+			}
+		})
+	}
+}
+
+func TestIsAccountError(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		want         bool
+		wantCooldown bool
+	}{
+		{name: "handshake authentication failure", err: fmt.Errorf("%w: %w: 401", ErrWebSocketDialFailed, ErrUpstreamAuthFailed), want: true, wantCooldown: true},
+		{name: "v1 concurrency limit", err: fmt.Errorf("wrapped: %w", &VolcanoError{Code: 3003}), want: true},
+		{name: "v1 auth error frame", err: &VolcanoError{Code: 45000010, Message: "authenticate failed"}, want: true, wantCooldown: true},
+		{name: "v1 quota error frame", err: &VolcanoError{Code: 45000292, Message: "quota exceeded"}, want: true, wantCooldown: true},
+		{
+			name:         "v3 session failed with resource not granted",
+			err:          v3Frame{event: v3EventSessionFailed, payload: []byte(`{"status_code":45000030,"message":"requested resource not granted"}`)}.err(),
+			want:         true,
+			wantCooldown: true,
+		},
+		{
+			name:         "v3 connection failed with quota exceeded",
+			err:          fmt.Errorf("%w: %w", ErrWebSocketDialFailed, v3Frame{event: v3EventConnectionFailed, payload: []byte(`{"status_code":45000292,"message":"quota exceeded"}`)}.err()),
+			want:         true,
+			wantCooldown: true,
+		},
+		{name: "v3 error frame with auth code", err: v3Frame{msgType: v3MsgError, errCode: 45000010, payload: []byte("invalid token")}.err(), want: true, wantCooldown: true},
+		{name: "message mentioning quota", err: &VolcanoError{Code: 3031, Message: "quota service timeout"}},
+		{name: "v3 invalid parameter", err: &VolcanoError{Code: 45000001, Event: v3EventSessionFailed}},
+		{name: "invalid text", err: &VolcanoError{Code: 3011}},
+		{name: "dial failure", err: fmt.Errorf("%w: connection refused", ErrWebSocketDialFailed)},
+	}
+
+	for _, tt := range tests {
+		if got := isAccountError(tt.err); got != tt.want {
+			t.Errorf("%s: isAccountError() = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := needsCooldown(tt.err); got != tt.wantCooldown {
+			t.Errorf("%s: needsCooldown() = %v, want %v", tt.name, got, tt.wantCooldown)
+		}
+	}
+}
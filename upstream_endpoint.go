@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 熔断器状态
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // 正常转发请求
+	breakerOpen                         // 暂停转发请求
+	breakerHalfOpen                     // 放行一个探测请求，成功后恢复
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// 熔断器配置
+type breakerConfig struct {
+	FailureThreshold int           // 连续失败多少次后打开
+	OpenDuration     time.Duration // 打开后经过多久进入半开状态
+	LatencyThreshold time.Duration // 首帧音频延迟超过该值视为失败，0表示不检查延迟
+}
+
+// 单个上游地址的熔断器
+// 连续失败或响应过慢达到阈值时打开，打开一段时间后半开并放行一个探测请求，
+// 探测成功则关闭，失败则重新打开
+type circuitBreaker struct {
+	cfg breakerConfig
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int       // 连续失败次数
+	openedAt  time.Time // 最近一次打开的时间
+	probing   bool      // 半开状态下是否已有探测请求
+	opens     int64     // 打开次数
+	lastError string    // 最近一次失败的原因
+}
+
+// 是否放行一个请求
+// 返回true时调用方必须通过 success、failure 或 skip 报告结果
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenDuration {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// 记录一次成功的请求
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// 记录一次失败的请求，返回熔断器是否因此打开
+func (b *circuitBreaker) failure(reason string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastError = reason
+	b.probing = false
+	if b.state == breakerHalfOpen || b.failures >= b.cfg.FailureThreshold {
+		opened := b.state != breakerOpen
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		if opened {
+			b.opens++
+		}
+		return opened
+	}
+	return false
+}
+
+// 请求的结果不能说明上游地址是否健康（例如客户端取消），只释放探测名额
+func (b *circuitBreaker) skip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// 当前状态，打开时间已到但还没有请求时显示为半开
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cfg.OpenDuration {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// 熔断器统计信息
+func (b *circuitBreaker) stats() map[string]interface{} {
+	state := b.currentState()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"state":                state.String(),
+		"consecutive_failures": b.failures,
+		"opens":                b.opens,
+	}
+	if b.lastError != "" {
+		stats["last_error"] = b.lastError
+	}
+	if state == breakerOpen {
+		stats["retry_in_ms"] = (b.cfg.OpenDuration - time.Since(b.openedAt)).Milliseconds()
+	}
+	return stats
+}
+
+// 上游地址配置
+type upstreamTarget struct {
+	URL      *url.URL
+	Cluster  string // v1 协议使用的集群，为空时使用账号的集群
+	Resource string // v3 协议使用的资源ID，为空时使用账号的资源ID
+}
+
+// 各协议默认的上游地址
+var defaultUpstreamURLs = map[string]string{
+	protocolV1: "wss://openspeech.bytedance.com/api/v1/tts/ws_binary",
+	protocolV3: "wss://openspeech.bytedance.com/api/v3/tts/bidirection",
+}
+
+// 解析 BYTEDANCE_TTS_ENDPOINTS 配置的上游地址列表，未配置时使用协议的默认地址
+// 地址以逗号分隔，按优先级排列；地址的 #后缀 为该地址使用的集群（v1）或资源ID（v3），
+// 省略时使用账号的集群或资源ID
+func (c *Config) upstreamTargets() ([]upstreamTarget, error) {
+	list := c.ByteDanceEndpoints
+	if strings.TrimSpace(list) == "" {
+		list = defaultUpstreamURLs[c.ByteDanceProtocol]
+	}
+
+	var targets []upstreamTarget
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		u, err := url.Parse(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream endpoint %q: %w", item, err)
+		}
+		if (u.Scheme != "wss" && u.Scheme != "ws") || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream endpoint %q: must be a ws:// or wss:// URL", item)
+		}
+
+		t := upstreamTarget{URL: u}
+		if u.Fragment != "" {
+			if c.ByteDanceProtocol == protocolV3 {
+				t.Resource = u.Fragment
+			} else {
+				t.Cluster = u.Fragment
+			}
+			u.Fragment = ""
+		}
+		targets = append(targets, t)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("BYTEDANCE_TTS_ENDPOINTS must contain at least one endpoint")
+	}
+	return targets, nil
+}
+
+// 一个上游地址，包含该地址的熔断器和每个账号的客户端
+type upstreamEndpoint struct {
+	target  upstreamTarget
+	clients []ttsUpstream // 按账号在账号池中的位置排列
+	breaker *circuitBreaker
+}
+
+// 上游请求路由
+// 先从账号池分配账号，再按配置顺序选择第一个熔断器未打开的地址；
+// 请求在输出音频前因地址故障失败时切换到下一个地址，因账号错误失败时换用下一个账号
+type upstreamRouter struct {
+	endpoints []*upstreamEndpoint
+	accounts  *accountPool
+
+	failovers      atomic.Int64 // 切换到下一个地址的次数
+	accountRetries atomic.Int64 // 换用下一个账号的次数
+}
+
+// 根据配置创建上游请求路由，每个地址的每个账号使用独立的连接池
+func newUpstreamRouter(targets []upstreamTarget, accounts *accountPool, pool upstreamPoolConfig, breaker breakerConfig) *upstreamRouter {
+	r := &upstreamRouter{accounts: accounts}
+	for _, t := range targets {
+		e := &upstreamEndpoint{target: t, breaker: &circuitBreaker{cfg: breaker}}
+		for _, s := range accounts.accounts {
+			account := s.account.forTarget(t)
+			// 连接池容量不超过账号的并发上限
+			cfg := pool
+			cfg.MaxSize = min(cfg.MaxSize, account.MaxConcurrent)
+			cfg.MinIdle = min(cfg.MinIdle, cfg.MaxSize)
+
+			if appConfig.ByteDanceProtocol == protocolV3 {
+				e.clients = append(e.clients, newV3Upstream(t.URL, account, cfg, appConfig.V3SessionsPerConn))
+			} else {
+				e.clients = append(e.clients, &v1Upstream{
+					pool:    newUpstreamPool(cfg, byteDanceDialer(t.URL, account.Token)),
+					account: account,
+				})
+			}
+		}
+		r.endpoints = append(r.endpoints, e)
+	}
+	return r
+}
+
+// 后台维护各地址的上游连接
+func (r *upstreamRouter) run() {
+	for _, e := range r.endpoints {
+		for _, client := range e.clients {
+			go client.run()
+		}
+	}
+}
+
+// 分配账号并在健康的上游地址上完成一次合成
+func (r *upstreamRouter) synthesize(ctx context.Context, p synthesisParams, onAudio audioHandler) error {
+	tried := make(map[int]bool)
+	var lastErr error
+	for {
+		s, release, err := r.accounts.acquire(p.tenant(), tried)
+		if err != nil {
+			// 没有账号可以再尝试时返回最后一个账号的错误
+			if lastErr != nil && !errors.Is(err, ErrTooManyConnections) {
+				return lastErr
+			}
+			return err
+		}
+		if lastErr != nil {
+			// 换用账号计入本次合成的上游调用次数
+			if !takeUpstreamAttempt(ctx) {
+				release()
+				return lastErr
+			}
+			r.accountRetries.Add(1)
+			slog.WarnContext(ctx, "Retrying with another Volcano account", "account", s.account.Name, "error", lastErr)
+		}
+
+		err = r.synthesizeWith(ctx, s, p, onAudio)
+		release()
+		r.accounts.record(ctx, s, p, err)
+
+		// 账号错误只会在输出音频之前发生
+		if err == nil || !isAccountError(err) || ctx.Err() != nil {
+			return err
+		}
+		tried[s.index] = true
+		lastErr = err
+	}
+}
+
+// 使用指定账号在健康的上游地址上完成一次合成
+func (r *upstreamRouter) synthesizeWith(ctx context.Context, s *accountState, p synthesisParams, onAudio audioHandler) error {
+	var lastErr error
+	for _, e := range r.endpoints {
+		if !e.breaker.allow() {
+			continue
+		}
+		if lastErr != nil {
+			// 故障转移计入本次合成的上游调用次数，次数用尽时释放 allow 占用的探测名额
+			if !takeUpstreamAttempt(ctx) {
+				e.breaker.skip()
+				return lastErr
+			}
+			r.failovers.Add(1)
+			slog.WarnContext(ctx, "Failing over to another upstream endpoint", "endpoint", e.target.URL.Redacted(), "error", lastErr)
+		}
+
+		// 每次尝试一个span，连接、请求和读取的span都在其下
+		// 每次尝试使用新的 reqid，由请求ID派生，记录在追踪数据和日志中，便于在火山引擎侧排查
+		reqID := newVolcanoReqID(ctx)
+		attemptCtx, span := startSpan(withVolcanoReqID(ctx, reqID), "volcano.synthesize",
+			attribute.String("server.address", e.target.URL.Host),
+			attribute.String("volcano.reqid", reqID),
+			attribute.String("volcano.account", s.account.Name),
+			attribute.String("volcano.voice_type", p.VoiceType),
+			attribute.Int("tts.characters", utf8.RuneCountInString(p.Text)))
+		start := time.Now()
+		var latency time.Duration
+		received := false
+		err := e.clients[s.index].synthesize(attemptCtx, p, func(audio []byte) error {
+			if !received {
+				received = true
+				// 增量输入的首帧延迟取决于客户端输入文本的速度，不计入熔断器的延迟检查
+				if p.Input == nil {
+					latency = time.Since(start)
+				}
+			}
+			return onAudio(audio)
+		})
+		endSpan(span, err)
+		e.record(err, latency)
+		logAttempt(attemptCtx, e, s, err)
+
+		if err == nil || received || !isEndpointFailure(err) || isAccountError(err) || ctx.Err() != nil {
+			return err
+		}
+		lastErr = err
+	}
+
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("%w: circuit breakers of all %d endpoints are open", ErrUpstreamUnavailable, len(r.endpoints))
+}
+
+// 输出一次上游调用的结果，日志带有请求ID和该次调用的 reqid，可按请求ID找到火山引擎侧的记录
+// 每次调用都至少输出一条 info 日志，上游错误记为 warn
+func logAttempt(ctx context.Context, e *upstreamEndpoint, s *accountState, err error) {
+	attrs := []any{"endpoint", e.target.URL.Redacted(), "account", s.account.Name}
+	switch {
+	case err == nil:
+		slog.InfoContext(ctx, "Upstream synthesis completed", attrs...)
+	case errors.Is(err, ErrRequestCancelled), errors.Is(err, ErrAudioWriteFailed):
+		slog.InfoContext(ctx, "Upstream synthesis aborted", append(attrs, "error", err)...)
+	default:
+		slog.WarnContext(ctx, "Upstream synthesis failed", append(attrs, "error", err)...)
+	}
+}
+
+// 上游故障导致的错误：连接失败、读写失败或火山引擎返回临时错误
+// 客户端取消、写出音频失败、账号错误和请求参数错误不计入熔断器
+func isEndpointFailure(err error) bool {
+	return isRetryable(err) || errors.Is(err, ErrMessageReadFailed) || errors.Is(err, ErrMessageWriteFailed)
+}
+
+// 将一次合成的结果记录到熔断器
+func (e *upstreamEndpoint) record(err error, latency time.Duration) {
+	observeVolcanoError(err)
+
+	var volcErr *VolcanoError
+	switch {
+	case err == nil:
+		if e.breaker.cfg.LatencyThreshold > 0 && latency > e.breaker.cfg.LatencyThreshold {
+			e.fail(fmt.Sprintf("slow response: first audio after %v", latency.Round(time.Millisecond)))
+			return
+		}
+		e.breaker.success()
+	case errors.Is(err, ErrRequestCancelled), errors.Is(err, ErrAudioWriteFailed), isAccountError(err):
+		e.breaker.skip()
+	case isEndpointFailure(err):
+		e.fail(err.Error())
+	case errors.As(err, &volcErr):
+		// 火山引擎正常返回了非临时错误，说明地址可用
+		e.breaker.success()
+	default:
+		e.breaker.skip()
+	}
+}
+
+// 记录一次失败，熔断器打开时输出日志
+func (e *upstreamEndpoint) fail(reason string) {
+	if e.breaker.failure(reason) {
+		slog.Warn("Circuit breaker opened for upstream endpoint", "endpoint", e.target.URL.Redacted(), "reason", reason)
+	}
+}
+
+// 是否所有地址的熔断器都处于关闭状态
+func (r *upstreamRouter) healthy() bool {
+	for _, e := range r.endpoints {
+		if e.breaker.currentState() != breakerClosed {
+			return false
+		}
+	}
+	return true
+}
+
+// 各上游地址的熔断器和连接统计信息，以及各账号的使用情况
+func (r *upstreamRouter) stats() map[string]interface{} {
+	endpoints := make([]map[string]interface{}, 0, len(r.endpoints))
+	for _, e := range r.endpoints {
+		connections := make(map[string]interface{}, len(e.clients))
+		for i, client := range e.clients {
+			connections[r.accounts.accounts[i].account.Name] = client.stats()
+		}
+		endpoint := map[string]interface{}{
+			"url":         e.target.URL.Redacted(),
+			"breaker":     e.breaker.stats(),
+			"connections": connections,
+		}
+		if e.target.Cluster != "" {
+			endpoint["cluster"] = e.target.Cluster
+		}
+		if e.target.Resource != "" {
+			endpoint["resource_id"] = e.target.Resource
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return map[string]interface{}{
+		"failovers":       r.failovers.Load(),
+		"account_retries": r.accountRetries.Load(),
+		"endpoints":       endpoints,
+		"accounts":        r.accounts.stats(),
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// 熔断器的一步操作，elapse 表示打开时间已到
+	type step struct {
+		op    string // allow、success、failure、skip 或 elapse
+		want  bool   // allow 和 failure 的返回值
+		state breakerState
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+		wantOpens int64
+	}{
+		{
+			name:      "opens after consecutive failures",
+			threshold: 2,
+			steps: []step{
+				{op: "allow", want: true, state: breakerClosed},
+				{op: "failure", want: false, state: breakerClosed},
+				{op: "failure", want: true, state: breakerOpen},
+				{op: "allow", want: false, state: breakerOpen},
+			},
+			wantOpens: 1,
+		},
+		{
+			name:      "success resets failure count",
+			threshold: 2,
+			steps: []step{
+				{op: "failure", want: false, state: breakerClosed},
+				{op: "success", state: breakerClosed},
+				{op: "failure", want: false, state: breakerClosed},
+			},
+		},
+		{
+			name:      "half open admits one probe",
+			threshold: 1,
+			steps: []step{
+				{op: "failure", want: true, state: breakerOpen},
+				{op: "elapse", state: breakerHalfOpen},
+				{op: "allow", want: true, state: breakerHalfOpen},
+				{op: "allow", want: false, state: breakerHalfOpen},
+				{op: "success", state: breakerClosed},
+				{op: "allow", want: true, state: breakerClosed},
+			},
+			wantOpens: 1,
+		},
+		{
+			name:      "failed probe reopens",
+			threshold: 3,
+			steps: []step{
+				{op: "failure", want: false, state: breakerClosed},
+				{op: "failure", want: false, state: breakerClosed},
+				{op: "failure", want: true, state: breakerOpen},
+				{op: "elapse", state: breakerHalfOpen},
+				{op: "allow", want: true, state: breakerHalfOpen},
+				{op: "failure", want: true, state: breakerOpen},
+				{op: "allow", want: false, state: breakerOpen},
+			},
+			wantOpens: 2,
+		},
+		{
+			name:      "skipped probe frees the probe slot",
+			threshold: 1,
+			steps: []step{
+				{op: "failure", want: true, state: breakerOpen},
+				{op: "elapse", state: breakerHalfOpen},
+				{op: "allow", want: true, state: breakerHalfOpen},
+				{op: "skip", state: breakerHalfOpen},
+				{op: "allow", want: true, state: breakerHalfOpen},
+			},
+			wantOpens: 1,
+		},
+		{
+			name:      "failure while open does not count as new open",
+			threshold: 1,
+			steps: []step{
+				{op: "failure", want: true, state: breakerOpen},
+				{op: "failure", want: false, state: breakerOpen},
+			},
+			wantOpens: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &circuitBreaker{cfg: breakerConfig{FailureThreshold: tt.threshold, OpenDuration: time.Minute}}
+			for i, s := range tt.steps {
+				var got bool
+				switch s.op {
+				case "allow":
+					got = b.allow()
+				case "success":
+					b.success()
+				case "failure":
+					got = b.failure("upstream error")
+				case "skip":
+					b.skip()
+				case "elapse":
+					b.mu.Lock()
+					b.openedAt = b.openedAt.Add(-b.cfg.OpenDuration)
+					b.mu.Unlock()
+				}
+				if (s.op == "allow" || s.op == "failure") && got != s.want {
+					t.Errorf("step %d: %s() = %v, want %v", i, s.op, got, s.want)
+				}
+				if state := b.currentState(); state != s.state {
+					t.Errorf("step %d: state after %s = %v, want %v", i, s.op, state, s.state)
+				}
+			}
+			if b.opens != tt.wantOpens {
+				t.Errorf("opens = %d, want %d", b.opens, tt.wantOpens)
+			}
+		})
+	}
+}
+
+// 按顺序返回预设错误的上游客户端，错误用完后合成成功
+type fakeUpstream struct {
+	errs  []error
+	calls int
+}
+
+func (f *fakeUpstream) synthesize(ctx context.Context, p synthesisParams, onAudio audioHandler) error {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	return onAudio([]byte("audio"))
+}
+
+func (f *fakeUpstream) run() {}
+
+func (f *fakeUpstream) stats() map[string]interface{} { return nil }
+
+// 创建使用 fakeUpstream 的上游请求路由，clients[i][j] 为第 i 个地址上第 j 个账号的客户端
+func newTestUpstreamRouter(clients [][]*fakeUpstream) *upstreamRouter {
+	var accounts []volcanoAccount
+	for j := range clients[0] {
+		accounts = append(accounts, volcanoAccount{Name: fmt.Sprintf("account-%d", j), MaxConcurrent: 1})
+	}
+	r := &upstreamRouter{accounts: newAccountPool(accounts, time.Minute)}
+	for i, endpointClients := range clients {
+		target, _ := url.Parse(fmt.Sprintf("wss://endpoint-%d.example.com/api/v1/tts/ws_binary", i))
+		e := &upstreamEndpoint{target: upstreamTarget{URL: target}, breaker: &circuitBreaker{cfg: breakerConfig{FailureThreshold: 1, OpenDuration: time.Minute}}}
+		for _, client := range endpointClients {
+			e.clients = append(e.clients, client)
+		}
+		r.endpoints = append(r.endpoints, e)
+	}
+	return r
+}
+
+func TestUpstreamRouterAccountFallback(t *testing.T) {
+	errAuth := fmt.Errorf("%w: %w: 401", ErrWebSocketDialFailed, ErrUpstreamAuthFailed)
+	tests := []struct {
+		name        string
+		maxAttempts int
+		wantErr     error
+		wantCalls   []int // 每个账号的调用次数
+	}{
+		{name: "falls back to another account", maxAttempts: 3, wantCalls: []int{1, 1}},
+		{name: "fallback is charged to the attempts", maxAttempts: 1, wantErr: ErrUpstreamAuthFailed, wantCalls: []int{1, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := []*fakeUpstream{{errs: []error{errAuth}}, {}}
+			r := newTestUpstreamRouter([][]*fakeUpstream{clients})
+			rp := &retryPolicy{maxAttempts: tt.maxAttempts, budget: newRetryBudget(1)}
+			ctx := rp.withAttempts(context.Background())
+
+			err := r.synthesize(ctx, synthesisParams{Text: "你好"}, func([]byte) error { return nil })
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			for i, client := range clients {
+				if client.calls != tt.wantCalls[i] {
+					t.Errorf("account %d calls = %d, want %d", i, client.calls, tt.wantCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamRouterFailoverReleasesProbe(t *testing.T) {
+	errBusy := &VolcanoError{Code: 3030, Message: "server busy"}
+	tests := []struct {
+		name        string
+		maxAttempts int
+		wantErr     error
+		wantCalls   int // 第二个地址的调用次数
+		wantState   breakerState
+	}{
+		{name: "probe runs on failover", maxAttempts: 2, wantCalls: 1, wantState: breakerClosed},
+		{name: "probe slot released when attempts are exhausted", maxAttempts: 1, wantErr: errBusy, wantState: breakerHalfOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, secondary := &fakeUpstream{errs: []error{errBusy}}, &fakeUpstream{}
+			r := newTestUpstreamRouter([][]*fakeUpstream{{primary}, {secondary}})
+			// 第二个地址的熔断器打开时间已到，下一个请求是探测请求
+			probe := r.endpoints[1].breaker
+			probe.state, probe.openedAt = breakerOpen, time.Now().Add(-2*time.Minute)
+
+			rp := &retryPolicy{maxAttempts: tt.maxAttempts, budget: newRetryBudget(1)}
+			err := r.synthesize(rp.withAttempts(context.Background()), synthesisParams{Text: "你好"}, func([]byte) error { return nil })
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if secondary.calls != tt.wantCalls {
+				t.Errorf("secondary calls = %d, want %d", secondary.calls, tt.wantCalls)
+			}
+			if got := probe.currentState(); got != tt.wantState {
+				t.Errorf("secondary breaker = %v, want %v", got, tt.wantState)
+			}
+			// 探测名额没有被占用，之后的请求仍可探测该地址
+			if !probe.allow() {
+				t.Error("secondary breaker does not admit a probe")
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 上游连接读取超时
+var errUpstreamReadTimeout = errors.New("upstream read timeout")
+
+// 上游连接在连接池中空闲时收到的消息缓冲数量
+const upstreamMessageBuffer = 64
+
+// 上游WebSocket连接
+// 由独立协程持续读取消息，使连接在连接池中空闲时也能处理pong和关闭帧
+type upstreamConn struct {
+	ws       *websocket.Conn
+	messages chan []byte
+	done     chan struct{} // 读取协程退出时关闭
+	closing  chan struct{} // 主动关闭连接时关闭
+	readErr  error         // 读取协程退出的原因，done关闭后有效
+	lastPong atomic.Int64  // 最近一次收到pong的时间（UnixNano）
+	lastUsed time.Time     // 最近一次归还连接池的时间
+	pooled   bool          // 是否计入连接池容量
+	once     sync.Once
+}
+
+// 包装一条已建立的上游WebSocket连接并启动读取协程
+func newUpstreamConn(ws *websocket.Conn) *upstreamConn {
+	c := &upstreamConn{
+		ws:       ws,
+		messages: make(chan []byte, upstreamMessageBuffer),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+	c.lastPong.Store(time.Now().UnixNano())
+	ws.SetPongHandler(func(string) error {
+		c.lastPong.Store(time.Now().UnixNano())
+		return nil
+	})
+
+	go func() {
+		defer close(c.done)
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				c.readErr = err
+				return
+			}
+			select {
+			case c.messages <- message:
+			case <-c.closing:
+				c.readErr = net.ErrClosed
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// 读取一条消息，timeout 内没有收到消息时返回超时错误
+func (c *upstreamConn) readMessage(timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case message := <-c.messages:
+		return message, nil
+	case <-c.done:
+		// 读取协程退出前可能已缓冲了消息
+		select {
+		case message := <-c.messages:
+			return message, nil
+		default:
+		}
+		return nil, c.readErr
+	case <-timer.C:
+		return nil, errUpstreamReadTimeout
+	}
+}
+
+// 写入一条二进制消息
+func (c *upstreamConn) writeMessage(data []byte, timeout time.Duration) error {
+	c.ws.SetWriteDeadline(time.Now().Add(timeout))
+	return c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// 连接是否仍可复用：读取协程未退出且没有未处理的消息
+func (c *upstreamConn) healthy() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	return len(c.messages) == 0
+}
+
+// 关闭连接
+func (c *upstreamConn) close() {
+	c.once.Do(func() {
+		close(c.closing)
+		c.ws.Close()
+	})
+}
+
+// 上游连接池配置
+type upstreamPoolConfig struct {
+	MinIdle      int           // 预先建立的最少空闲连接数
+	MaxSize      int           // 连接池最大连接数，0表示不复用连接
+	IdleTimeout  time.Duration // 空闲连接的最长保留时间
+	PingInterval time.Duration // 空闲连接的心跳间隔
+}
+
+// 上游WebSocket连接池
+type upstreamPool struct {
+	cfg  upstreamPoolConfig
+	dial func(ctx context.Context) (*websocket.Conn, error)
+
+	mu   sync.Mutex
+	idle []*upstreamConn // 后进先出，优先复用最近使用的连接
+	open int             // 计入连接池容量的连接数（空闲+使用中）
+
+	dials    atomic.Int64
+	reuses   atomic.Int64
+	discards atomic.Int64
+}
+
+// 创建上游连接池
+func newUpstreamPool(cfg upstreamPoolConfig, dial func(ctx context.Context) (*websocket.Conn, error)) *upstreamPool {
+	return &upstreamPool{
+		cfg:  cfg,
+		dial: dial,
+	}
+}
+
+// 建立一条新的上游连接
+// 连接池未满时计入连接池容量，否则为用完即关闭的临时连接
+func (p *upstreamPool) dialConn(ctx context.Context) (*upstreamConn, error) {
+	p.mu.Lock()
+	pooled := p.open < p.cfg.MaxSize
+	if pooled {
+		p.open++
+	}
+	p.mu.Unlock()
+
+	start := time.Now()
+	dialCtx, span := startSpan(ctx, "volcano.dial", attribute.String("tts.protocol", protocolV1))
+	ws, err := p.dial(dialCtx)
+	endSpan(span, err)
+	observeUpstreamDial(protocolV1, start, err)
+	if err != nil {
+		if pooled {
+			p.mu.Lock()
+			p.open--
+			p.mu.Unlock()
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %w", ErrRequestCancelled, context.Cause(ctx))
+		}
+		return nil, fmt.Errorf("%w: %w", ErrWebSocketDialFailed, err)
+	}
+	p.dials.Add(1)
+
+	c := newUpstreamConn(ws)
+	c.pooled = pooled
+	return c, nil
+}
+
+// 获取一条上游连接，优先复用空闲连接
+// reused 表示连接是否来自连接池
+func (p *upstreamPool) get(ctx context.Context) (c *upstreamConn, reused bool, err error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		c = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if c.healthy() {
+			p.mu.Unlock()
+			p.reuses.Add(1)
+			return c, true, nil
+		}
+		p.closeLocked(c)
+	}
+	p.mu.Unlock()
+
+	c, err = p.dialConn(ctx)
+	return c, false, err
+}
+
+// 归还一条完成合成的连接
+func (p *upstreamPool) put(c *upstreamConn) {
+	if !c.pooled || !c.healthy() {
+		p.discard(c)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c.lastUsed = time.Now()
+	p.idle = append(p.idle, c)
+}
+
+// 丢弃一条连接
+func (p *upstreamPool) discard(c *upstreamConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeLocked(c)
+}
+
+// 关闭连接并释放连接池容量，调用方需持有锁
+func (p *upstreamPool) closeLocked(c *upstreamConn) {
+	c.close()
+	if c.pooled {
+		c.pooled = false
+		p.open--
+		p.discards.Add(1)
+	}
+}
+
+// 后台维护连接池：清理过期和失效的空闲连接，发送心跳，并补充最少空闲连接
+func (p *upstreamPool) run() {
+	if p.cfg.MaxSize <= 0 {
+		return
+	}
+
+	p.maintain()
+	ticker := time.NewTicker(p.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.maintain()
+	}
+}
+
+// 执行一轮连接池维护
+func (p *upstreamPool) maintain() {
+	now := time.Now()
+	// 两个心跳周期内没有收到pong视为连接失效
+	pongDeadline := now.Add(-2 * p.cfg.PingInterval).UnixNano()
+
+	p.mu.Lock()
+	alive := p.idle[:0]
+	for _, c := range p.idle {
+		switch {
+		case !c.healthy(),
+			now.Sub(c.lastUsed) > p.cfg.IdleTimeout,
+			c.lastPong.Load() < pongDeadline:
+			p.closeLocked(c)
+		default:
+			alive = append(alive, c)
+		}
+	}
+	p.idle = alive
+	idle := append([]*upstreamConn(nil), p.idle...)
+	missing := p.cfg.MinIdle - len(p.idle)
+	if room := p.cfg.MaxSize - p.open; missing > room {
+		missing = room
+	}
+	p.mu.Unlock()
+
+	// 对空闲连接发送心跳，WriteControl 可与其他写操作并发调用
+	for _, c := range idle {
+		if err := c.ws.WriteControl(websocket.PingMessage, nil, now.Add(appConfig.WriteTimeout)); err != nil {
+			c.close()
+		}
+	}
+
+	// 预先建立连接，补充到最少空闲连接数
+	for i := 0; i < missing; i++ {
+		c, err := p.dialConn(context.Background())
+		if err != nil {
+			slog.Warn("Failed to pre-dial upstream connection", "error", err)
+			return
+		}
+		p.put(c)
+	}
+}
+
+// 连接池统计信息
+func (p *upstreamPool) stats() map[string]interface{} {
+	p.mu.Lock()
+	idle, open := len(p.idle), p.open
+	p.mu.Unlock()
+
+	return map[string]interface{}{
+		"idle":     idle,
+		"open":     open,
+		"max_size": p.cfg.MaxSize,
+		"dials":    p.dials.Load(),
+		"reuses":   p.reuses.Load(),
+		"discards": p.discards.Load(),
+	}
+}
+
+// 返回使用指定令牌建立到火山引擎指定地址的WebSocket连接的函数
+func byteDanceDialer(target *url.URL, token string) func(ctx context.Context) (*websocket.Conn, error) {
+	return func(ctx context.Context) (*websocket.Conn, error) {
+		dialer := websocket.Dialer{
+			HandshakeTimeout: appConfig.DialTimeout,
+			ReadBufferSize:   1024 * 1024, // 1MB
+			WriteBufferSize:  1024 * 1024, // 1MB
+		}
+
+		header := http.Header{"Authorization": []string{fmt.Sprintf("Bearer;%s", token)}}
+		ws, resp, err := dialer.DialContext(ctx, target.String(), header)
+		if err != nil && isAuthFailure(resp) {
+			err = fmt.Errorf("%w: %v", ErrUpstreamAuthFailed, err)
+		}
+		return ws, err
+	}
+}
+
+// 握手响应是否表示鉴权失败
+func isAuthFailure(resp *http.Response) bool {
+	return resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden)
+}
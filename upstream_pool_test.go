@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 启动一个测试用的WebSocket服务端，每条连接交给 handler 处理，handler 返回后关闭连接
+func newTestWebSocketServer(t *testing.T, handler func(ws *websocket.Conn)) (*url.URL, *atomic.Int64) {
+	t.Helper()
+
+	var accepted atomic.Int64
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted.Add(1)
+		defer ws.Close()
+		handler(ws)
+	}))
+	t.Cleanup(server.Close)
+
+	target, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target, &accepted
+}
+
+// 保持连接直到客户端关闭
+func holdConnection(ws *websocket.Conn) {
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// 等待连接的读取协程退出
+func waitConnDone(t *testing.T, c *upstreamConn) {
+	t.Helper()
+	select {
+	case <-c.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestUpstreamPoolGetPut(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int
+		handler    func(ws *websocket.Conn)
+		beforePut  func(t *testing.T, c *upstreamConn)
+		wantReused bool
+		wantDials  int64
+		wantOpen   int
+	}{
+		{
+			name:       "reuses idle connection",
+			maxSize:    2,
+			handler:    holdConnection,
+			wantReused: true,
+			wantDials:  1,
+			wantOpen:   1,
+		},
+		{
+			name:       "temporary connection is not pooled",
+			maxSize:    0,
+			handler:    holdConnection,
+			wantReused: false,
+			wantDials:  2,
+			wantOpen:   0,
+		},
+		{
+			name:    "connection closed by server is discarded",
+			maxSize: 2,
+			handler: func(ws *websocket.Conn) {},
+			beforePut: func(t *testing.T, c *upstreamConn) {
+				waitConnDone(t, c)
+			},
+			wantReused: false,
+			wantDials:  2,
+			wantOpen:   1,
+		},
+		{
+			name:    "connection with unread message is discarded",
+			maxSize: 2,
+			handler: func(ws *websocket.Conn) {
+				ws.WriteMessage(websocket.BinaryMessage, []byte("stale"))
+				holdConnection(ws)
+			},
+			beforePut: func(t *testing.T, c *upstreamConn) {
+				deadline := time.Now().Add(2 * time.Second)
+				for len(c.messages) == 0 && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+			},
+			wantReused: false,
+			wantDials:  2,
+			wantOpen:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, _ := newTestWebSocketServer(t, tt.handler)
+			pool := newUpstreamPool(upstreamPoolConfig{MaxSize: tt.maxSize}, byteDanceDialer(target, "token"))
+			ctx := context.Background()
+
+			first, reused, err := pool.get(ctx)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if reused {
+				t.Fatal("first connection must be dialed")
+			}
+			if tt.beforePut != nil {
+				tt.beforePut(t, first)
+			}
+			pool.put(first)
+
+			second, reused, err := pool.get(ctx)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			defer pool.discard(second)
+
+			if reused != tt.wantReused {
+				t.Errorf("reused = %v, want %v", reused, tt.wantReused)
+			}
+			if got := pool.dials.Load(); got != tt.wantDials {
+				t.Errorf("dials = %d, want %d", got, tt.wantDials)
+			}
+			if pool.open != tt.wantOpen {
+				t.Errorf("open = %d, want %d", pool.open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolMaintain(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         upstreamPoolConfig
+		idle        int // 维护前放入连接池的空闲连接数
+		idleFor     time.Duration
+		wantIdle    int
+		wantClosed  int
+		wantAccepts int64
+	}{
+		{
+			name:        "dials up to min idle",
+			cfg:         upstreamPoolConfig{MinIdle: 2, MaxSize: 4, IdleTimeout: time.Minute, PingInterval: time.Minute},
+			wantIdle:    2,
+			wantAccepts: 2,
+		},
+		{
+			name:        "min idle is capped by max size",
+			cfg:         upstreamPoolConfig{MinIdle: 3, MaxSize: 1, IdleTimeout: time.Minute, PingInterval: time.Minute},
+			wantIdle:    1,
+			wantAccepts: 1,
+		},
+		{
+			name:        "closes connections idle for too long",
+			cfg:         upstreamPoolConfig{MaxSize: 4, IdleTimeout: time.Second, PingInterval: time.Minute},
+			idle:        2,
+			idleFor:     2 * time.Second,
+			wantIdle:    0,
+			wantClosed:  2,
+			wantAccepts: 2,
+		},
+		{
+			name:        "keeps recently used connections",
+			cfg:         upstreamPoolConfig{MaxSize: 4, IdleTimeout: time.Minute, PingInterval: time.Minute},
+			idle:        2,
+			wantIdle:    2,
+			wantAccepts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, accepted := newTestWebSocketServer(t, holdConnection)
+			pool := newUpstreamPool(tt.cfg, byteDanceDialer(target, "token"))
+
+			var conns []*upstreamConn
+			for i := 0; i < tt.idle; i++ {
+				c, err := pool.dialConn(context.Background())
+				if err != nil {
+					t.Fatalf("dial: %v", err)
+				}
+				conns = append(conns, c)
+			}
+			for _, c := range conns {
+				pool.put(c)
+				c.lastUsed = time.Now().Add(-tt.idleFor)
+			}
+
+			pool.maintain()
+
+			if got := len(pool.idle); got != tt.wantIdle {
+				t.Errorf("idle = %d, want %d", got, tt.wantIdle)
+			}
+			if got := pool.discards.Load(); got != int64(tt.wantClosed) {
+				t.Errorf("discards = %d, want %d", got, tt.wantClosed)
+			}
+			if got := accepted.Load(); got != tt.wantAccepts {
+				t.Errorf("accepted connections = %d, want %d", got, tt.wantAccepts)
+			}
+			for _, c := range pool.idle {
+				pool.discard(c)
+			}
+		})
+	}
+}
+
+func TestByteDanceDialer(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		wantErr  bool
+		wantAuth bool
+	}{
+		{name: "upgrade succeeds", status: http.StatusSwitchingProtocols},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantErr: true, wantAuth: true},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: true, wantAuth: true},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var authorization atomic.Value
+			upgrader := websocket.Upgrader{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization.Store(r.Header.Get("Authorization"))
+				if tt.status != http.StatusSwitchingProtocols {
+					http.Error(w, http.StatusText(tt.status), tt.status)
+					return
+				}
+				ws, err := upgrader.Upgrade(w, r, nil)
+				if err == nil {
+					ws.Close()
+				}
+			}))
+			defer server.Close()
+			target, _ := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+
+			ws, err := byteDanceDialer(target, "secret-token")(context.Background())
+			if ws != nil {
+				ws.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := errors.Is(err, ErrUpstreamAuthFailed); got != tt.wantAuth {
+				t.Errorf("auth failure = %v, want %v (err: %v)", got, tt.wantAuth, err)
+			}
+			if got := authorization.Load(); got != "Bearer;secret-token" {
+				t.Errorf("Authorization = %q, want %q", got, "Bearer;secret-token")
+			}
+		})
+	}
+}
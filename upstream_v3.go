@@ -0,0 +1,831 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// V3 协议消息类型
+const (
+	v3MsgFullClientRequest  byte = 0x1
+	v3MsgFullServerResponse byte = 0x9
+	v3MsgAudioOnlyServer    byte = 0xb
+	v3MsgError              byte = 0xf
+
+	// 消息携带事件编号
+	v3FlagWithEvent byte = 0x4
+)
+
+// V3 协议事件
+const (
+	v3EventStartConnection    int32 = 1
+	v3EventFinishConnection   int32 = 2
+	v3EventConnectionStarted  int32 = 50
+	v3EventConnectionFailed   int32 = 51
+	v3EventConnectionFinished int32 = 52
+	v3EventStartSession       int32 = 100
+	v3EventCancelSession      int32 = 101
+	v3EventFinishSession      int32 = 102
+	v3EventSessionStarted     int32 = 150
+	v3EventSessionFinished    int32 = 152
+	v3EventSessionFailed      int32 = 153
+	v3EventTaskRequest        int32 = 200
+	v3EventTTSResponse        int32 = 352
+)
+
+// V3 协议会话消息缓冲数量
+const v3SessionBuffer = 256
+
+// 会话的消息缓冲已满：客户端读取音频的速度跟不上合成速度
+var errV3SessionOverflow = errors.New("session buffer overflow: audio is not consumed fast enough")
+
+// V3 协议帧
+type v3Frame struct {
+	msgType byte
+	event   int32
+	id      string // 会话ID或连接ID
+	errCode uint32
+	payload []byte
+}
+
+// 编码一条客户端事件
+// 连接级事件（StartConnection、FinishConnection）不携带会话ID
+func encodeV3Frame(event int32, sessionID string, payload []byte) []byte {
+	frame := []byte{0x11, v3MsgFullClientRequest<<4 | v3FlagWithEvent, 0x10, 0x00}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(event))
+	if event != v3EventStartConnection && event != v3EventFinishConnection {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(sessionID)))
+		frame = append(frame, sessionID...)
+	}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// 读取一个带长度前缀的字段
+func readV3Field(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("invalid frame: insufficient data")
+	}
+	size := binary.BigEndian.Uint32(data[0:4])
+	if uint64(size) > uint64(len(data)-4) {
+		return nil, nil, errors.New("invalid frame: field size exceeds data length")
+	}
+	return data[4 : 4+size], data[4+size:], nil
+}
+
+// 解析一条服务端帧
+func parseV3Frame(data []byte) (f v3Frame, err error) {
+	if len(data) < 4 {
+		return f, errors.New("invalid frame: too short")
+	}
+
+	headSize := int(data[0]&0x0f) * 4
+	f.msgType = data[1] >> 4
+	flags := data[1] & 0x0f
+	compression := data[2] & 0x0f
+	if headSize > len(data) {
+		return f, errors.New("invalid frame: header size exceeds data length")
+	}
+	rest := data[headSize:]
+
+	if f.msgType == v3MsgError {
+		if len(rest) < 4 {
+			return f, errors.New("invalid error frame: insufficient data")
+		}
+		f.errCode = binary.BigEndian.Uint32(rest[0:4])
+		rest = rest[4:]
+	}
+
+	if flags&v3FlagWithEvent != 0 {
+		if len(rest) < 4 {
+			return f, errors.New("invalid frame: missing event")
+		}
+		f.event = int32(binary.BigEndian.Uint32(rest[0:4]))
+		rest = rest[4:]
+
+		// 服务端事件都携带连接ID或会话ID
+		id, remaining, err := readV3Field(rest)
+		if err != nil {
+			return f, err
+		}
+		f.id = string(id)
+		rest = remaining
+	}
+
+	f.payload, _, err = readV3Field(rest)
+	if err != nil {
+		return f, err
+	}
+	if compression == 1 {
+		f.payload = gzipDecompress(f.payload)
+	}
+
+	return f, nil
+}
+
+// 将服务端失败事件或错误帧转换为错误
+func (f v3Frame) err() error {
+	var detail struct {
+		StatusCode int    `json:"status_code"`
+		Message    string `json:"message"`
+	}
+	code := int(f.errCode)
+	message := string(f.payload)
+	if json.Unmarshal(f.payload, &detail) == nil && detail.Message != "" {
+		message = detail.Message
+		if code == 0 {
+			code = detail.StatusCode
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrResponseParseFailed, &VolcanoError{Code: code, Message: message, Event: f.event})
+}
+
+// V3 协议连接，一条连接上可以承载多个会话
+type v3Conn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	sessions map[string]*v3Session
+	lastUsed time.Time
+	pooled   bool // 是否计入连接池容量
+
+	done     chan struct{} // 读取协程退出时关闭
+	readErr  error
+	lastPong atomic.Int64
+	once     sync.Once
+}
+
+// 写入一条帧
+func (c *v3Conn) write(frame []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.ws.SetWriteDeadline(time.Now().Add(appConfig.WriteTimeout))
+	return c.ws.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// 连接是否仍可用
+func (c *v3Conn) healthy() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// 当前会话数
+func (c *v3Conn) sessionCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sessions)
+}
+
+// 持续读取服务端帧，按会话ID分发
+func (c *v3Conn) readLoop() {
+	defer func() {
+		close(c.done)
+		// 通知所有会话连接已断开
+		c.mu.Lock()
+		for _, s := range c.sessions {
+			s.fail(fmt.Errorf("%w: %v", ErrMessageReadFailed, c.readErr))
+		}
+		c.mu.Unlock()
+	}()
+
+	for {
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			c.readErr = err
+			return
+		}
+
+		frame, err := parseV3Frame(message)
+		if err != nil {
+			slog.Warn("Invalid v3 frame", "error", err)
+			continue
+		}
+
+		c.mu.Lock()
+		s := c.sessions[frame.id]
+		c.mu.Unlock()
+		if s == nil {
+			// 没有会话ID的错误帧属于整条连接
+			if frame.msgType == v3MsgError && frame.id == "" {
+				c.mu.Lock()
+				for _, s := range c.sessions {
+					s.fail(frame.err())
+				}
+				c.mu.Unlock()
+			}
+			continue
+		}
+		s.deliver(frame)
+	}
+}
+
+// 关闭连接
+func (c *v3Conn) close() {
+	c.once.Do(func() {
+		c.write(encodeV3Frame(v3EventFinishConnection, "", []byte("{}")))
+		c.ws.Close()
+	})
+}
+
+// V3 协议会话，对应一次合成
+type v3Session struct {
+	id       string
+	conn     *v3Conn
+	upstream *v3Upstream
+
+	speaker   string
+	format    string
+	speakRate int
+	wavHeader bool       // 请求wav时以pcm合成并补充WAV文件头
+	input     *textInput // 增量输入的文本，等待输入期间不计读取超时
+
+	frames  chan v3Frame
+	failed  chan struct{}
+	failErr error
+	closed  chan struct{}
+	once    sync.Once
+	failMu  sync.Once
+}
+
+// 投递一条服务端帧
+// 连接上只有一个会话时缓冲已满则等待读取，由 WebSocket 流控减缓服务端发送；
+// 多个会话复用连接时不阻塞读取协程，缓冲已满时会话失败并丢弃之后的帧，一个会话读取缓慢不会阻塞同一连接上的其他会话
+func (s *v3Session) deliver(f v3Frame) {
+	select {
+	case <-s.failed:
+		return
+	default:
+	}
+
+	if s.upstream.sessionsPerConn <= 1 {
+		select {
+		case s.frames <- f:
+		case <-s.closed:
+		case <-s.failed:
+		}
+		return
+	}
+
+	select {
+	case s.frames <- f:
+	case <-s.closed:
+	default:
+		s.fail(fmt.Errorf("%w: %w", ErrAudioWriteFailed, errV3SessionOverflow))
+	}
+}
+
+// 标记会话失败
+func (s *v3Session) fail(err error) {
+	s.failMu.Do(func() {
+		s.failErr = err
+		close(s.failed)
+	})
+}
+
+// 读取下一条帧，ctx 取消时立即返回
+// 增量输入的会话在输入结束前可能长时间没有音频，等待输入期间不计读取超时
+func (s *v3Session) next(ctx context.Context) (v3Frame, error) {
+	timer := time.NewTimer(appConfig.ReadTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return v3Frame{}, fmt.Errorf("%w: %w", ErrRequestCancelled, context.Cause(ctx))
+		case f := <-s.frames:
+			return f, nil
+		case <-s.failed:
+			// 失败前可能已缓冲了帧；缓冲溢出时丢弃的是之后到达的帧，已缓冲的帧仍按顺序输出
+			select {
+			case f := <-s.frames:
+				return f, nil
+			default:
+			}
+			return v3Frame{}, s.failErr
+		case <-timer.C:
+			if s.input != nil && s.input.pending() {
+				timer.Reset(appConfig.ReadTimeout)
+				continue
+			}
+			return v3Frame{}, fmt.Errorf("%w: %w", ErrMessageReadFailed, errUpstreamReadTimeout)
+		}
+	}
+}
+
+// 构建会话请求负载
+func (s *v3Session) payload(event int32, text string) []byte {
+	reqParams := map[string]interface{}{
+		"speaker": s.speaker,
+		"audio_params": map[string]interface{}{
+			"format":      s.format,
+			"sample_rate": audioSampleRate,
+			"speech_rate": s.speakRate,
+		},
+	}
+	if event == v3EventTaskRequest {
+		reqParams["text"] = text
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"user":       map[string]interface{}{"uid": "uid"},
+		"event":      event,
+		"namespace":  "BidirectionalTTS",
+		"req_params": reqParams,
+	})
+	return data
+}
+
+// 发送一段文本，可多次调用以增量推送文本
+func (s *v3Session) sendText(text string) error {
+	if err := s.conn.write(encodeV3Frame(v3EventTaskRequest, s.id, s.payload(v3EventTaskRequest, text))); err != nil {
+		return fmt.Errorf("%w: %v", ErrMessageWriteFailed, err)
+	}
+	return nil
+}
+
+// 结束文本输入，服务端合成完剩余文本后结束会话
+func (s *v3Session) finish() error {
+	if err := s.conn.write(encodeV3Frame(v3EventFinishSession, s.id, []byte("{}"))); err != nil {
+		return fmt.Errorf("%w: %v", ErrMessageWriteFailed, err)
+	}
+	return nil
+}
+
+// 逐段推送增量输入的文本，输入结束后结束会话
+// 推送失败或输入被放弃时会话失败，receive 随即返回该错误；ctx 在 receive 返回后取消
+func (s *v3Session) pushInput(ctx context.Context, input *textInput) {
+	for i := 0; ; i++ {
+		text, ok, err := input.next(ctx, i)
+		if err == nil && !ok {
+			err = s.finish()
+		} else if err == nil {
+			err = s.sendText(text)
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// 接收音频直到会话结束
+func (s *v3Session) receive(ctx context.Context, onAudio audioHandler) error {
+	headerSent := !s.wavHeader
+	for {
+		f, err := s.next(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f.msgType == v3MsgError, f.event == v3EventSessionFailed:
+			return f.err()
+		case f.event == v3EventTTSResponse && len(f.payload) > 0:
+			if !headerSent {
+				headerSent = true
+				if err := onAudio(wavStreamHeader(audioSampleRate)); err != nil {
+					return fmt.Errorf("%w: %v", ErrAudioWriteFailed, err)
+				}
+			}
+			if err := onAudio(f.payload); err != nil {
+				return fmt.Errorf("%w: %v", ErrAudioWriteFailed, err)
+			}
+		case f.event == v3EventSessionFinished:
+			return nil
+		}
+	}
+}
+
+// 关闭会话并释放连接
+func (s *v3Session) close() {
+	s.once.Do(func() {
+		close(s.closed)
+		s.upstream.release(s)
+	})
+}
+
+// 火山引擎V3双向流式协议客户端
+// 会话复用连接，连接池配置与v1协议相同
+type v3Upstream struct {
+	url             *url.URL
+	account         volcanoAccount
+	cfg             upstreamPoolConfig
+	sessionsPerConn int
+
+	mu    sync.Mutex
+	conns []*v3Conn
+	open  int // 计入连接池容量的连接数
+
+	dials    atomic.Int64
+	sessions atomic.Int64
+}
+
+// 创建V3协议客户端
+func newV3Upstream(target *url.URL, account volcanoAccount, cfg upstreamPoolConfig, sessionsPerConn int) *v3Upstream {
+	return &v3Upstream{url: target, account: account, cfg: cfg, sessionsPerConn: sessionsPerConn}
+}
+
+// 建立一条V3连接并完成 StartConnection 握手
+func (u *v3Upstream) dial(ctx context.Context) (conn *v3Conn, err error) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "volcano.dial", attribute.String("tts.protocol", protocolV3))
+	defer func() {
+		endSpan(span, err)
+		observeUpstreamDial(protocolV3, start, err)
+	}()
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: appConfig.DialTimeout,
+		ReadBufferSize:   1024 * 1024, // 1MB
+		WriteBufferSize:  1024 * 1024, // 1MB
+	}
+	header := http.Header{
+		"X-Api-App-Key":     []string{u.account.AppID},
+		"X-Api-Access-Key":  []string{u.account.Token},
+		"X-Api-Resource-Id": []string{u.account.ResourceID},
+		"X-Api-Connect-Id":  []string{uuid.NewV4().String()},
+	}
+	ws, resp, err := dialer.DialContext(ctx, u.url.String(), header)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %w", ErrRequestCancelled, context.Cause(ctx))
+		}
+		if isAuthFailure(resp) {
+			return nil, fmt.Errorf("%w: %w: %v", ErrWebSocketDialFailed, ErrUpstreamAuthFailed, err)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrWebSocketDialFailed, err)
+	}
+
+	// 连接级握手
+	ws.SetWriteDeadline(time.Now().Add(appConfig.WriteTimeout))
+	if err := ws.WriteMessage(websocket.BinaryMessage, encodeV3Frame(v3EventStartConnection, "", []byte("{}"))); err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("%w: %v", ErrWebSocketDialFailed, err)
+	}
+	ws.SetReadDeadline(time.Now().Add(appConfig.DialTimeout))
+	_, message, err := ws.ReadMessage()
+	if err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("%w: %v", ErrWebSocketDialFailed, err)
+	}
+	frame, err := parseV3Frame(message)
+	if err == nil && frame.event != v3EventConnectionStarted {
+		err = frame.err()
+	}
+	if err != nil {
+		// 保留火山引擎错误，鉴权失败和配额用尽时切换账号
+		ws.Close()
+		return nil, fmt.Errorf("%w: %w", ErrWebSocketDialFailed, err)
+	}
+	ws.SetReadDeadline(time.Time{})
+	u.dials.Add(1)
+
+	c := &v3Conn{
+		ws:       ws,
+		sessions: make(map[string]*v3Session),
+		lastUsed: time.Now(),
+		done:     make(chan struct{}),
+	}
+	c.lastPong.Store(time.Now().UnixNano())
+	ws.SetPongHandler(func(string) error {
+		c.lastPong.Store(time.Now().UnixNano())
+		return nil
+	})
+	go c.readLoop()
+
+	return c, nil
+}
+
+// 为会话分配连接：优先复用还有空余会话数的连接，否则建立新连接
+func (u *v3Upstream) acquire(ctx context.Context, s *v3Session) error {
+	u.mu.Lock()
+	for _, c := range u.conns {
+		if c.healthy() && c.sessionCount() < u.sessionsPerConn {
+			u.attach(c, s)
+			u.mu.Unlock()
+			return nil
+		}
+	}
+	pooled := u.open < u.cfg.MaxSize
+	if pooled {
+		u.open++
+	}
+	u.mu.Unlock()
+
+	c, err := u.dial(ctx)
+	if err != nil {
+		if pooled {
+			u.mu.Lock()
+			u.open--
+			u.mu.Unlock()
+		}
+		return err
+	}
+	c.pooled = pooled
+
+	u.mu.Lock()
+	if pooled {
+		u.conns = append(u.conns, c)
+	}
+	u.attach(c, s)
+	u.mu.Unlock()
+	return nil
+}
+
+// 将会话绑定到连接
+func (u *v3Upstream) attach(c *v3Conn, s *v3Session) {
+	c.mu.Lock()
+	c.sessions[s.id] = s
+	c.mu.Unlock()
+	s.conn = c
+}
+
+// 会话结束后解除绑定，临时连接在没有会话时关闭
+func (u *v3Upstream) release(s *v3Session) {
+	c := s.conn
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.sessions, s.id)
+	remaining := len(c.sessions)
+	c.lastUsed = time.Now()
+	c.mu.Unlock()
+
+	if !c.pooled && remaining == 0 {
+		c.close()
+	}
+}
+
+// 丢弃一条连接，连接上的会话都会失败
+func (u *v3Upstream) discard(c *v3Conn) {
+	c.close()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.removeLocked(c)
+}
+
+// 从连接池移除连接，调用方需持有锁
+func (u *v3Upstream) removeLocked(c *v3Conn) {
+	for i, conn := range u.conns {
+		if conn == c {
+			u.conns = append(u.conns[:i], u.conns[i+1:]...)
+			u.open--
+			return
+		}
+	}
+}
+
+// 取消进行中的会话：连接上没有其他会话时直接关闭连接，否则发送 CancelSession
+// 被取消会话之后到达的帧因找不到会话而被丢弃
+func (u *v3Upstream) abort(s *v3Session) {
+	if s.conn.sessionCount() <= 1 {
+		u.discard(s.conn)
+		return
+	}
+	if err := s.conn.write(encodeV3Frame(v3EventCancelSession, s.id, []byte("{}"))); err != nil {
+		u.discard(s.conn)
+	}
+}
+
+// 开始一个会话，等待服务端确认 SessionStarted
+func (u *v3Upstream) startSession(ctx context.Context, p synthesisParams) (_ *v3Session, err error) {
+	s := &v3Session{
+		id:        volcanoReqIDFromContext(ctx), // 会话ID即 V3 协议的请求ID
+		upstream:  u,
+		speaker:   p.VoiceType,
+		format:    p.Encoding,
+		speakRate: v3SpeechRate(p.Speed),
+		frames:    make(chan v3Frame, v3SessionBuffer),
+		failed:    make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	if s.speaker == "" {
+		s.speaker = p.tenant().DefaultVoice
+	}
+	switch s.format {
+	case "":
+		s.format = "mp3"
+	case "wav":
+		// V3 协议不支持wav，以pcm合成并补充WAV文件头
+		s.format = "pcm"
+		s.wavHeader = true
+	}
+
+	if err := u.acquire(ctx, s); err != nil {
+		return nil, err
+	}
+	u.sessions.Add(1)
+
+	_, span := startSpan(ctx, "volcano.start_session")
+	defer func() { endSpan(span, err) }()
+	if err := s.conn.write(encodeV3Frame(v3EventStartSession, s.id, s.payload(v3EventStartSession, ""))); err != nil {
+		s.close()
+		u.discard(s.conn)
+		return nil, fmt.Errorf("%w: %v", ErrMessageWriteFailed, err)
+	}
+
+	for {
+		f, err := s.next(ctx)
+		if err != nil {
+			if errors.Is(err, ErrRequestCancelled) || errors.Is(err, errV3SessionOverflow) {
+				u.abort(s)
+			}
+			s.close()
+			return nil, err
+		}
+		switch {
+		case f.event == v3EventSessionStarted:
+			return s, nil
+		case f.msgType == v3MsgError, f.event == v3EventSessionFailed:
+			s.close()
+			return nil, f.err()
+		}
+	}
+}
+
+// 完成一次合成：开始会话、发送全部文本、结束会话并接收音频
+// p.Input 不为nil时每段输入文本发送一条 TaskRequest，输入结束后结束会话，推送文本与接收音频同时进行
+// ctx 取消时立即中止会话，不再等待剩余音频
+func (u *v3Upstream) synthesize(ctx context.Context, p synthesisParams, onAudio audioHandler) error {
+	// 验证单次上游请求的文本长度，长文本应先经 splitText 切分
+	if n := utf8.RuneCountInString(p.Text); n > appConfig.MaxSegmentLength {
+		return fmt.Errorf("%w: segment length %d exceeds maximum allowed %d",
+			ErrTextTooLong, n, appConfig.MaxSegmentLength)
+	}
+
+	s, err := u.startSession(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if p.Input != nil {
+		// 从第一段文本开始推送，重试时重新推送已收到的全部文本
+		s.input = p.Input
+		pushCtx, cancel := context.WithCancel(ctx)
+		pushed := make(chan struct{})
+		go func() {
+			defer close(pushed)
+			s.pushInput(pushCtx, p.Input)
+		}()
+		defer func() {
+			cancel()
+			<-pushed
+		}()
+	} else {
+		_, span := startSpan(ctx, "volcano.write_request")
+		err = s.sendText(p.Text)
+		if err == nil {
+			err = s.finish()
+		}
+		endSpan(span, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	spans := startReadSpans(ctx)
+	err = s.receive(ctx, spans.wrap(onAudio))
+	spans.end(err)
+	switch {
+	case errors.Is(err, ErrRequestCancelled), errors.Is(err, errV3SessionOverflow):
+		// 服务端仍在发送该会话的音频，取消会话
+		u.abort(s)
+	case errors.Is(err, errUpstreamReadTimeout):
+		// 读取超时的连接状态未知，不再复用
+		u.discard(s.conn)
+	}
+	return err
+}
+
+// 后台维护连接：清理失效和空闲超时的连接，发送心跳，并补充最少空闲连接
+func (u *v3Upstream) run() {
+	if u.cfg.MaxSize <= 0 {
+		return
+	}
+
+	u.maintain()
+	ticker := time.NewTicker(u.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		u.maintain()
+	}
+}
+
+// 执行一轮连接维护
+func (u *v3Upstream) maintain() {
+	now := time.Now()
+	pongDeadline := now.Add(-2 * u.cfg.PingInterval).UnixNano()
+
+	u.mu.Lock()
+	var alive, idle []*v3Conn
+	for _, c := range u.conns {
+		c.mu.Lock()
+		sessions, lastUsed := len(c.sessions), c.lastUsed
+		c.mu.Unlock()
+
+		switch {
+		case !c.healthy(), c.lastPong.Load() < pongDeadline && sessions == 0:
+			c.close()
+			u.open--
+		case sessions == 0 && now.Sub(lastUsed) > u.cfg.IdleTimeout && len(idle) >= u.cfg.MinIdle:
+			c.close()
+			u.open--
+		default:
+			alive = append(alive, c)
+			if sessions == 0 {
+				idle = append(idle, c)
+			}
+		}
+	}
+	u.conns = alive
+	missing := u.cfg.MinIdle - len(idle)
+	if room := u.cfg.MaxSize - u.open; missing > room {
+		missing = room
+	}
+	u.mu.Unlock()
+
+	for _, c := range alive {
+		if err := c.ws.WriteControl(websocket.PingMessage, nil, now.Add(appConfig.WriteTimeout)); err != nil {
+			c.ws.Close()
+		}
+	}
+
+	// 预先建立连接，补充到最少空闲连接数
+	for i := 0; i < missing; i++ {
+		u.mu.Lock()
+		u.open++
+		u.mu.Unlock()
+
+		c, err := u.dial(context.Background())
+		u.mu.Lock()
+		if err != nil {
+			u.open--
+			u.mu.Unlock()
+			slog.Warn("Failed to pre-dial upstream v3 connection", "error", err)
+			return
+		}
+		c.pooled = true
+		u.conns = append(u.conns, c)
+		u.mu.Unlock()
+	}
+}
+
+// 连接统计信息
+func (u *v3Upstream) stats() map[string]interface{} {
+	u.mu.Lock()
+	open := u.open
+	active := 0
+	for _, c := range u.conns {
+		active += c.sessionCount()
+	}
+	u.mu.Unlock()
+
+	return map[string]interface{}{
+		"open":              open,
+		"max_size":          u.cfg.MaxSize,
+		"active_sessions":   active,
+		"sessions_per_conn": u.sessionsPerConn,
+		"dials":             u.dials.Load(),
+		"sessions":          u.sessions.Load(),
+	}
+}
+
+// 将OpenAI语速（0.5~2.0）转换为V3协议的 speech_rate（-50~100）
+func v3SpeechRate(speed float64) int {
+	rate := int((speed - 1.0) * 100)
+	if rate < -50 {
+		rate = -50
+	}
+	if rate > 100 {
+		rate = 100
+	}
+	return rate
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// 构造一条带事件编号的服务端帧，gzip 为 true 时压缩负载
+func v3ServerFrame(msgType byte, errCode uint32, event int32, id string, payload []byte, gzip bool) []byte {
+	compression := byte(0x00)
+	if gzip {
+		compression = 0x01
+		payload = gzipCompress(payload)
+	}
+	frame := []byte{0x11, msgType<<4 | v3FlagWithEvent, 0x10 | compression, 0x00}
+	if msgType == v3MsgError {
+		frame = binary.BigEndian.AppendUint32(frame, errCode)
+	}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(event))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(id)))
+	frame = append(frame, id...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestParseV3Frame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    v3Frame
+		wantErr bool
+	}{
+		{
+			name: "client session event round trip",
+			data: encodeV3Frame(v3EventTaskRequest, "session-1", []byte(`{"text":"hi"}`)),
+			want: v3Frame{msgType: v3MsgFullClientRequest, event: v3EventTaskRequest, id: "session-1", payload: []byte(`{"text":"hi"}`)},
+		},
+		{
+			name: "audio response",
+			data: v3ServerFrame(v3MsgAudioOnlyServer, 0, v3EventTTSResponse, "session-1", []byte{1, 2, 3}, false),
+			want: v3Frame{msgType: v3MsgAudioOnlyServer, event: v3EventTTSResponse, id: "session-1", payload: []byte{1, 2, 3}},
+		},
+		{
+			name: "compressed payload",
+			data: v3ServerFrame(v3MsgFullServerResponse, 0, v3EventSessionStarted, "session-1", []byte("{}"), true),
+			want: v3Frame{msgType: v3MsgFullServerResponse, event: v3EventSessionStarted, id: "session-1", payload: []byte("{}")},
+		},
+		{
+			name: "error frame",
+			data: v3ServerFrame(v3MsgError, 45000001, v3EventSessionFailed, "session-1", []byte(`{"message":"bad"}`), false),
+			want: v3Frame{msgType: v3MsgError, event: v3EventSessionFailed, id: "session-1", errCode: 45000001, payload: []byte(`{"message":"bad"}`)},
+		},
+		{
+			name:    "too short",
+			data:    []byte{0x11, 0x94},
+			wantErr: true,
+		},
+		{
+			name:    "missing event",
+			data:    []byte{0x11, 0x94, 0x10, 0x00, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "id longer than frame",
+			data:    v3ServerFrame(v3MsgFullServerResponse, 0, v3EventSessionStarted, "session-1", nil, false)[:12],
+			wantErr: true,
+		},
+		{
+			name:    "truncated payload",
+			data:    v3ServerFrame(v3MsgAudioOnlyServer, 0, v3EventTTSResponse, "session-1", []byte{1, 2, 3}, false)[:27],
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseV3Frame(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseV3Frame() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseV3Frame(): %v", err)
+			}
+			if got.msgType != tt.want.msgType || got.event != tt.want.event || got.id != tt.want.id ||
+				got.errCode != tt.want.errCode || string(got.payload) != string(tt.want.payload) {
+				t.Errorf("parseV3Frame() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestV3FrameErr(t *testing.T) {
+	tests := []struct {
+		name        string
+		frame       v3Frame
+		wantCode    int
+		wantMessage string
+	}{
+		{
+			name:        "error frame code",
+			frame:       v3Frame{msgType: v3MsgError, errCode: 45000001, payload: []byte(`{"status_code":55000000,"message":"invalid speaker"}`)},
+			wantCode:    45000001,
+			wantMessage: "invalid speaker",
+		},
+		{
+			name:        "status code from payload",
+			frame:       v3Frame{event: v3EventSessionFailed, payload: []byte(`{"status_code":55000000,"message":"server busy"}`)},
+			wantCode:    55000000,
+			wantMessage: "server busy",
+		},
+		{
+			name:        "plain text payload",
+			frame:       v3Frame{event: v3EventConnectionFailed, payload: []byte("connection refused")},
+			wantMessage: "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.frame.err()
+			if !errors.Is(err, ErrResponseParseFailed) {
+				t.Errorf("err = %v, want ErrResponseParseFailed", err)
+			}
+			var volcanoErr *VolcanoError
+			if !errors.As(err, &volcanoErr) {
+				t.Fatalf("err = %v, want VolcanoError", err)
+			}
+			if volcanoErr.Code != tt.wantCode || volcanoErr.Message != tt.wantMessage || volcanoErr.Event != tt.frame.event {
+				t.Errorf("VolcanoError = %+v, want code %d, message %q, event %d",
+					volcanoErr, tt.wantCode, tt.wantMessage, tt.frame.event)
+			}
+		})
+	}
+}
+
+// 测试用的会话，每条连接最多 sessionsPerConn 个会话，缓冲 buffer 帧
+func testV3Session(sessionsPerConn, buffer int) *v3Session {
+	return &v3Session{
+		id:       "session-1",
+		upstream: &v3Upstream{sessionsPerConn: sessionsPerConn},
+		frames:   make(chan v3Frame, buffer),
+		failed:   make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func TestV3SessionDeliverOverflow(t *testing.T) {
+	s := testV3Session(2, 2)
+	for i := int32(0); i < 4; i++ {
+		s.deliver(v3Frame{event: v3EventTTSResponse, payload: []byte{byte(i)}})
+	}
+
+	// 溢出前已缓冲的帧仍按顺序输出，之后返回溢出错误
+	for i := 0; i < 2; i++ {
+		f, err := s.next(context.Background())
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if f.payload[0] != byte(i) {
+			t.Errorf("frame %d payload = %v", i, f.payload)
+		}
+	}
+	_, err := s.next(context.Background())
+	if !errors.Is(err, errV3SessionOverflow) || !errors.Is(err, ErrAudioWriteFailed) {
+		t.Errorf("err = %v, want session overflow", err)
+	}
+
+	// 失败后投递的帧被丢弃
+	s.deliver(v3Frame{event: v3EventTTSResponse})
+	if len(s.frames) != 0 {
+		t.Errorf("frames buffered after failure: %d", len(s.frames))
+	}
+}
+
+func TestV3SessionDeliverBackPressure(t *testing.T) {
+	s := testV3Session(1, 2)
+
+	// 连接上只有一个会话时，缓冲已满则等待读取而不是使会话失败
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		for i := int32(0); i < 4; i++ {
+			s.deliver(v3Frame{event: v3EventTTSResponse, payload: []byte{byte(i)}})
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		f, err := s.next(context.Background())
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if f.payload[0] != byte(i) {
+			t.Errorf("frame %d payload = %v", i, f.payload)
+		}
+	}
+	<-delivered
+
+	// 会话关闭后不再等待
+	for i := 0; i < 2; i++ {
+		s.deliver(v3Frame{event: v3EventTTSResponse})
+	}
+	close(s.closed)
+	s.deliver(v3Frame{event: v3EventTTSResponse})
+}
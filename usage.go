@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// 用量记录中的请求端点
+const (
+	usageEndpointSpeech    = "speech"
+	usageEndpointStream    = "stream"
+	usageEndpointWebSocket = "websocket"
+)
+
+// 一次成功合成的用量记录，每条记录占用量日志的一行
+type usageRecord struct {
+	// Time 请求开始时间（UTC）
+	Time time.Time `json:"time"`
+	// KeyID 客户端密钥ID，见 apiKeyIdentity
+	KeyID string `json:"key_id"`
+	// KeyName 客户端密钥名称
+	KeyName string `json:"key_name"`
+	// Tenant 租户名称
+	Tenant string `json:"tenant"`
+	// Endpoint 请求端点：speech、stream 或 websocket
+	Endpoint string `json:"endpoint"`
+	// Voice 火山引擎 voice_type
+	Voice string `json:"voice"`
+	// Format 返回给客户端的音频格式
+	Format string `json:"format"`
+	// Characters 输入字符数
+	Characters int `json:"characters"`
+	// Cached 是否由音频缓存返回，缓存命中不调用火山引擎
+	Cached bool `json:"cached"`
+	// AudioBytes 火山引擎编码的音频字节数，不包括本地转码
+	AudioBytes int64 `json:"audio_bytes"`
+	// AudioDurationMs 音频时长（毫秒）
+	AudioDurationMs int64 `json:"audio_duration_ms"`
+	// FirstByteMs 从请求开始到第一帧音频的时间（毫秒）
+	FirstByteMs int64 `json:"first_byte_ms"`
+	// LatencyMs 从请求开始到合成完成的时间（毫秒）
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// 用量日志，以JSONL格式追加写入文件，服务重启后仍可统计
+type usageLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+
+	recorded atomic.Int64 // 写入的记录数
+	failed   atomic.Int64 // 写入失败的记录数
+}
+
+// 用量日志，在 main 中根据配置创建，为nil表示不记录用量
+var usageRecorder *usageLog
+
+// 打开用量日志文件，不存在时创建
+func openUsageLog(path string) (*usageLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage log: %w", err)
+	}
+	return &usageLog{path: path, file: file}, nil
+}
+
+// 追加一条用量记录，写入失败只打印警告，不影响请求
+func (l *usageLog) record(ctx context.Context, r usageRecord) {
+	data, err := json.Marshal(r)
+	if err == nil {
+		l.mu.Lock()
+		_, err = l.file.Write(append(data, '\n'))
+		l.mu.Unlock()
+	}
+	if err != nil {
+		l.failed.Add(1)
+		slog.WarnContext(ctx, "Failed to write usage record", "error", err)
+		return
+	}
+	l.recorded.Add(1)
+}
+
+// 用量日志统计信息
+func (l *usageLog) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"file":     l.path,
+		"recorded": l.recorded.Load(),
+		"failed":   l.failed.Load(),
+	}
+}
+
+// 一次合成的用量计量
+type usageMeter struct {
+	ctx      context.Context
+	endpoint string
+	params   synthesisParams
+	format   string
+	cached   bool
+
+	start     time.Time
+	firstByte time.Duration
+	audio     *audioMeter
+}
+
+// 开始计量一次合成，cacheStatus 为 cachedSynthesis 返回的缓存状态
+func startUsage(ctx context.Context, endpoint string, p synthesisParams, format audioFormat, cacheStatus string) *usageMeter {
+	return &usageMeter{
+		ctx:      ctx,
+		endpoint: endpoint,
+		params:   p,
+		format:   format.Name,
+		cached:   cacheStatus == cacheHit,
+		start:    time.Now(),
+		audio:    newAudioMeter(p.Encoding),
+	}
+}
+
+// 包装音频输出，计量音频字节数、时长和首字节时间
+func (u *usageMeter) wrap(onAudio audioHandler) audioHandler {
+	return func(audio []byte) error {
+		if u.firstByte == 0 {
+			u.firstByte = time.Since(u.start)
+		}
+		u.audio.write(audio)
+		return onAudio(audio)
+	}
+}
+
+// 结束计量，合成成功时记录指标并写入用量日志
+func (u *usageMeter) finish(characters int, err error) {
+	if err != nil {
+		return
+	}
+	observeSynthesis(u.endpoint, u.cached, characters, u.audio.bytes, u.firstByte, time.Since(u.start))
+	if usageRecorder == nil {
+		return
+	}
+	id := apiKeyIdentityFromContext(u.ctx)
+	usageRecorder.record(u.ctx, usageRecord{
+		Time:            u.start.UTC(),
+		KeyID:           id.ID,
+		KeyName:         id.Name,
+		Tenant:          id.Tenant.Name,
+		Endpoint:        u.endpoint,
+		Voice:           u.params.VoiceType,
+		Format:          u.format,
+		Characters:      characters,
+		Cached:          u.cached,
+		AudioBytes:      u.audio.bytes,
+		AudioDurationMs: u.audio.duration().Milliseconds(),
+		FirstByteMs:     u.firstByte.Milliseconds(),
+		LatencyMs:       time.Since(u.start).Milliseconds(),
+	})
+}
+
+// 为完整文本的合成记录用量
+func meteredSynthesis(ctx context.Context, endpoint string, p synthesisParams, format audioFormat, cacheStatus string, synthesize func(onAudio audioHandler) error) func(onAudio audioHandler) error {
+	return func(onAudio audioHandler) error {
+		u := startUsage(ctx, endpoint, p, format, cacheStatus)
+		err := synthesize(u.wrap(onAudio))
+		u.finish(utf8.RuneCountInString(p.Text), err)
+		return err
+	}
+}
+
+// 用量统计的分组维度
+const (
+	usageByKey    = "key"
+	usageByTenant = "tenant"
+	usageByDay    = "day"
+	usageByVoice  = "voice"
+)
+
+// 所有分组维度
+var usageDimensions = []string{usageByKey, usageByTenant, usageByDay, usageByVoice}
+
+// 用量统计查询
+type usageQuery struct {
+	From    time.Time // 包含
+	To      time.Time // 不包含
+	GroupBy []string
+	KeyID   string // 为空表示全部密钥
+	Tenant  string // 为空表示全部租户
+}
+
+// 一个分组的用量
+type usageRow struct {
+	KeyID              string `json:"key_id,omitempty"`
+	KeyName            string `json:"key_name,omitempty"`
+	Tenant             string `json:"tenant,omitempty"`
+	Day                string `json:"day,omitempty"`
+	Voice              string `json:"voice,omitempty"`
+	Requests           int64  `json:"requests"`
+	Characters         int64  `json:"characters"`
+	UpstreamCharacters int64  `json:"upstream_characters"` // 未命中缓存、由火山引擎合成的字符数
+	AudioBytes         int64  `json:"audio_bytes"`
+	AudioDurationMs    int64  `json:"audio_duration_ms"`
+	AvgLatencyMs       int64  `json:"avg_latency_ms"`
+
+	latencyMs int64
+}
+
+// 累加一条记录
+func (r *usageRow) add(rec usageRecord) {
+	r.Requests++
+	r.Characters += int64(rec.Characters)
+	if !rec.Cached {
+		r.UpstreamCharacters += int64(rec.Characters)
+	}
+	r.AudioBytes += rec.AudioBytes
+	r.AudioDurationMs += rec.AudioDurationMs
+	r.latencyMs += rec.LatencyMs
+	r.AvgLatencyMs = r.latencyMs / r.Requests
+}
+
+// 用量统计结果
+type usageReport struct {
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+	GroupBy []string   `json:"group_by"`
+	Rows    []usageRow `json:"rows"`
+	Total   usageRow   `json:"total"`
+}
+
+// 按查询条件汇总用量日志，格式错误的行（例如写了一半的最后一行）被跳过
+func (l *usageLog) aggregate(q usageQuery) (*usageReport, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage log: %w", err)
+	}
+	defer file.Close()
+
+	groups := make(map[string]*usageRow)
+	report := &usageReport{
+		From:    q.From.Format(time.DateOnly),
+		To:      q.To.AddDate(0, 0, -1).Format(time.DateOnly),
+		GroupBy: q.GroupBy,
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec usageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if rec.Time.Before(q.From) || !rec.Time.Before(q.To) ||
+			(q.KeyID != "" && rec.KeyID != q.KeyID) || (q.Tenant != "" && rec.Tenant != q.Tenant) {
+			continue
+		}
+
+		var row usageRow
+		for _, dim := range q.GroupBy {
+			switch dim {
+			case usageByKey:
+				row.KeyID, row.KeyName, row.Tenant = rec.KeyID, rec.KeyName, rec.Tenant
+			case usageByTenant:
+				row.Tenant = rec.Tenant
+			case usageByDay:
+				row.Day = rec.Time.UTC().Format(time.DateOnly)
+			case usageByVoice:
+				row.Voice = rec.Voice
+			}
+		}
+		group := strings.Join([]string{row.Day, row.Tenant, row.KeyID, row.Voice}, "\x00")
+		if groups[group] == nil {
+			groups[group] = &row
+		}
+		// 密钥名称可能被修改，使用最新的名称
+		if row.KeyName != "" {
+			groups[group].KeyName = row.KeyName
+		}
+		groups[group].add(rec)
+		report.Total.add(rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage log: %w", err)
+	}
+
+	report.Rows = make([]usageRow, 0, len(groups))
+	for _, row := range groups {
+		report.Rows = append(report.Rows, *row)
+	}
+	slices.SortFunc(report.Rows, func(a, b usageRow) int {
+		return strings.Compare(
+			strings.Join([]string{a.Day, a.Tenant, a.KeyID, a.Voice}, "\x00"),
+			strings.Join([]string{b.Day, b.Tenant, b.KeyID, b.Voice}, "\x00"))
+	})
+	return report, nil
+}
+
+// 以CSV格式写出统计结果，列为分组维度和用量指标
+func (r *usageReport) writeCSV(w *csv.Writer) error {
+	var header []string
+	for _, dim := range r.GroupBy {
+		switch dim {
+		case usageByKey:
+			header = append(header, "key_id", "key_name", "tenant")
+		case usageByTenant:
+			if !slices.Contains(r.GroupBy, usageByKey) {
+				header = append(header, "tenant")
+			}
+		default:
+			header = append(header, dim)
+		}
+	}
+	header = append(header, "requests", "characters", "upstream_characters", "audio_bytes", "audio_duration_ms", "avg_latency_ms")
+	if err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, row := range r.Rows {
+		var record []string
+		for _, column := range header {
+			switch column {
+			case "key_id":
+				record = append(record, row.KeyID)
+			case "key_name":
+				record = append(record, row.KeyName)
+			case "tenant":
+				record = append(record, row.Tenant)
+			case "day":
+				record = append(record, row.Day)
+			case "voice":
+				record = append(record, row.Voice)
+			}
+		}
+		record = append(record,
+			strconv.FormatInt(row.Requests, 10),
+			strconv.FormatInt(row.Characters, 10),
+			strconv.FormatInt(row.UpstreamCharacters, 10),
+			strconv.FormatInt(row.AudioBytes, 10),
+			strconv.FormatInt(row.AudioDurationMs, 10),
+			strconv.FormatInt(row.AvgLatencyMs, 10))
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
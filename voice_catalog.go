@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// VoiceCatalog 语音目录
+// 将 OpenAI 语音名称（alloy、echo、nova 等）和自定义别名映射到火山引擎 voice_type，
+// 并通过白名单限制可使用的火山引擎语音
+type VoiceCatalog struct {
+	// Aliases 语音别名到火山引擎 voice_type 的映射，别名不区分大小写
+	Aliases map[string]string `json:"aliases"`
+	// Allowed 允许使用的火山引擎 voice_type 白名单，为空表示不限制
+	Allowed []string `json:"allowed"`
+
+	allowed map[string]struct{}
+}
+
+// 火山引擎 voice_type 的格式，例如 BV001_streaming、zh_female_shuangkuaisisi_moon_bigtts
+// OpenAI 语音名称不包含下划线，因此不会被误判为原始语音ID
+var volcanoVoiceIDPattern = regexp.MustCompile(`^[A-Za-z0-9]+(_[A-Za-z0-9]+)+$`)
+
+// 语音目录，默认为空目录，所有请求回退到 BYTEDANCE_TTS_VOICE_TYPE
+var voiceCatalog = &VoiceCatalog{}
+
+// LoadVoiceCatalog 从JSON配置文件加载语音目录，路径为空时返回空目录
+func LoadVoiceCatalog(path string) (*VoiceCatalog, error) {
+	catalog := &VoiceCatalog{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read voice catalog: %w", err)
+		}
+		if err := json.Unmarshal(data, catalog); err != nil {
+			return nil, fmt.Errorf("failed to parse voice catalog: %w", err)
+		}
+	}
+
+	if err := catalog.init(); err != nil {
+		return nil, err
+	}
+
+	return catalog, nil
+}
+
+// 规范化别名并构建白名单索引
+func (vc *VoiceCatalog) init() error {
+	aliases := make(map[string]string, len(vc.Aliases))
+	for alias, voiceType := range vc.Aliases {
+		key := strings.ToLower(strings.TrimSpace(alias))
+		if key == "" || voiceType == "" {
+			return fmt.Errorf("invalid voice catalog entry: %q -> %q", alias, voiceType)
+		}
+		aliases[key] = voiceType
+	}
+	vc.Aliases = aliases
+
+	vc.allowed = make(map[string]struct{}, len(vc.Allowed))
+	for _, voiceType := range vc.Allowed {
+		vc.allowed[voiceType] = struct{}{}
+	}
+
+	// 别名指向的语音也必须在白名单内，避免配置错误在请求时才暴露
+	for alias, voiceType := range vc.Aliases {
+		if !vc.isAllowed(voiceType) {
+			return fmt.Errorf("voice catalog alias %q maps to %q which is not in the allowed list", alias, voiceType)
+		}
+	}
+
+	return nil
+}
+
+// 检查火山引擎语音是否在白名单内
+func (vc *VoiceCatalog) isAllowed(voiceType string) bool {
+	if len(vc.allowed) == 0 {
+		return true
+	}
+	_, ok := vc.allowed[voiceType]
+	return ok
+}
+
+// Resolve 将请求中的 voice 解析为火山引擎 voice_type
+// 解析顺序：别名映射 -> 原始火山引擎语音ID -> 回退到 fallback（BYTEDANCE_TTS_VOICE_TYPE）
+func (vc *VoiceCatalog) Resolve(voice, fallback string) (string, error) {
+	if voiceType, ok := vc.Aliases[strings.ToLower(strings.TrimSpace(voice))]; ok {
+		return voiceType, nil
+	}
+
+	// 白名单中的语音ID直接透传
+	if _, ok := vc.allowed[voice]; ok {
+		return voice, nil
+	}
+
+	// 看起来像火山引擎语音ID，但不在白名单内
+	if volcanoVoiceIDPattern.MatchString(voice) {
+		if !vc.isAllowed(voice) {
+			return "", fmt.Errorf("%w: %s", ErrVoiceNotAllowed, voice)
+		}
+		return voice, nil
+	}
+
+	// 没有任何映射时使用默认语音
+	return fallback, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVoiceCatalogResolve(t *testing.T) {
+	catalog := &VoiceCatalog{
+		Aliases: map[string]string{
+			"Alloy":    "BV001_streaming",
+			"narrator": "zh_female_shuangkuaisisi_moon_bigtts",
+		},
+		Allowed: []string{"BV001_streaming", "BV002_streaming", "zh_female_shuangkuaisisi_moon_bigtts"},
+	}
+	if err := catalog.init(); err != nil {
+		t.Fatal(err)
+	}
+	open := &VoiceCatalog{}
+	if err := open.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		catalog *VoiceCatalog
+		voice   string
+		want    string
+		wantErr error
+	}{
+		{name: "alias is case insensitive", catalog: catalog, voice: "alloy", want: "BV001_streaming"},
+		{name: "alias is trimmed", catalog: catalog, voice: " NARRATOR ", want: "zh_female_shuangkuaisisi_moon_bigtts"},
+		{name: "allowed voice ID passes through", catalog: catalog, voice: "BV002_streaming", want: "BV002_streaming"},
+		{name: "voice ID outside allowed list", catalog: catalog, voice: "BV700_streaming", wantErr: ErrVoiceNotAllowed},
+		{name: "unknown OpenAI voice falls back", catalog: catalog, voice: "nova", want: "BV_fallback"},
+		{name: "empty voice falls back", catalog: catalog, voice: "", want: "BV_fallback"},
+		{name: "any voice ID without allowed list", catalog: open, voice: "BV700_streaming", want: "BV700_streaming"},
+		{name: "OpenAI voice without aliases falls back", catalog: open, voice: "alloy", want: "BV_fallback"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.catalog.Resolve(tt.voice, "BV_fallback")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Resolve(%q) err = %v, want %v", tt.voice, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve(%q) = %q, want %q", tt.voice, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadVoiceCatalog(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid catalog", content: `{"aliases": {"alloy": "BV001_streaming"}, "allowed": ["BV001_streaming"]}`},
+		{name: "alias outside allowed list", content: `{"aliases": {"alloy": "BV002_streaming"}, "allowed": ["BV001_streaming"]}`, wantErr: true},
+		{name: "empty voice type", content: `{"aliases": {"alloy": ""}}`, wantErr: true},
+		{name: "invalid JSON", content: `{"aliases":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "voices.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadVoiceCatalog(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadVoiceCatalog() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := LoadVoiceCatalog(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadVoiceCatalog() succeeded for a missing file")
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gorilla/websocket"
+)
+
+// 下游WebSocket心跳配置
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+)
+
+// 等待处理的请求消息上限，超过时拒绝新消息，读取协程不会因合成耗时而阻塞
+const wsMaxQueuedMessages = 64
+
+// 下游WebSocket控制消息类型
+const (
+	wsMessageStart = "start"
+	wsMessageEnd   = "end"
+	wsMessageError = "error"
+
+	// 增量文本输入
+	wsInputStart  = "input.start"
+	wsInputAppend = "input.append"
+	wsInputEnd    = "input.end"
+)
+
+// 客户端在增量文本输入期间断开连接
+var errWebSocketClosed = errors.New("websocket connection closed")
+
+// 下游WebSocket连接升级器
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 64 * 1024,
+	// 与CORS中间件保持一致，允许任意来源
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocket合成请求，在OpenAI TTS请求基础上增加可选的客户端请求ID
+// Type 为空表示完整文本请求，否则为增量文本输入消息
+type wsSynthesisRequest struct {
+	OpenAITTSRequest
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+// WebSocket控制消息
+type wsControlMessage struct {
+	Type        string `json:"type"`
+	ID          string `json:"id,omitempty"`
+	Format      string `json:"format,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Cache       string `json:"cache,omitempty"`
+	AudioBytes  int    `json:"audio_bytes,omitempty"`
+	*ErrorResponse
+}
+
+// 下游WebSocket连接，写操作加锁以便心跳与音频帧并发写出
+type wsClientConn struct {
+	conn      *websocket.Conn
+	requestID string // 升级请求的请求ID，错误消息中返回给客户端
+	writeMu   sync.Mutex
+
+	// 升级请求已由限流中间件扣除一个请求的额度，第一条合成请求使用这次额度
+	upgradeChargeUsed bool
+}
+
+// 写出一条消息
+func (wc *wsClientConn) write(messageType int, data []byte) error {
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+
+	wc.conn.SetWriteDeadline(time.Now().Add(appConfig.WriteTimeout))
+	return wc.conn.WriteMessage(messageType, data)
+}
+
+// 扣除一条合成请求的限流额度：一个请求和输入字符数
+// 第一条合成请求的请求数已在升级时扣除，只扣除字符数
+func (wc *wsClientConn) takeRateLimit(ctx context.Context, chars int) error {
+	requests := 1
+	if !wc.upgradeChargeUsed {
+		requests = 0
+	}
+	if err := takeRateLimit(ctx, requests, chars); err != nil {
+		return err
+	}
+	wc.upgradeChargeUsed = true
+	return nil
+}
+
+// 写出一条JSON控制消息
+func (wc *wsClientConn) writeControl(msg wsControlMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return wc.write(websocket.TextMessage, data)
+}
+
+// 写出错误控制消息
+func (wc *wsClientConn) writeError(id string, err error) error {
+	statusCode, errorType := synthesisErrorStatus(err)
+	return wc.writeControl(wsControlMessage{
+		Type: wsMessageError,
+		ID:   id,
+		ErrorResponse: &ErrorResponse{
+			Error:     errorType,
+			Code:      statusCode,
+			Message:   err.Error(),
+			RequestID: wc.requestID,
+		},
+	})
+}
+
+// 处理下游WebSocket TTS连接
+// 客户端发送JSON格式的合成请求，服务端依次返回start控制消息、二进制音频帧和end控制消息
+// 同一连接上可以依次发送多个请求
+func handleTTSWebSocket(c *gin.Context) {
+	// 增加活动连接计数
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
+
+	// 验证并发连接数
+	currentConnections := activeConnections.Load()
+	if currentConnections > int32(appConfig.MaxConnections) {
+		writeErrorResponse(c, &ErrorResponse{
+			Error:   "service_overloaded",
+			Code:    http.StatusServiceUnavailable,
+			Message: fmt.Sprintf("Too many concurrent connections, maximum is %d", appConfig.MaxConnections),
+		})
+		return
+	}
+
+	// API密钥验证，浏览器无法设置WebSocket请求头，允许通过api_key查询参数传递
+	apiKey := extractAPIKey(c)
+	if apiKey == "" {
+		apiKey = c.Query("api_key")
+	}
+	identity, errResp := authenticateAPIKey(apiKey, scopeSpeech)
+	if errResp != nil {
+		writeErrorResponse(c, errResp)
+		return
+	}
+
+	// 按API密钥和优先级调度并发调用名额，优先级也可通过 priority 查询参数指定
+	callCtx, err := callContext(c, apiKey, identity)
+	if err != nil {
+		writeSynthesisError(c, err)
+		return
+	}
+
+	// Upgrade 自行写出响应头，请求ID需要单独传入
+	requestID := requestIDFromContext(callCtx)
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, http.Header{requestIDHeader: {requestID}})
+	if err != nil {
+		// Upgrade 已经向客户端返回了错误响应
+		slog.WarnContext(callCtx, "WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	client := &wsClientConn{conn: conn, requestID: requestID}
+	conn.SetReadLimit(int64(appConfig.MaxRequestSizeMB) * 1024 * 1024)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	// 客户端断开连接时取消正在排队或进行中的合成
+	ctx, cancel := context.WithCancel(callCtx)
+	defer cancel()
+
+	// 独立协程读取请求，保证合成期间也能处理pong和关闭帧
+	requests := make(chan []byte, wsMaxQueuedMessages)
+	readDone := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(readDone)
+		defer cancel()
+		client.readRequests(requests)
+	}()
+
+	// 定期发送ping，合成期间也保持心跳
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				client.writeMu.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(appConfig.WriteTimeout))
+				client.writeMu.Unlock()
+				if err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// 依次处理请求，保证音频按请求顺序返回
+	for {
+		select {
+		case message := <-requests:
+			if err := handleWebSocketMessage(ctx, client, message, requests, readDone); err != nil {
+				// 写入客户端失败，连接已不可用
+				return
+			}
+		case <-readDone:
+			return
+		}
+	}
+}
+
+// 读取客户端消息并放入请求队列，直到连接断开
+// 队列已满时以error消息拒绝新消息，不等待合成完成，以便继续处理pong和关闭帧
+func (wc *wsClientConn) readRequests(requests chan<- []byte) {
+	for {
+		messageType, message, err := wc.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		if messageType != websocket.TextMessage {
+			wc.writeError("", fmt.Errorf("%w: synthesis requests must be JSON text messages", ErrInvalidRequest))
+			continue
+		}
+		select {
+		case requests <- message:
+		default:
+			// 尽量带上被拒绝消息的ID，便于客户端重发
+			var msg struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(message, &msg)
+			wc.writeError(msg.ID, fmt.Errorf("%w: more than %d messages are waiting to be processed on this connection",
+				ErrRateLimited, wsMaxQueuedMessages))
+		}
+	}
+}
+
+// 处理一条WebSocket请求消息，只有写入客户端失败时返回错误
+func handleWebSocketMessage(ctx context.Context, client *wsClientConn, message []byte, requests <-chan []byte, readDone <-chan struct{}) error {
+	// 解析请求
+	var req wsSynthesisRequest
+	if err := json.Unmarshal(message, &req); err != nil {
+		return client.writeError("", fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+	}
+
+	switch req.Type {
+	case "":
+		return handleWebSocketSynthesis(ctx, client, req)
+	case wsInputStart:
+		return handleWebSocketTextStream(ctx, client, req, requests, readDone)
+	default:
+		return client.writeError(req.ID, fmt.Errorf("%w: unexpected message type %q", ErrInvalidRequest, req.Type))
+	}
+}
+
+// 处理一条完整文本的合成请求
+func handleWebSocketSynthesis(ctx context.Context, client *wsClientConn, req wsSynthesisRequest) error {
+	if err := binding.Validator.ValidateStruct(&req.OpenAITTSRequest); err != nil {
+		return client.writeError(req.ID, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+	}
+
+	// 按租户的设置验证请求参数并转换为合成参数
+	params, format, err := prepareSynthesis(tenantFromContext(ctx), req.OpenAITTSRequest)
+	if err != nil {
+		return client.writeError(req.ID, err)
+	}
+
+	// 每条合成请求都扣除一个请求和输入字符数的限流额度
+	if err := client.takeRateLimit(ctx, utf8.RuneCountInString(params.Text)); err != nil {
+		return client.writeError(req.ID, err)
+	}
+
+	// 在调用火山引擎之前扣除配额，合成失败且没有返回音频时退还
+	quota, err := reserveQuota(ctx, 1, utf8.RuneCountInString(params.Text))
+	if err != nil {
+		return client.writeError(req.ID, err)
+	}
+
+	cacheStatus, _, synthesize := cachedSynthesis(ctx, params)
+	synthesize = quota.settle(meteredSynthesis(ctx, usageEndpointWebSocket, params, format, cacheStatus, synthesize))
+	return runWebSocketSynthesis(client, req.ID, format, cacheStatus, synthesize)
+}
+
+// 处理增量文本输入：input.start 之后依次接收 input.append，收到 input.end 时结束
+// 文本按句切分合成，音频在输入过程中持续返回
+func handleWebSocketTextStream(ctx context.Context, client *wsClientConn, start wsSynthesisRequest, requests <-chan []byte, readDone <-chan struct{}) error {
+	if start.Model == "" {
+		return client.writeError(start.ID, fmt.Errorf("%w: model parameter cannot be empty", ErrInvalidRequest))
+	}
+
+	params, format, err := prepareSynthesisOptions(tenantFromContext(ctx), start.OpenAITTSRequest)
+	if err != nil {
+		return client.writeError(start.ID, err)
+	}
+	if err := client.takeRateLimit(ctx, 0); err != nil {
+		return client.writeError(start.ID, err)
+	}
+
+	// 开始时扣除一个请求的配额，字符数的配额在写入文本时扣除，合成失败且没有输出音频时全部退还
+	quota, err := reserveQuota(ctx, 1, 0)
+	if err != nil {
+		return client.writeError(start.ID, err)
+	}
+
+	return runWebSocketSynthesis(client, start.ID, format, "", func(onAudio audioHandler) error {
+		u := startUsage(ctx, usageEndpointWebSocket, params, format, "")
+		ts := startTextStream(ctx, params, quota, u.wrap(onAudio))
+		err := handleWebSocketTextInput(ts, client, start, requests, readDone)
+		u.finish(ts.chars, err)
+		return err
+	})
+}
+
+// 将 input.append 消息中的文本写入增量合成，收到 input.end 时完成合成
+func handleWebSocketTextInput(ts *textStream, client *wsClientConn, start wsSynthesisRequest, requests <-chan []byte, readDone <-chan struct{}) error {
+	if start.Input != "" {
+		if err := ts.Write(start.Input); err != nil {
+			ts.Abort()
+			return err
+		}
+	}
+
+	for {
+		select {
+		case message := <-requests:
+			var msg wsSynthesisRequest
+			if err := json.Unmarshal(message, &msg); err != nil {
+				client.writeError(start.ID, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+				continue
+			}
+
+			switch msg.Type {
+			case wsInputAppend:
+				if err := ts.Write(msg.Text); err != nil {
+					ts.Abort()
+					return err
+				}
+			case wsInputEnd:
+				return ts.Close()
+			default:
+				client.writeError(start.ID, fmt.Errorf("%w: expected %s or %s during streaming input, got %q",
+					ErrInvalidRequest, wsInputAppend, wsInputEnd, msg.Type))
+			}
+		case <-readDone:
+			ts.Abort()
+			return errWebSocketClosed
+		}
+	}
+}
+
+// 执行一次合成并以控制消息和二进制音频帧返回，只有写入客户端失败时返回错误
+// cacheStatus 为空表示不经过音频缓存
+func runWebSocketSynthesis(client *wsClientConn, id string, format audioFormat, cacheStatus string, synthesize func(onAudio audioHandler) error) error {
+	// 收到第一帧音频时才发送start消息，以便在此之前的错误只产生error消息
+	started := false
+	startStream := func() error {
+		if started {
+			return nil
+		}
+		started = true
+		return client.writeControl(wsControlMessage{
+			Type:        wsMessageStart,
+			ID:          id,
+			Format:      format.Name,
+			ContentType: format.ContentType,
+			Cache:       cacheStatus,
+		})
+	}
+
+	audioBytes := 0
+	var writeErr error
+	pipeline, err := newAudioPipeline(format, func(audio []byte) error {
+		if err := startStream(); err != nil {
+			writeErr = err
+			return err
+		}
+		audioBytes += len(audio)
+		if err := client.write(websocket.BinaryMessage, audio); err != nil {
+			writeErr = err
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return client.writeError(id, err)
+	}
+
+	err = synthesize(pipeline.Write)
+	if err != nil {
+		pipeline.Abort()
+	} else {
+		err = pipeline.Close()
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if errors.Is(err, errWebSocketClosed) {
+		return err
+	}
+	if err != nil {
+		return client.writeError(id, err)
+	}
+
+	// 没有收到任何音频时也发送start消息，保持消息序列完整
+	if err := startStream(); err != nil {
+		return err
+	}
+
+	return client.writeControl(wsControlMessage{
+		Type:       wsMessageEnd,
+		ID:         id,
+		Format:     format.Name,
+		AudioBytes: audioBytes,
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketReadRequestsQueueFull(t *testing.T) {
+	// 服务端只读取消息，不处理请求队列，模拟合成耗时较长
+	requests := make(chan []byte, wsMaxQueuedMessages)
+	readDone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(readDone)
+		client := &wsClientConn{conn: conn, requestID: "req-test"}
+		client.readRequests(requests)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 连续发送超过队列上限的消息，多出的一条以error消息拒绝
+	for i := 0; i <= wsMaxQueuedMessages; i++ {
+		msg := fmt.Sprintf(`{"id":"req-%d","model":"tts-1","input":"你好"}`, i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply wsControlMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	wantID := fmt.Sprintf("req-%d", wsMaxQueuedMessages)
+	if reply.Type != wsMessageError || reply.ID != wantID || reply.ErrorResponse == nil ||
+		reply.Code != http.StatusTooManyRequests || reply.RequestID != "req-test" {
+		t.Errorf("reply = %+v, want rate limited error for %s", reply, wantID)
+	}
+	if len(requests) != wsMaxQueuedMessages {
+		t.Errorf("queued requests = %d, want %d", len(requests), wsMaxQueuedMessages)
+	}
+
+	// 队列已满时仍然响应ping
+	pong := make(chan struct{}, 1)
+	conn.SetPongHandler(func(string) error {
+		pong <- struct{}{}
+		return nil
+	})
+	if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	go conn.ReadMessage()
+	select {
+	case <-pong:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pong while the request queue is full")
+	}
+
+	// 客户端断开连接后读取结束
+	conn.Close()
+	select {
+	case <-readDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readRequests did not return after the client disconnected")
+	}
+}
+
+func TestWebSocketReadRequestsBinaryMessage(t *testing.T) {
+	requests := make(chan []byte, wsMaxQueuedMessages)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		(&wsClientConn{conn: conn}).readRequests(requests)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("audio")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply wsControlMessage
+	if err := json.Unmarshal(data, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != wsMessageError || reply.ErrorResponse == nil || reply.Code != http.StatusBadRequest {
+		t.Errorf("reply = %s, want invalid request error", data)
+	}
+	if len(requests) != 0 {
+		t.Errorf("queued requests = %d, want 0", len(requests))
+	}
+}
+
+func TestWebSocketTakeRateLimit(t *testing.T) {
+	// 升级请求由限流中间件扣除一个请求
+	rl := newRateLimiter(rateLimitConfig{}, rateLimitConfig{RequestsPerMinute: 3, CharsPerMinute: 100})
+	h := rl.handle("", "192.0.2.1")
+	if err := h.take(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx := withRateLimit(context.Background(), h)
+	client := &wsClientConn{}
+
+	tests := []struct {
+		name    string
+		chars   int
+		wantErr error
+	}{
+		{name: "first synthesis uses the upgrade request", chars: 10},
+		{name: "rejected synthesis", chars: 200, wantErr: ErrTextTooLong},
+		{name: "second synthesis", chars: 10},
+		{name: "third synthesis", chars: 10},
+		{name: "requests exhausted", chars: 10, wantErr: ErrRateLimited},
+	}
+	for _, tt := range tests {
+		if err := client.takeRateLimit(ctx, tt.chars); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}